@@ -16,6 +16,9 @@ func init() {
 	http.HandleFunc("/", randomize.InformationPage)
 	http.HandleFunc("/dashboard", randomize.Dashboard)
 
+	// Pages that take a project key are wrapped with LegacyKeys so
+	// that old "owner::name" keys are redirected to the new key.
+
 	// Project creation pages
 	http.HandleFunc("/create_project_step1", randomize.CreateProjectStep1)
 	http.HandleFunc("/create_project_step2", randomize.CreateProjectStep2)
@@ -28,11 +31,11 @@ func init() {
 	http.HandleFunc("/create_project_step9", randomize.CreateProjectStep9)
 
 	// Copy project pages
-	http.HandleFunc("/copy_project", randomize.CopyProject)
-	http.HandleFunc("/copy_project_completed", randomize.CopyProjectCompleted)
+	http.HandleFunc("/copy_project", randomize.LegacyKeys(randomize.CopyProject))
+	http.HandleFunc("/copy_project_completed", randomize.LegacyKeys(randomize.CopyProjectCompleted))
 
 	// Import/export pages
-	http.HandleFunc("/export_project", randomize.ExportProject)
+	http.HandleFunc("/export_project", randomize.LegacyKeys(randomize.ExportProject))
 	http.HandleFunc("/import_project_step1", randomize.ImportProjectStep1)
 	http.HandleFunc("/import_project_step2", randomize.ImportProjectStep2)
 
@@ -41,34 +44,71 @@ func init() {
 	http.HandleFunc("/delete_project_step2", randomize.DeleteProjectStep2)
 	http.HandleFunc("/delete_project_step3", randomize.DeleteProjectStep3)
 
-	http.HandleFunc("/project_dashboard", randomize.ProjectDashboard)
-	http.HandleFunc("/edit_sharing", randomize.EditSharing)
-	http.HandleFunc("/edit_sharing_confirm", randomize.EditSharingConfirm)
+	http.HandleFunc("/project_dashboard", randomize.LegacyKeys(randomize.ProjectDashboard))
+	http.HandleFunc("/edit_sharing", randomize.LegacyKeys(randomize.EditSharing))
+	http.HandleFunc("/edit_sharing_confirm", randomize.LegacyKeys(randomize.EditSharingConfirm))
+	http.HandleFunc("/respond_invitation", randomize.RespondInvitation)
+	http.HandleFunc("/transfer_ownership", randomize.LegacyKeys(randomize.TransferOwnership))
+	http.HandleFunc("/transfer_ownership_completed", randomize.LegacyKeys(randomize.TransferOwnershipCompleted))
+	http.HandleFunc("/edit_project_info", randomize.LegacyKeys(randomize.EditProjectInfo))
+	http.HandleFunc("/edit_project_info_completed", randomize.LegacyKeys(randomize.EditProjectInfoCompleted))
+	http.HandleFunc("/amend_project", randomize.LegacyKeys(randomize.AmendProject))
+	http.HandleFunc("/amend_project_completed", randomize.LegacyKeys(randomize.AmendProjectCompleted))
+	http.HandleFunc("/manage_arms", randomize.LegacyKeys(randomize.ManageArms))
+	http.HandleFunc("/manage_arms_completed", randomize.LegacyKeys(randomize.ManageArmsCompleted))
+	http.HandleFunc("/enroll_member", randomize.LegacyKeys(randomize.EnrollMember))
+	http.HandleFunc("/enroll_member_confirm", randomize.LegacyKeys(randomize.EnrollMemberConfirm))
+	http.HandleFunc("/edit_targets", randomize.LegacyKeys(randomize.EditTargets))
+	http.HandleFunc("/edit_targets_completed", randomize.LegacyKeys(randomize.EditTargetsCompleted))
+	http.HandleFunc("/edit_window", randomize.LegacyKeys(randomize.EditWindow))
+	http.HandleFunc("/edit_window_completed", randomize.LegacyKeys(randomize.EditWindowCompleted))
+	http.HandleFunc("/edit_criteria", randomize.LegacyKeys(randomize.EditCriteria))
+	http.HandleFunc("/edit_subject_ids", randomize.LegacyKeys(randomize.EditSubjectIDs))
+	http.HandleFunc("/edit_subject_ids_completed", randomize.LegacyKeys(randomize.EditSubjectIDsCompleted))
+	http.HandleFunc("/edit_criteria_completed", randomize.LegacyKeys(randomize.EditCriteriaCompleted))
+	http.HandleFunc("/screening_log", randomize.LegacyKeys(randomize.ScreeningLog))
+	http.HandleFunc("/screening_log_completed", randomize.LegacyKeys(randomize.ScreeningLogCompleted))
+	http.HandleFunc("/view_screening_log", randomize.LegacyKeys(randomize.ViewScreeningLog))
+	http.HandleFunc("/reinstate_subject", randomize.LegacyKeys(randomize.ReinstateSubject))
+	http.HandleFunc("/reinstate_subject_completed", randomize.LegacyKeys(randomize.ReinstateSubjectCompleted))
+	http.HandleFunc("/correct_covariate", randomize.LegacyKeys(randomize.CorrectCovariate))
+	http.HandleFunc("/correct_covariate_completed", randomize.LegacyKeys(randomize.CorrectCovariateCompleted))
+	http.HandleFunc("/view_audit", randomize.LegacyKeys(randomize.ViewAudit))
+	http.HandleFunc("/verify_audit", randomize.LegacyKeys(randomize.VerifyAudit))
+	http.HandleFunc("/signing_setup", randomize.SigningSetup)
+	http.HandleFunc("/signing_setup_completed", randomize.SigningSetupCompleted)
+	http.HandleFunc("/change_requests", randomize.LegacyKeys(randomize.ChangeRequests))
+	http.HandleFunc("/decide_change_request", randomize.LegacyKeys(randomize.DecideChangeRequest))
+	http.HandleFunc("/check_consistency", randomize.LegacyKeys(randomize.CheckConsistency))
+	http.HandleFunc("/rebuild_aggregates", randomize.LegacyKeys(randomize.RebuildAggregates))
+	http.HandleFunc("/migrate_projects", randomize.MigrateProjects)
+	http.HandleFunc("/lookup_subject", randomize.LegacyKeys(randomize.LookupSubject))
+	http.HandleFunc("/api/subject", randomize.LegacyKeys(randomize.LookupSubjectAPI))
 
 	// Treatment assignment pages
-	http.HandleFunc("/assign_treatment_input", randomize.AssignTreatmentInput)
-	http.HandleFunc("/assign_treatment_confirm", randomize.AssignTreatmentConfirm)
-	http.HandleFunc("/assign_treatment", randomize.AssignTreatment)
+	http.HandleFunc("/assign_treatment_input", randomize.LegacyKeys(randomize.AssignTreatmentInput))
+	http.HandleFunc("/assign_treatment_confirm", randomize.LegacyKeys(randomize.AssignTreatmentConfirm))
+	http.HandleFunc("/assign_treatment", randomize.LegacyKeys(randomize.AssignTreatment))
 
-	http.HandleFunc("/view_statistics", randomize.ViewStatistics)
-	http.HandleFunc("/view_comments", randomize.ViewComments)
-	http.HandleFunc("/add_comment", randomize.AddComment)
-	http.HandleFunc("/confirm_add_comment", randomize.ConfirmAddComment)
-	http.HandleFunc("/view_complete_data", randomize.ViewCompleteData)
+	http.HandleFunc("/view_statistics", randomize.LegacyKeys(randomize.ViewStatistics))
+	http.HandleFunc("/view_comments", randomize.LegacyKeys(randomize.ViewComments))
+	http.HandleFunc("/add_comment", randomize.LegacyKeys(randomize.AddComment))
+	http.HandleFunc("/confirm_add_comment", randomize.LegacyKeys(randomize.ConfirmAddComment))
+	http.HandleFunc("/view_complete_data", randomize.LegacyKeys(randomize.ViewCompleteData))
 
 	// Remove subject pages
-	http.HandleFunc("/remove_subject", randomize.RemoveSubject)
-	http.HandleFunc("/remove_subject_confirm", randomize.RemoveSubjectConfirm)
-	http.HandleFunc("/remove_subject_completed", randomize.RemoveSubjectCompleted)
+	http.HandleFunc("/remove_subject", randomize.LegacyKeys(randomize.RemoveSubject))
+	http.HandleFunc("/remove_subject_confirm", randomize.LegacyKeys(randomize.RemoveSubjectConfirm))
+	http.HandleFunc("/remove_subject_completed", randomize.LegacyKeys(randomize.RemoveSubjectCompleted))
 
 	// Edit assignment pages
-	http.HandleFunc("/edit_assignment", randomize.EditAssignment)
-	http.HandleFunc("/edit_assignment_confirm", randomize.EditAssignmentConfirm)
-	http.HandleFunc("/edit_assignment_completed", randomize.EditAssignmentCompleted)
+	http.HandleFunc("/edit_assignment", randomize.LegacyKeys(randomize.EditAssignment))
+	http.HandleFunc("/edit_assignment_confirm", randomize.LegacyKeys(randomize.EditAssignmentConfirm))
+	http.HandleFunc("/edit_assignment_completed", randomize.LegacyKeys(randomize.EditAssignmentCompleted))
 
 	// Close or open project for enrollment pages
-	http.HandleFunc("/openclose_project", randomize.OpenCloseProject)
-	http.HandleFunc("/openclose_completed", randomize.OpenCloseCompleted)
+	http.HandleFunc("/openclose_project", randomize.LegacyKeys(randomize.OpenCloseProject))
+	http.HandleFunc("/openclose_completed", randomize.LegacyKeys(randomize.OpenCloseCompleted))
 }
 
 /*
@@ -0,0 +1,425 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Amendment records a protocol amendment that changed the variables,
+// levels or treatment groups of a project after it was created.
+type Amendment struct {
+
+	// Description is the author's description of the amendment
+	Description string
+
+	// Change is a generated summary of what was changed
+	Change string
+
+	// EffectiveDate is the date on which the amendment takes effect
+	EffectiveDate time.Time
+
+	// Created is the time at which the amendment was recorded
+	Created time.Time
+
+	// Author is the person who recorded the amendment
+	Author string
+}
+
+// maxLevels returns the number of levels of the variable with the
+// most levels, or 1 if there are no variables.  CellTotals stores this
+// many levels for every variable.
+func (proj *Project) maxLevels() int {
+	n := 1
+	for _, va := range proj.Variables {
+		if len(va.Levels) > n {
+			n = len(va.Levels)
+		}
+	}
+	return n
+}
+
+// resizeCells returns cell totals laid out for p variables, q groups
+// and r levels per variable, containing the counts from cells, which
+// are laid out for p0 variables, q0 groups and r0 levels per
+// variable.  Variables, groups and levels keep their positions, so
+// the new dimensions must be at least as large as the old ones.
+func resizeCells(cells []float64, p0, q0, r0, p, q, r int) []float64 {
+
+	newCells := make([]float64, p*q*r)
+	for v := 0; v < p0; v++ {
+		for l := 0; l < r0; l++ {
+			for g := 0; g < q0; g++ {
+				newCells[q*r*v+q*l+g] = cells[q0*r0*v+q0*l+g]
+			}
+		}
+	}
+
+	return newCells
+}
+
+// amend applies a change to the variables or groups of the project,
+// and re-lays out the cell totals so that existing counts keep their
+// meaning.
+func (proj *Project) amend(change func()) {
+
+	p0 := len(proj.Variables)
+	q0 := len(proj.GroupNames)
+	r0 := proj.maxLevels()
+
+	change()
+
+	p := len(proj.Variables)
+	q := len(proj.GroupNames)
+	r := proj.maxLevels()
+
+	proj.CellTotals = resizeCells(proj.CellTotals, p0, q0, r0, p, q, r)
+	for _, per := range proj.Periods {
+		per.CellTotals = resizeCells(per.CellTotals, p0, q0, r0, p, q, r)
+	}
+}
+
+// checkLabel returns an error if a new level, variable or group label
+// is blank, contains a comma, or duplicates one of the existing labels.
+func checkLabel(label string, existing []string) error {
+
+	if label == "" {
+		return fmt.Errorf("the name may not be blank")
+	}
+	if strings.ContainsAny(label, ",:;") {
+		return fmt.Errorf("the name '%s' may not contain commas, colons or semicolons", label)
+	}
+	for _, x := range existing {
+		if x == label {
+			return fmt.Errorf("the name '%s' is already in use", label)
+		}
+	}
+
+	return nil
+}
+
+// checkEffectiveDate returns an error if an amendment with the given
+// effective date cannot be recorded at time now.  Amendments change
+// the project when they are recorded, so they cannot be dated later.
+func checkEffectiveDate(effective, now time.Time) error {
+	if effective.After(now) {
+		return fmt.Errorf("the effective date is in the future, amendments take effect when they are recorded")
+	}
+	return nil
+}
+
+// addLevel adds a new level to the variable with the given index.
+// Subjects who are already enrolled do not have the new level.
+func (proj *Project) addLevel(varIx int, level string) error {
+
+	if varIx < 0 || varIx >= len(proj.Variables) {
+		return fmt.Errorf("there is no variable with index %d", varIx)
+	}
+	if err := checkLabel(level, proj.Variables[varIx].Levels); err != nil {
+		return err
+	}
+
+	proj.amend(func() {
+		va := &proj.Variables[varIx]
+		va.Levels = append(va.Levels, level)
+	})
+
+	return nil
+}
+
+// addVariable adds a new balancing variable.  If existingLevel is not
+// blank, all subjects who are already enrolled are counted as having
+// this level of the new variable.  Otherwise enrolled subjects are not
+// counted toward the balance of the new variable.
+func (proj *Project) addVariable(va Variable, existingLevel string) error {
+
+	var names []string
+	for _, x := range proj.Variables {
+		names = append(names, x.Name)
+	}
+	if err := checkLabel(va.Name, names); err != nil {
+		return err
+	}
+	if len(va.Levels) < 2 {
+		return fmt.Errorf("the variable '%s' must have at least two levels", va.Name)
+	}
+	for i, lev := range va.Levels {
+		if err := checkLabel(lev, va.Levels[0:i]); err != nil {
+			return err
+		}
+	}
+	if va.Weight <= 0 {
+		return fmt.Errorf("the weight of variable '%s' must be positive", va.Name)
+	}
+
+	levIx := -1
+	if existingLevel != "" {
+		levIx = getIndex(va.Levels, existingLevel)
+		if levIx == -1 {
+			return fmt.Errorf("'%s' is not a level of variable '%s'", existingLevel, va.Name)
+		}
+	}
+
+	proj.logEvent(&Event{
+		Time:     time.Now(),
+		Kind:     EventAddVariable,
+		Variable: va.Name,
+		Level:    existingLevel,
+	})
+
+	proj.amend(func() {
+		proj.Variables = append(proj.Variables, va)
+	})
+
+	if levIx != -1 {
+		j := len(proj.Variables) - 1
+		for g, n := range proj.Assignments {
+			proj.SetData(j, levIx, g, float64(n))
+		}
+		for _, per := range proj.Periods {
+			q := len(proj.GroupNames)
+			r := len(per.CellTotals) / (len(proj.Variables) * q)
+			for g, n := range per.Assignments {
+				per.CellTotals[q*r*j+q*levIx+g] = float64(n)
+			}
+		}
+	}
+
+	for _, rec := range proj.RawData {
+		rec.Data = append(rec.Data, existingLevel)
+		if rec.OriginalData != nil {
+			rec.OriginalData = append(rec.OriginalData, existingLevel)
+		}
+	}
+
+	return nil
+}
+
+// addGroup adds a new treatment group with the given sampling rate.
+// If the project has allocation periods, the new group is closed in
+// all of them and must be opened separately.
+func (proj *Project) addGroup(name string, rate float64) error {
+
+	if len(proj.Factors) > 0 {
+		return fmt.Errorf("the groups of a factorial design are determined by its factors")
+	}
+	if proj.IsCrossover() {
+		return fmt.Errorf("the sequences of a crossover design are determined by its treatments")
+	}
+
+	if err := checkLabel(name, proj.GroupNames); err != nil {
+		return err
+	}
+	if rate <= 0 {
+		return fmt.Errorf("the sampling rate must be a positive number")
+	}
+
+	proj.amend(func() {
+		proj.GroupNames = append(proj.GroupNames, name)
+		proj.Assignments = append(proj.Assignments, 0)
+		proj.SamplingRates = append(proj.SamplingRates, rate)
+		for _, per := range proj.Periods {
+			per.Open = append(per.Open, false)
+			per.Assignments = append(per.Assignments, 0)
+		}
+	})
+
+	return nil
+}
+
+// AmendProject is step 1 of amending the variables, levels or
+// treatment groups of a project.
+func AmendProject(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionAmend, r) {
+		msg := "Only the project owner can amend a project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("AmendProject [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	tvals := struct {
+		User     string
+		LoggedIn bool
+		Pkey     string
+		Project  *Project
+		Today    string
+	}{
+		User:     useremail,
+		LoggedIn: useremail != "",
+		Pkey:     pkey,
+		Project:  proj,
+		Today:    time.Now().Format("2006-01-02"),
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "amend_project.html", tvals); err != nil {
+		log.Printf("amendProject failed to execute template: %v", err)
+	}
+}
+
+// AmendProjectCompleted is step 2 of amending the variables, levels or
+// treatment groups of a project.
+func AmendProjectCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionAmend, r) {
+		msg := "Only the project owner can amend a project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("AmendProjectCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	description := strings.TrimSpace(r.FormValue("description"))
+	if description == "" {
+		msg := "A description of the amendment must be provided."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	loc, _ := time.LoadLocation("America/New_York")
+	effective, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(r.FormValue("effective_date")), loc)
+	if err != nil {
+		msg := "The effective date must be provided in the form YYYY-MM-DD."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+	if err := checkEffectiveDate(effective, time.Now()); err != nil {
+		msg := fmt.Sprintf("The project was not amended: %v.", err)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	var change string
+	switch r.FormValue("kind") {
+	case "level":
+		varIx, _ := strconv.Atoi(r.FormValue("level_variable"))
+		level := strings.TrimSpace(r.FormValue("new_level"))
+		err = proj.addLevel(varIx, level)
+		if err == nil {
+			change = fmt.Sprintf("Added level \"%s\" to variable \"%s\".", level, proj.Variables[varIx].Name)
+		}
+	case "variable":
+		var weight float64
+		weight, err = strconv.ParseFloat(strings.TrimSpace(r.FormValue("variable_weight")), 64)
+		if err != nil {
+			err = fmt.Errorf("the weight must be a number")
+			break
+		}
+		va := Variable{
+			Name:   strings.TrimSpace(r.FormValue("variable_name")),
+			Levels: cleanSplit(r.FormValue("variable_levels"), ","),
+			Weight: weight,
+		}
+		existing := strings.TrimSpace(r.FormValue("existing_level"))
+		err = proj.addVariable(va, existing)
+		if err == nil {
+			change = fmt.Sprintf("Added variable \"%s\" with levels %s.", va.Name, strings.Join(va.Levels, ","))
+			if existing != "" {
+				change += fmt.Sprintf(" Previously enrolled subjects are counted as \"%s\".", existing)
+			} else {
+				change += " Previously enrolled subjects are not counted toward this variable."
+			}
+		}
+	case "group":
+		var rate float64
+		rate, err = strconv.ParseFloat(strings.TrimSpace(r.FormValue("group_rate")), 64)
+		if err != nil {
+			err = fmt.Errorf("the sampling rate must be a number")
+			break
+		}
+		name := strings.TrimSpace(r.FormValue("group_name"))
+		if err = proj.addGroup(name, rate); err != nil {
+			break
+		}
+		if len(proj.Periods) > 0 {
+			err = proj.setGroupOpen(len(proj.GroupNames)-1, true, useremail, description, time.Now())
+		}
+		change = fmt.Sprintf("Added treatment group \"%s\" with sampling rate %v.", name, rate)
+	default:
+		err = fmt.Errorf("no change was selected")
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("The project was not amended: %v.", err)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	now := time.Now()
+	amendment := &Amendment{
+		Description:   description,
+		Change:        change,
+		EffectiveDate: effective,
+		Created:       now,
+		Author:        useremail,
+	}
+	proj.Amendments = append(proj.Amendments, amendment)
+
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  now,
+		Comment: []string{
+			fmt.Sprintf("Protocol amendment effective %s: %s", effective.Format("2006-01-02"), change),
+			description,
+		},
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditSettings, "amendment", nil, amendment)
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("AmendProjectCompleted [2]: %v", err)
+		msg := "Database error, the amendment was not saved."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := "The project has been amended. " + change
+	rmsg := "Return to project dashboard"
+	messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
@@ -0,0 +1,185 @@
+package randomize
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// amendmentLevels cycles through the levels of both variables.
+var amendmentLevels = [][]string{
+	{"F", "<40"}, {"M", "40-60"}, {"F", "60+"},
+	{"M", "<40"}, {"F", "40-60"}, {"M", "60+"},
+}
+
+// cellCopy returns the counts of the project indexed by variable,
+// level and group.
+func cellCopy(proj *Project) map[[3]int]float64 {
+
+	m := make(map[[3]int]float64)
+	for v, va := range proj.Variables {
+		for l := range va.Levels {
+			for g := range proj.GroupNames {
+				m[[3]int{v, l, g}] = proj.GetData(v, l, g)
+			}
+		}
+	}
+	return m
+}
+
+// checkCells checks that the counts of the project are unchanged from
+// old, and agree with the subject-level data and the event log.
+func checkCells(t *testing.T, proj *Project, old map[[3]int]float64) {
+
+	if len(proj.CellTotals) != len(proj.Variables)*len(proj.GroupNames)*proj.maxLevels() {
+		t.Fatalf("CellTotals has length %d", len(proj.CellTotals))
+	}
+	for k, x := range old {
+		if y := proj.GetData(k[0], k[1], k[2]); y != x {
+			t.Errorf("cell %v: expected %v, got %v", k, x, y)
+		}
+	}
+	for _, p := range proj.checkConsistency() {
+		t.Errorf("inconsistent after amendment: %s", p)
+	}
+}
+
+func TestAmendAddLevel(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+			{Name: "Age", Levels: []string{"<40", "40-60", "60+"}, Weight: 1},
+		},
+	}, 1, 30, "", amendmentLevels)
+	old := cellCopy(proj)
+
+	if err := proj.addLevel(0, "X"); err != nil {
+		t.Fatal(err)
+	}
+	checkCells(t, proj, old)
+	for g := range proj.GroupNames {
+		if proj.GetData(0, 2, g) != 0 {
+			t.Errorf("new level should have no subjects")
+		}
+	}
+
+	// Adding a fourth level to Age changes the number of stored levels
+	if err := proj.addLevel(1, "80+"); err != nil {
+		t.Fatal(err)
+	}
+	checkCells(t, proj, old)
+
+	if err := proj.addLevel(1, "80+"); err == nil {
+		t.Errorf("duplicate level should be rejected")
+	}
+
+	mpv := map[string]string{"Sex": "X", "Age": "80+"}
+	if _, err := proj.doAssignment(mpv, "new", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if proj.NumAssignments() != 31 {
+		t.Errorf("expected 31 assignments, got %d", proj.NumAssignments())
+	}
+	checkCells(t, proj, nil)
+}
+
+func TestAmendAddVariable(t *testing.T) {
+
+	for _, existing := range []string{"", "no"} {
+		proj := testProject(t, &Project{
+			GroupNames: []string{"A", "B"},
+			Variables: []Variable{
+				{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+				{Name: "Age", Levels: []string{"<40", "40-60", "60+"}, Weight: 1},
+			},
+		}, 1, 30, "", amendmentLevels)
+		old := cellCopy(proj)
+
+		va := Variable{Name: "Smoker", Levels: []string{"yes", "no"}, Weight: 1}
+		if err := proj.addVariable(va, existing); err != nil {
+			t.Fatal(err)
+		}
+		checkCells(t, proj, old)
+
+		for g, n := range proj.Assignments {
+			if proj.GetData(2, 0, g) != 0 {
+				t.Errorf("no existing subjects should be smokers")
+			}
+			expected := 0.0
+			if existing != "" {
+				expected = float64(n)
+			}
+			if proj.GetData(2, 1, g) != expected {
+				t.Errorf("expected %v non-smokers in group %d, got %v", expected, g, proj.GetData(2, 1, g))
+			}
+		}
+
+		for _, rec := range proj.RawData {
+			if len(rec.Data) != 3 || rec.Data[2] != existing {
+				t.Errorf("raw data not extended: %v", rec.Data)
+			}
+		}
+	}
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+			{Name: "Age", Levels: []string{"<40", "40-60", "60+"}, Weight: 1},
+		},
+	}, 1, 30, "", amendmentLevels)
+	va := Variable{Name: "Smoker", Levels: []string{"yes", "no"}, Weight: 1}
+	if err := proj.addVariable(va, "maybe"); err == nil {
+		t.Errorf("unknown level for existing subjects should be rejected")
+	}
+	if err := proj.addVariable(Variable{Name: "Sex", Levels: []string{"a", "b"}, Weight: 1}, ""); err == nil {
+		t.Errorf("duplicate variable should be rejected")
+	}
+}
+
+func TestAmendAddGroup(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+			{Name: "Age", Levels: []string{"<40", "40-60", "60+"}, Weight: 1},
+		},
+	}, 1, 30, "", amendmentLevels)
+	old := cellCopy(proj)
+
+	if err := proj.addGroup("C", 2); err != nil {
+		t.Fatal(err)
+	}
+	checkCells(t, proj, old)
+
+	if len(proj.Assignments) != 3 || proj.Assignments[2] != 0 || proj.SamplingRates[2] != 2 {
+		t.Errorf("group not added: %v %v", proj.Assignments, proj.SamplingRates)
+	}
+
+	sex := []string{"F", "M"}
+	age := []string{"<40", "40-60", "60+"}
+	for i := 0; i < 30; i++ {
+		mpv := map[string]string{"Sex": sex[i%2], "Age": age[i%3]}
+		if _, err := proj.doAssignment(mpv, fmt.Sprintf("new%d", i), "user"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if proj.Assignments[2] == 0 {
+		t.Errorf("no subjects were assigned to the new group")
+	}
+	checkCells(t, proj, nil)
+}
+
+func TestEffectiveDate(t *testing.T) {
+
+	now := time.Date(2021, 6, 1, 15, 0, 0, 0, time.UTC)
+	if err := checkEffectiveDate(now.Add(-15*time.Hour), now); err != nil {
+		t.Errorf("an amendment effective today should be accepted: %v", err)
+	}
+	if err := checkEffectiveDate(now.AddDate(0, 0, 1), now); err == nil {
+		t.Errorf("an amendment effective tomorrow should be rejected")
+	}
+}
@@ -0,0 +1,427 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// The kinds of change that need approval
+	RequestEdit   = "edit assignment"
+	RequestRemove = "remove subject"
+
+	// The states of a change request
+	RequestPending  = "pending"
+	RequestApproved = "approved"
+	RequestRejected = "rejected"
+)
+
+// ChangeRequest is a change to a randomized subject that has been
+// requested by one user and must be approved by another before it
+// takes effect.
+type ChangeRequest struct {
+
+	// ID is the number of the request within the project, starting from 1
+	ID int
+
+	// Kind is RequestEdit or RequestRemove
+	Kind string
+
+	// SubjectId identifies the subject to be changed
+	SubjectId string
+
+	// NewGroup is the requested treatment group, for RequestEdit
+	NewGroup string
+
+	// Category, Reason and RetainBalance describe the removal, for
+	// RequestRemove
+	Category      string
+	Reason        string
+	RetainBalance bool
+
+	// RequestedBy and Requested are the person who made the request
+	// and the time of the request
+	RequestedBy string
+	Requested   time.Time
+
+	// State is one of RequestPending, RequestApproved or RequestRejected
+	State string
+
+	// DecidedBy, Decided and DecisionReason record the approval or
+	// rejection of the request
+	DecidedBy      string
+	Decided        time.Time
+	DecisionReason string
+}
+
+// Describe returns a printable description of the requested change.
+func (req *ChangeRequest) Describe() string {
+
+	switch req.Kind {
+	case RequestEdit:
+		return fmt.Sprintf("Change the treatment group of subject '%s' to '%s'", req.SubjectId, req.NewGroup)
+	case RequestRemove:
+		s := fmt.Sprintf("Remove subject '%s' from the study (%s: %s)", req.SubjectId, req.Category, req.Reason)
+		if req.RetainBalance {
+			s += ", still counting toward the balance"
+		}
+		return s
+	default:
+		return req.Kind
+	}
+}
+
+// action returns the permission needed to request or approve the change.
+func (req *ChangeRequest) action() Action {
+	if req.Kind == RequestRemove {
+		return ActionRemoveSubject
+	}
+	return ActionEditAssignment
+}
+
+// IsPending returns true if the request has not been decided.
+func (req *ChangeRequest) IsPending() bool {
+	return req.State == RequestPending
+}
+
+// PendingRequests returns the change requests awaiting a decision.
+func (proj *Project) PendingRequests() []*ChangeRequest {
+	var pending []*ChangeRequest
+	for _, req := range proj.ChangeRequests {
+		if req.IsPending() {
+			pending = append(pending, req)
+		}
+	}
+	return pending
+}
+
+// findRequest returns the change request with the given id, or nil.
+func (proj *Project) findRequest(id int) *ChangeRequest {
+	for _, req := range proj.ChangeRequests {
+		if req.ID == id {
+			return req
+		}
+	}
+	return nil
+}
+
+// changeGroup moves a randomized subject to a new treatment group,
+// updating the aggregate counts.
+func (proj *Project) changeGroup(rec *DataRecord, newGroup, user string, now time.Time) {
+	proj.logEvent(&Event{
+		Time:      now,
+		Kind:      EventRegroup,
+		SubjectId: rec.SubjectId,
+		Group:     newGroup,
+		User:      user,
+	})
+	removeFromAggregate(rec, proj)
+	rec.CurrentGroup = newGroup
+	rec.Sequence = proj.sequence(newGroup)
+	addToAggregate(rec, proj)
+}
+
+// checkRequest returns an error if the requested change cannot
+// currently be made.
+func (proj *Project) checkRequest(req *ChangeRequest) error {
+
+	rec := proj.findSubject(req.SubjectId)
+	if rec == nil {
+		return fmt.Errorf("there is no subject with id '%s'", req.SubjectId)
+	}
+	if !rec.Included {
+		return fmt.Errorf("subject '%s' has been removed from the study", req.SubjectId)
+	}
+
+	switch req.Kind {
+	case RequestEdit:
+		if getIndex(proj.GroupNames, req.NewGroup) == -1 {
+			return fmt.Errorf("there is no treatment group '%s'", req.NewGroup)
+		}
+		if rec.CurrentGroup == req.NewGroup {
+			return fmt.Errorf("subject '%s' is already in group '%s'", req.SubjectId, req.NewGroup)
+		}
+	case RequestRemove:
+		if getIndex(removalCategories, req.Category) == -1 {
+			return fmt.Errorf("a reason category must be selected")
+		}
+		if req.Reason == "" {
+			return fmt.Errorf("a description of the reason must be provided")
+		}
+	default:
+		return fmt.Errorf("unknown change '%s'", req.Kind)
+	}
+
+	return nil
+}
+
+// requestChange adds a pending change request to the project.  Only
+// one request for a subject may be pending at a time.
+func (proj *Project) requestChange(req *ChangeRequest, user string, now time.Time) error {
+
+	if err := proj.checkRequest(req); err != nil {
+		return err
+	}
+	for _, x := range proj.PendingRequests() {
+		if x.SubjectId == req.SubjectId {
+			return fmt.Errorf("request %d for subject '%s' is already awaiting approval", x.ID, req.SubjectId)
+		}
+	}
+
+	req.ID = len(proj.ChangeRequests) + 1
+	req.State = RequestPending
+	req.RequestedBy = user
+	req.Requested = now
+	proj.ChangeRequests = append(proj.ChangeRequests, req)
+
+	return nil
+}
+
+// decideChange approves or rejects a pending change request.  The
+// person deciding must not be the person who made the request.  An
+// approved change is applied to the subject and the aggregate counts.
+func (proj *Project) decideChange(req *ChangeRequest, approve bool, user, reason string, now time.Time) error {
+
+	if !req.IsPending() {
+		return fmt.Errorf("request %d has already been %s", req.ID, req.State)
+	}
+	if strings.EqualFold(user, req.RequestedBy) {
+		return fmt.Errorf("a request must be decided by someone other than the person who made it")
+	}
+
+	if approve {
+		if err := proj.checkRequest(req); err != nil {
+			return err
+		}
+		rec := proj.findSubject(req.SubjectId)
+		switch req.Kind {
+		case RequestEdit:
+			proj.changeGroup(rec, req.NewGroup, user, now)
+		case RequestRemove:
+			if err := proj.removeSubject(rec, req.Category, req.Reason, req.RetainBalance, user, now); err != nil {
+				return err
+			}
+		}
+		req.State = RequestApproved
+	} else {
+		if reason == "" {
+			return fmt.Errorf("a reason for rejecting the request must be provided")
+		}
+		req.State = RequestRejected
+	}
+
+	req.DecidedBy = user
+	req.Decided = now
+	req.DecisionReason = reason
+
+	return nil
+}
+
+// submitChangeRequest stores a request for a change that needs
+// approval, and tells the user that it is pending.
+func submitChangeRequest(ctx context.Context, proj *Project, pkey string, req *ChangeRequest, sig *Signature,
+	w http.ResponseWriter, r *http.Request) {
+
+	useremail := userEmail(r)
+	now := time.Now()
+
+	if err := proj.requestChange(req, useremail, now); err != nil {
+		msg := fmt.Sprintf("The change was not requested: %v.", err)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  now,
+		Comment: signedComment([]string{
+			fmt.Sprintf("Request %d submitted for approval: %s.", req.ID, req.Describe())}, sig),
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logSignedAudit(useremail, AuditRequest, req.SubjectId, nil, req.Describe(), sig)
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("submitChangeRequest: %v", err)
+		msg := "Database error, the change was not requested."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("The change has been submitted as request %d, it will take effect when it is approved by another user.", req.ID)
+	rmsg := "Return to project dashboard"
+	messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
+
+// ChangeRequests displays the pending and decided change requests of
+// a project.
+func ChangeRequests(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionEditAssignment, r) && !checkPermission(susers, ActionRemoveSubject, r) {
+		msg := "You don't have permission to view the change requests of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ChangeRequests [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	type requestView struct {
+		ID             int
+		Description    string
+		RequestedBy    string
+		Requested      string
+		State          string
+		DecidedBy      string
+		Decided        string
+		DecisionReason string
+		CanDecide      bool
+	}
+	loc, _ := time.LoadLocation("America/New_York")
+	var pending, decided []requestView
+	for _, req := range proj.ChangeRequests {
+		v := requestView{
+			ID:             req.ID,
+			Description:    req.Describe(),
+			RequestedBy:    req.RequestedBy,
+			Requested:      req.Requested.In(loc).Format("2006-01-02 3:04 PM"),
+			State:          req.State,
+			DecidedBy:      req.DecidedBy,
+			DecisionReason: req.DecisionReason,
+		}
+		if req.IsPending() {
+			v.CanDecide = checkPermission(susers, req.action(), r) && !strings.EqualFold(useremail, req.RequestedBy)
+			pending = append(pending, v)
+		} else {
+			v.Decided = req.Decided.In(loc).Format("2006-01-02 3:04 PM")
+			decided = append(decided, v)
+		}
+	}
+
+	tvals := struct {
+		User      string
+		LoggedIn  bool
+		Pkey      string
+		Project   *Project
+		Pending   []requestView
+		Decided   []requestView
+		Signature *SignatureForm
+	}{
+		User:      useremail,
+		LoggedIn:  useremail != "",
+		Pkey:      pkey,
+		Project:   proj,
+		Pending:   pending,
+		Decided:   decided,
+		Signature: proj.signatureForm(MeaningApproved),
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "change_requests.html", tvals); err != nil {
+		log.Printf("changeRequests failed to execute template: %v", err)
+	}
+}
+
+// DecideChangeRequest approves or rejects a pending change request.
+func DecideChangeRequest(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("DecideChangeRequest [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	req := proj.findRequest(id)
+	if req == nil {
+		msg := fmt.Sprintf("There is no change request with id '%s'.", r.FormValue("id"))
+		rmsg := "Return to change requests"
+		messagePage(w, r, msg, rmsg, "/change_requests?pkey="+pkey)
+		return
+	}
+
+	if !checkPermission(susers, req.action(), r) {
+		msg := "You don't have permission to decide this change request."
+		rmsg := "Return to change requests"
+		messagePage(w, r, msg, rmsg, "/change_requests?pkey="+pkey)
+		return
+	}
+
+	sig, ok := requireSignature(ctx, proj, w, r, "/change_requests?pkey="+pkey)
+	if !ok {
+		return
+	}
+
+	approve := r.FormValue("decision") == "approve"
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	now := time.Now()
+	if err := proj.decideChange(req, approve, useremail, reason, now); err != nil {
+		msg := fmt.Sprintf("Request %d was not decided: %v.", req.ID, err)
+		rmsg := "Return to change requests"
+		messagePage(w, r, msg, rmsg, "/change_requests?pkey="+pkey)
+		return
+	}
+
+	lines := []string{fmt.Sprintf("Request %d %s: %s.", req.ID, req.State, req.Describe()),
+		fmt.Sprintf("Requested by %s.", req.RequestedBy)}
+	if reason != "" {
+		lines = append(lines, reason)
+	}
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  now,
+		Comment:   signedComment(lines, sig),
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logSignedAudit(useremail, AuditDecide, req.SubjectId, req.Describe(), map[string]string{
+		"Request": strconv.Itoa(req.ID), "State": req.State, "RequestedBy": req.RequestedBy, "Reason": reason,
+	}, sig)
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("DecideChangeRequest [2]: %v", err)
+		msg := "Database error, the request was not decided."
+		rmsg := "Return to change requests"
+		messagePage(w, r, msg, rmsg, "/change_requests?pkey="+pkey)
+		return
+	}
+
+	http.Redirect(w, r, "/change_requests?pkey="+pkey, http.StatusSeeOther)
+}
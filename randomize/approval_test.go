@@ -0,0 +1,95 @@
+package randomize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChangeRequests(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+		RequireApproval: true,
+	}, 1, 6, "", [][]string{{"F"}, {"M"}})
+	now := time.Now()
+
+	rec := proj.findSubject("2")
+	other := "A"
+	if rec.CurrentGroup == "A" {
+		other = "B"
+	}
+
+	for _, req := range []*ChangeRequest{
+		{Kind: RequestEdit, SubjectId: "99", NewGroup: "A"},
+		{Kind: RequestEdit, SubjectId: "2", NewGroup: "C"},
+		{Kind: RequestEdit, SubjectId: "2", NewGroup: rec.CurrentGroup},
+		{Kind: RequestRemove, SubjectId: "2", Category: "Other"},
+	} {
+		if err := proj.requestChange(req, "dm@example.com", now); err == nil {
+			t.Errorf("invalid request '%s' was accepted", req.Describe())
+		}
+	}
+
+	// An edit request changes nothing until it is approved
+	cells := cellCopy(proj)
+	edit := &ChangeRequest{Kind: RequestEdit, SubjectId: "2", NewGroup: other}
+	if err := proj.requestChange(edit, "dm@example.com", now); err != nil {
+		t.Fatal(err)
+	}
+	if edit.ID != 1 || !edit.IsPending() || len(proj.PendingRequests()) != 1 {
+		t.Errorf("request was not added as pending")
+	}
+	checkCells(t, proj, cells)
+
+	dup := &ChangeRequest{Kind: RequestRemove, SubjectId: "2", Category: "Other", Reason: "x"}
+	if err := proj.requestChange(dup, "owner@example.com", now); err == nil {
+		t.Errorf("a second pending request for a subject was accepted")
+	}
+
+	if err := proj.decideChange(edit, true, "DM@example.com", "", now); err == nil {
+		t.Errorf("a request was approved by the person who made it")
+	}
+	if err := proj.decideChange(edit, true, "owner@example.com", "", now); err != nil {
+		t.Fatal(err)
+	}
+	if rec.CurrentGroup != other || edit.State != RequestApproved || edit.DecidedBy != "owner@example.com" {
+		t.Errorf("approved edit was not applied")
+	}
+	if err := proj.decideChange(edit, false, "owner@example.com", "oops", now); err == nil {
+		t.Errorf("a decided request was decided again")
+	}
+
+	// A rejected removal leaves the subject in the study
+	remove := &ChangeRequest{Kind: RequestRemove, SubjectId: "4", Category: "Other", Reason: "moved"}
+	if err := proj.requestChange(remove, "dm@example.com", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.decideChange(remove, false, "owner@example.com", "", now); err == nil {
+		t.Errorf("a request was rejected without a reason")
+	}
+	if err := proj.decideChange(remove, false, "owner@example.com", "no evidence", now); err != nil {
+		t.Fatal(err)
+	}
+	if !proj.findSubject("4").Included || proj.NumAssignments() != 6 {
+		t.Errorf("rejected removal was applied")
+	}
+
+	// An approved removal updates the aggregates
+	remove = &ChangeRequest{Kind: RequestRemove, SubjectId: "4", Category: "Other", Reason: "moved"}
+	if err := proj.requestChange(remove, "dm@example.com", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.decideChange(remove, true, "owner@example.com", "", now); err != nil {
+		t.Fatal(err)
+	}
+	if proj.findSubject("4").Included || proj.NumAssignments() != 5 {
+		t.Errorf("approved removal was not applied")
+	}
+
+	if len(proj.ChangeRequests) != 3 || len(proj.PendingRequests()) != 0 {
+		t.Errorf("request history was not retained")
+	}
+}
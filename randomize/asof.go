@@ -0,0 +1,177 @@
+package randomize
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parseAsOf returns the time given in the "as_of" form value, in
+// America/New_York time.  A date without a time means the end of that
+// day.  The zero time is returned if no value was given.
+func parseAsOf(r *http.Request) (time.Time, error) {
+
+	s := strings.TrimSpace(r.FormValue("as_of"))
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	loc, _ := time.LoadLocation("America/New_York")
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, loc); err == nil {
+		return t.Add(time.Minute - time.Nanosecond), nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("the date must have the form YYYY-MM-DD or YYYY-MM-DD HH:MM")
+	}
+
+	return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
+
+// historyAsOf returns the lifecycle transitions that occurred no later
+// than t.
+func historyAsOf(history []*StatusChange, t time.Time) []*StatusChange {
+	var h []*StatusChange
+	for _, c := range history {
+		if !c.Time.After(t) {
+			h = append(h, c)
+		}
+	}
+	return h
+}
+
+// asOf returns a copy of the project showing the trial as it was at
+// time t, obtained by replaying the event log.  Subjects who were
+// later removed or reassigned appear as they were at that time.  The
+// groups and variables are those of the current project, with
+// variables added after t left blank.  The project itself is not
+// changed.
+func (proj *Project) asOf(t time.Time) (*Project, error) {
+
+	if !proj.StoreRawData {
+		return nil, fmt.Errorf("earlier states can only be shown for projects that store the subject-level data")
+	}
+	if t.Before(proj.Created) {
+		return nil, fmt.Errorf("the project was created after this time")
+	}
+
+	states, err := proj.replay(t)
+	if err != nil {
+		return nil, err
+	}
+
+	past := *proj
+	past.Modified = t
+
+	// Allocation periods that had started by time t
+	past.Periods = nil
+	for _, per := range proj.Periods {
+		if per.Start.After(t) && len(past.Periods) > 0 {
+			break
+		}
+		past.Periods = append(past.Periods, &AllocationPeriod{Start: per.Start, Open: per.Open})
+	}
+
+	agg := past.aggregate(states)
+	past.Assignments = agg.Assignments
+	past.CellTotals = agg.CellTotals
+	for i, per := range past.Periods {
+		per.Assignments = agg.PeriodAssignments[i]
+		per.CellTotals = agg.PeriodCells[i]
+	}
+
+	// Subject-level data
+	records := make(map[string]*DataRecord)
+	for _, rec := range proj.RawData {
+		records[rec.SubjectId] = rec
+	}
+	assigned := make(map[string]bool)
+	past.RawData = nil
+	past.subjectIndex = nil
+	past.RemovedSubjects = nil
+	for _, s := range states {
+		assigned[s.SubjectId] = true
+		rec := &DataRecord{
+			SubjectId:     s.SubjectId,
+			AssignedTime:  s.Assigned,
+			AssignedGroup: s.Group,
+			CurrentGroup:  s.Group,
+			Sequence:      proj.sequence(s.Group),
+			Included:      s.Included,
+			Data:          make([]string, len(proj.Variables)),
+			Period:        s.Period,
+		}
+		copy(rec.Data, s.Data)
+		if cur, ok := records[s.SubjectId]; ok {
+			rec.AssignedGroup = cur.AssignedGroup
+			rec.Assigner = cur.Assigner
+			rec.Eligibility = cur.Eligibility
+			rec.History = historyAsOf(cur.History, t)
+			if c := rec.LastChange(); c != nil {
+				rec.Status = c.Status
+			}
+			if !s.Included {
+				rec.RemovalCategory = cur.RemovalCategory
+				rec.RemovalReason = cur.RemovalReason
+				rec.BalanceRetained = s.Retained
+			}
+			for _, c := range cur.Corrections {
+				if !c.Time.After(t) {
+					rec.Corrections = append(rec.Corrections, c)
+				}
+			}
+			if len(rec.Corrections) > 0 {
+				rec.OriginalData = make([]string, len(proj.Variables))
+				copy(rec.OriginalData, cur.OriginalData)
+			}
+		}
+		if !s.Included {
+			past.RemovedSubjects = append(past.RemovedSubjects, s.SubjectId)
+		}
+		past.RawData = append(past.RawData, rec)
+	}
+
+	// Subjects who had been screened but not yet randomized
+	past.Screening = nil
+	for _, sr := range proj.Screening {
+		if h := historyAsOf(sr.History, t); len(h) > 0 {
+			past.Screening = append(past.Screening, &ScreeningRecord{
+				SubjectId: sr.SubjectId,
+				Status:    h[len(h)-1].Status,
+				Answers:   sr.Answers,
+				Reasons:   sr.Reasons,
+				History:   h,
+			})
+		}
+	}
+	for _, rec := range proj.RawData {
+		if assigned[rec.SubjectId] {
+			continue
+		}
+		if h := historyAsOf(rec.History, t); len(h) > 0 {
+			past.Screening = append(past.Screening, &ScreeningRecord{
+				SubjectId: rec.SubjectId,
+				Status:    h[len(h)-1].Status,
+				Answers:   rec.Eligibility,
+				History:   h,
+			})
+		}
+	}
+
+	past.Members = nil
+	for _, m := range proj.Members {
+		if !m.Enrolled.After(t) {
+			past.Members = append(past.Members, m)
+		}
+	}
+
+	past.Comments = nil
+	for _, c := range proj.Comments {
+		if !c.DateTime.After(t) {
+			past.Comments = append(past.Comments, c)
+		}
+	}
+
+	return &past, nil
+}
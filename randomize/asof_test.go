@@ -0,0 +1,109 @@
+package randomize
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAsOf(t *testing.T) {
+
+	day := func(d int) time.Time {
+		return time.Date(2021, 3, d, 12, 0, 0, 0, time.UTC)
+	}
+
+	proj := testProject(t, &Project{
+		Created:    day(1),
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+	}, 1, 6, "", [][]string{{"F"}, {"M"}})
+	for i := 0; i < 6; i++ {
+		proj.RawData[i].AssignedTime = day(i + 2)
+		proj.Events[i].Time = day(i + 2)
+		proj.RawData[i].History[0].Time = day(i + 2)
+	}
+
+	rec := proj.findSubject("0")
+	first := rec.CurrentGroup
+	other := "A"
+	if first == "A" {
+		other = "B"
+	}
+	proj.changeGroup(rec, other, "dm", day(10))
+	if err := proj.removeSubject(proj.findSubject("1"), "Other", "moved", false, "dm", day(11)); err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.correctCovariate(proj.findSubject("2"), 0, "M", "owner", "typo", day(12)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := proj.asOf(day(1).Add(-time.Hour)); err == nil {
+		t.Errorf("a time before the project was created was accepted")
+	}
+
+	past, err := proj.asOf(day(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(past.RawData) != 3 || past.NumAssignments() != 3 {
+		t.Errorf("expected 3 subjects on day 4, got %d", len(past.RawData))
+	}
+
+	past, err = proj.asOf(day(9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if past.findSubject("0").CurrentGroup != first || !past.findSubject("1").Included || past.NumAssignments() != 6 {
+		t.Errorf("later changes appear on day 9")
+	}
+	if past.findSubject("2").MisStratified() || past.findSubject("2").Data[0] != "F" {
+		t.Errorf("later correction appears on day 9")
+	}
+
+	past, err = proj.asOf(day(11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := past.findSubject("1")
+	if past.findSubject("0").CurrentGroup != other || sub.Included || sub.CurrentStatus() != StatusWithdrawn {
+		t.Errorf("changes on days 10 and 11 are missing")
+	}
+	if past.NumAssignments() != 5 || len(past.RemovedSubjects) != 1 {
+		t.Errorf("expected 5 included subjects on day 11, got %d", past.NumAssignments())
+	}
+	if d := past.diffAggregates("as of", past.aggregate(past.rawStates()), past.storedAggregates()); len(d) != 0 {
+		t.Errorf("counts do not match the data: %v", d)
+	}
+
+	// The project itself is unchanged
+	if p := proj.checkConsistency(); len(p) != 0 || !proj.findSubject("2").MisStratified() {
+		t.Errorf("asOf changed the project: %v", p)
+	}
+}
+
+func TestParseAsOf(t *testing.T) {
+
+	loc, _ := time.LoadLocation("America/New_York")
+	for _, tc := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"2021-03-05", time.Date(2021, 3, 5, 23, 59, 59, 999999999, loc)},
+		{"2021-03-05 09:30", time.Date(2021, 3, 5, 9, 30, 59, 999999999, loc)},
+	} {
+		r, _ := http.NewRequest("GET", "/view_statistics?as_of="+url.QueryEscape(tc.value), nil)
+		got, err := parseAsOf(r)
+		if err != nil || !got.Equal(tc.want) {
+			t.Errorf("%q: got %v, %v", tc.value, got, err)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/view_statistics?as_of=March", nil)
+	if _, err := parseAsOf(r); err == nil {
+		t.Errorf("invalid date was accepted")
+	}
+}
@@ -31,14 +31,14 @@ func AssignTreatmentInput(w http.ResponseWriter, r *http.Request) {
 	pkey := r.FormValue("pkey")
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
-		msg := "You don't have access to this project."
+	if !checkPermission(susers, ActionAssign, r) {
+		msg := "You don't have permission to randomize subjects in this project."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
 	}
 
-	proj, err := getProjectFromKey(pkey)
+	proj, err := getProjectHeader(ctx, pkey)
 	if err != nil {
 		log.Printf("Assign_treatment_input: %v", err)
 		msg := "A database error occurred, the project could not be loaded."
@@ -54,6 +54,13 @@ func AssignTreatmentInput(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !proj.Window.IsOpen(time.Now()) {
+		msg := "This project is outside of its enrollment window.  " + proj.windowStatus(time.Now())
+		rmsg := "Return to project"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
 	fproj := formatProject(proj)
 
 	tvals := struct {
@@ -64,6 +71,7 @@ func AssignTreatmentInput(w http.ResponseWriter, r *http.Request) {
 		NumGroups int
 		Fields    string
 		Pkey      string
+		Criteria  []*CriterionView
 	}{
 		User:      useremail,
 		LoggedIn:  useremail != "",
@@ -71,6 +79,7 @@ func AssignTreatmentInput(w http.ResponseWriter, r *http.Request) {
 		PV:        fproj,
 		NumGroups: len(proj.GroupNames),
 		Pkey:      pkey,
+		Criteria:  proj.criterionViews(nil),
 	}
 
 	S := make([]string, len(proj.Variables))
@@ -84,7 +93,9 @@ func AssignTreatmentInput(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func checkBeforeAssigning(proj *Project, pkey string, subjectId string, w http.ResponseWriter, r *http.Request) bool {
+// checkEnrollmentOpen shows a message and returns false if the project
+// is not currently accepting new subjects or individuals.
+func checkEnrollmentOpen(proj *Project, pkey string, w http.ResponseWriter, r *http.Request) bool {
 
 	if !proj.Open {
 		msg := "This project is currently not open for new enrollments.  The project owner can change this by following the \"Open/close enrollment\" link on the project dashboard."
@@ -93,24 +104,48 @@ func checkBeforeAssigning(proj *Project, pkey string, subjectId string, w http.R
 		return false
 	}
 
-	// Check the subject id
-	if proj.StoreRawData {
+	if !proj.Window.IsOpen(time.Now()) {
+		msg := "This project is outside of its enrollment window.  " + proj.windowStatus(time.Now())
+		rmsg := "Return to project"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return false
+	}
 
-		if len(subjectId) == 0 {
-			msg := fmt.Sprintf("The subject id may not be blank.")
-			rmsg := "Return to project"
-			messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
-			return false
-		}
+	return true
+}
 
-		for _, rec := range proj.RawData {
-			if subjectId == rec.SubjectId {
-				msg := fmt.Sprintf("Subject '%s' has already been assigned to a treatment group.  Please use a different subject id.", subjectId)
-				rmsg := "Return to project"
-				messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
-				return false
-			}
-		}
+func checkBeforeAssigning(proj *Project, pkey string, subjectId string, w http.ResponseWriter, r *http.Request) bool {
+
+	if !checkEnrollmentOpen(proj, pkey, w, r) {
+		return false
+	}
+
+	if proj.targetReached() {
+		msg := fmt.Sprintf("The target sample size of %d has been reached, no further subjects can be enrolled.", proj.TargetTotal)
+		rmsg := "Return to project"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return false
+	}
+
+	// Check the subject id
+	if err := proj.SubjectIDs.check(subjectId); err != nil {
+		msg := fmt.Sprintf("The subject id '%s' was not accepted: %v.  Please check the id and enter it again.", subjectId, err)
+		rmsg := "Return to project"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return false
+	}
+	if proj.StoreRawData && len(subjectId) == 0 {
+		msg := fmt.Sprintf("The subject id may not be blank.")
+		rmsg := "Return to project"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return false
+	}
+
+	if subjectId != "" && (proj.findSubject(subjectId) != nil || proj.SubjectIDs.issued(subjectId)) {
+		msg := fmt.Sprintf("Subject '%s' has already been assigned to a treatment group.  Please use a different subject id.", subjectId)
+		rmsg := "Return to project"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return false
 	}
 
 	return true
@@ -130,8 +165,8 @@ func AssignTreatmentConfirm(w http.ResponseWriter, r *http.Request) {
 	pkey := r.FormValue("pkey")
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
-		msg := "You don't have access to this project."
+	if !checkPermission(susers, ActionAssign, r) {
+		msg := "You don't have permission to randomize subjects in this project."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
@@ -145,7 +180,11 @@ func AssignTreatmentConfirm(w http.ResponseWriter, r *http.Request) {
 	subjectId := r.FormValue("subject_id")
 	subjectId = strings.TrimSpace(subjectId)
 
-	project, err := getProjectFromKey(pkey)
+	project, err := getProjectHeader(ctx, pkey)
+	if err == nil {
+		// Read any stored record of the subject for the checks below
+		_, err = project.loadSubject(subjectId)
+	}
 	if err != nil {
 		log.Printf("Assign_treatment_confirm: %v", err)
 		msg := "A database error occurred, the project could not be loaded."
@@ -154,11 +193,28 @@ func AssignTreatmentConfirm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Generated ids are only marked as issued when the subject is
+	// randomized
+	if project.SubjectIDs.AutoGenerate {
+		subjectId, err = project.siteSubjectId(r.FormValue("site"))
+		if err != nil {
+			msg := fmt.Sprintf("The subject could not be given an id: %v.", err)
+			rmsg := "Return to project"
+			messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		}
+	}
+
 	ok := checkBeforeAssigning(project, pkey, subjectId, w, r)
 	if !ok {
 		return
 	}
 
+	answers := project.eligibilityAnswers(r)
+	if !screenSubject(ctx, project, pkey, subjectId, useremail, answers, w, r) {
+		return
+	}
+
 	projView := formatProject(project)
 
 	Fields := strings.Split(r.FormValue("fields"), ",")
@@ -166,10 +222,19 @@ func AssignTreatmentConfirm(w http.ResponseWriter, r *http.Request) {
 	Values := make([]string, len(Fields))
 
 	FV[0] = []string{"Subject id", subjectId}
+	mpv := make(map[string]string)
 	for i, v := range Fields {
 		x := r.FormValue(v)
 		FV[i+1] = []string{v, x}
 		Values[i] = x
+		mpv[v] = x
+	}
+
+	if err := project.capError(mpv); err != nil {
+		msg := fmt.Sprintf("This subject cannot be enrolled: %v.", err)
+		rmsg := "Return to project"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
 	}
 
 	tvals := struct {
@@ -183,7 +248,9 @@ func AssignTreatmentConfirm(w http.ResponseWriter, r *http.Request) {
 		FV          [][]string
 		Values      string
 		SubjectId   string
+		Site        string
 		AnyVars     bool
+		Criteria    []*CriterionView
 	}{
 		User:        useremail,
 		LoggedIn:    useremail != "",
@@ -195,7 +262,9 @@ func AssignTreatmentConfirm(w http.ResponseWriter, r *http.Request) {
 		FV:          FV,
 		Values:      strings.Join(Values, ","),
 		SubjectId:   subjectId,
+		Site:        r.FormValue("site"),
 		AnyVars:     len(project.Variables) > 0,
+		Criteria:    project.criterionViews(answers),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "assign_treatment_confirm.html", tvals); err != nil {
@@ -221,8 +290,8 @@ func AssignTreatment(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	if !checkAccess(pkey, susers, r) {
-		msg := "You don't have access to this project."
+	if !checkPermission(susers, ActionAssign, r) {
+		msg := "You don't have permission to randomize subjects in this project."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
@@ -233,53 +302,108 @@ func AssignTreatment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	proj, err := getProjectFromKey(pkey)
-	if err != nil {
-		log.Printf("Assign_treatment %v", err)
-		msg := "A database error occurred, the project could not be loaded."
-		rmsg := "Return to dashboard"
-		messagePage(w, r, msg, rmsg, "/dashboard")
-		return
-	}
-	log.Printf("pkey=%v", pkey)
-	log.Printf("proj=%+v\n", proj)
+	var proj *Project
+	var pview *ProjectView
+	var subjectId, ax string
+	for attempt := 1; ; attempt++ {
+
+		proj, err = getProjectHeader(ctx, pkey)
+		if err != nil {
+			log.Printf("Assign_treatment %v", err)
+			msg := "A database error occurred, the project could not be loaded."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+		log.Printf("pkey=%v", pkey)
+		log.Printf("proj=%+v\n", proj)
+
+		// Generated ids are issued from the project as it is now, the id
+		// shown on the confirmation page may have been given to another
+		// subject since
+		subjectId = r.FormValue("subject_id")
+		if proj.SubjectIDs.AutoGenerate {
+			subjectId, err = proj.siteSubjectId(r.FormValue("site"))
+			if err != nil {
+				msg := fmt.Sprintf("The subject could not be given an id: %v.", err)
+				rmsg := "Return to project"
+				messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+				return
+			}
+		}
 
-	subjectId := r.FormValue("subject_id")
+		// Read any stored record of the subject for the checks below
+		if _, err := proj.loadSubject(subjectId); err != nil {
+			log.Printf("Assign_treatment %v", err)
+			msg := "A database error occurred, the project could not be loaded."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
 
-	// Check this a second time in case someone lands on this page
-	// without going through the previous checks
-	// (e.g. inappropriate use of back button on browser).
-	ok := checkBeforeAssigning(proj, pkey, subjectId, w, r)
-	if !ok {
-		return
-	}
+		// Check this a second time in case someone lands on this page
+		// without going through the previous checks
+		// (e.g. inappropriate use of back button on browser).
+		ok := checkBeforeAssigning(proj, pkey, subjectId, w, r)
+		if !ok {
+			return
+		}
 
-	pview := formatProject(proj)
+		answers := proj.eligibilityAnswers(r)
+		if !screenSubject(ctx, proj, pkey, subjectId, useremail, answers, w, r) {
+			return
+		}
 
-	fields := strings.Split(r.FormValue("fields"), ",")
-	values := strings.Split(r.FormValue("values"), ",")
+		pview = formatProject(proj)
 
-	// mpv maps variable names to values for the unit that is about
-	// to be randomized to a treatment group.
-	mpv := make(map[string]string)
-	for i, x := range fields {
-		mpv[x] = values[i]
-	}
+		fields := strings.Split(r.FormValue("fields"), ",")
+		values := strings.Split(r.FormValue("values"), ",")
 
-	ax, err := proj.doAssignment(mpv, subjectId, useremail)
-	if err != nil {
-		log.Printf("%v", err)
-	}
+		// mpv maps variable names to values for the unit that is about
+		// to be randomized to a treatment group.
+		mpv := make(map[string]string)
+		for i, x := range fields {
+			mpv[x] = values[i]
+		}
 
-	proj.Modified = time.Now()
+		ax, err = proj.doAssignment(mpv, subjectId, useremail)
+		if err != nil {
+			log.Printf("%v", err)
+			msg := fmt.Sprintf("The subject could not be assigned: %v.", err)
+			rmsg := "Return to project"
+			messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		}
 
-	// Update the project in the database.
-	if _, err := client.Doc("Project/"+pkey).Set(ctx, proj); err != nil {
-		log.Printf("Assign_treatment: %v", err)
-		msg := "A database error occurred, the project could not be updated."
-		rmsg := "Return to dashboard"
-		messagePage(w, r, msg, rmsg, "/dashboard")
-		return
+		proj.issueSubjectId(subjectId)
+
+		// Keep the checklist answers with the subject's data
+		if proj.StoreRawData && len(proj.Criteria) > 0 {
+			proj.RawData[len(proj.RawData)-1].Eligibility = answers
+		}
+
+		proj.Modified = time.Now()
+
+		proj.logAudit(useremail, AuditAssign, subjectId, nil, map[string]interface{}{
+			"Group": ax, "Data": mpv, "Eligibility": answers,
+		})
+
+		// Update the project in the database.  A subject assigned
+		// at the same time by another request changes the counts,
+		// so the assignment is made again from the stored project.
+		err = saveProject(ctx, client, pkey, proj, false, nil)
+		if err == errConflict && attempt < saveAttempts {
+			log.Printf("Assign_treatment: %s was changed, assigning again", pkey)
+			continue
+		}
+		if err != nil {
+			log.Printf("Assign_treatment: %v", err)
+			msg := "A database error occurred, the project could not be updated."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+		break
 	}
 
 	tvals := struct {
@@ -289,11 +413,13 @@ func AssignTreatment(w http.ResponseWriter, r *http.Request) {
 		ProjView  *ProjectView
 		NumGroups int
 		Ax        string
+		SubjectId string
 		Pkey      string
 	}{
 		User:      useremail,
 		LoggedIn:  useremail != "",
 		Ax:        ax,
+		SubjectId: subjectId,
 		Project:   proj,
 		ProjView:  pview,
 		NumGroups: len(proj.GroupNames),
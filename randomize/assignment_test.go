@@ -2,6 +2,7 @@ package randomize
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 )
@@ -63,6 +64,69 @@ func maxrange(proj *Project) []float64 {
 	return rv
 }
 
+// testProject completes a project for testing and assigns n subjects
+// to it.  The cell totals, assignment counts and sampling rates are
+// set from the groups and variables of the given project unless they
+// are given, and the bias is 5 unless another is given.  The id of
+// subject i is formatted from i using idFormat ("%d" if blank).  Row i
+// of levels holds the levels of the variables of subject i, in the
+// order of the variables, and the rows are repeated as needed.  The
+// random number generator is seeded with seed for the rest of the
+// test, so that the assignments are the same in every run.
+func testProject(t *testing.T, proj *Project, seed int64, n int, idFormat string, levels [][]string) *Project {
+
+	t.Helper()
+
+	if proj.CellTotals == nil {
+		proj.CellTotals = make([]float64, len(proj.Variables)*len(proj.GroupNames)*proj.maxLevels())
+	}
+	if proj.Assignments == nil {
+		proj.Assignments = make([]int, len(proj.GroupNames))
+	}
+	if proj.SamplingRates == nil {
+		for range proj.GroupNames {
+			proj.SamplingRates = append(proj.SamplingRates, 1)
+		}
+	}
+	if proj.Bias == 0 {
+		proj.Bias = 5
+	}
+	proj.Open = true
+	proj.StoreRawData = true
+
+	rgen := rand.New(rand.NewSource(seed))
+	prev := newRandom
+	newRandom = func() *rand.Rand { return rgen }
+	t.Cleanup(func() { newRandom = prev })
+
+	if idFormat == "" {
+		idFormat = "%d"
+	}
+	for i := 0; i < n; i++ {
+		if _, err := proj.doAssignment(testLevels(proj, levels, i), fmt.Sprintf(idFormat, i), "user"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return proj
+}
+
+// testLevels returns the levels of subject i of a test project, from
+// row i of levels as described for testProject.
+func testLevels(proj *Project, levels [][]string, i int) map[string]string {
+
+	mpv := make(map[string]string)
+	if len(levels) == 0 {
+		return mpv
+	}
+	row := levels[i%len(levels)]
+	for j, va := range proj.Variables {
+		mpv[va.Name] = row[j]
+	}
+
+	return mpv
+}
+
 func checkAssignment(bias int) float64 {
 
 	// Randomize nn subjects
@@ -0,0 +1,540 @@
+package randomize
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Actions recorded in the audit log
+	AuditCreate    = "create"
+	AuditAssign    = "assign"
+	AuditEdit      = "edit assignment"
+	AuditRemove    = "remove subject"
+	AuditReinstate = "reinstate subject"
+	AuditCorrect   = "correct data"
+	AuditStatus    = "subject status"
+	AuditOpenClose = "open/close"
+	AuditShare     = "share"
+	AuditOwner     = "transfer ownership"
+	AuditDelete    = "delete"
+	AuditComment   = "comment"
+	AuditSettings  = "change settings"
+	AuditExport    = "export"
+	AuditViewData  = "view unblinded data"
+	AuditRequest   = "request change"
+	AuditDecide    = "decide change"
+	AuditRebuild   = "rebuild counts"
+)
+
+// auditCollection is the Firestore collection containing the audit
+// logs, with one document per project
+const auditCollection = "Audit"
+
+// AuditEntry is one entry of the append-only audit log of a project.
+// Each entry contains the hash of the previous entry, so that any
+// change to, or removal of, an entry can be detected.
+type AuditEntry struct {
+
+	// Seq is the position of the entry in the log, starting from 1
+	Seq int
+
+	// Time is the time of the action
+	Time time.Time
+
+	// Actor is the person who performed the action
+	Actor string
+
+	// Action is one of the Audit constants
+	Action string
+
+	// Target identifies what was acted on, e.g. a subject id
+	Target string
+
+	// Before and After describe the affected values before and after
+	// the action
+	Before string
+	After  string
+
+	// Signature is the electronic signature applied to the action,
+	// if any
+	Signature string
+
+	// PrevHash is the hash of the previous entry, blank for the first
+	// entry
+	PrevHash string
+
+	// Hash is the hash of this entry, including PrevHash
+	Hash string
+}
+
+// computeHash returns the hash of the entry's contents, not including
+// the stored Hash.
+func (e *AuditEntry) computeHash() string {
+
+	fields := []string{
+		fmt.Sprintf("%d", e.Seq),
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.Actor,
+		e.Action,
+		e.Target,
+		e.Before,
+		e.After,
+		e.PrevHash,
+	}
+
+	// Entries made before signatures were introduced have no
+	// signature field in their hash
+	if e.Signature != "" {
+		fields = append(fields, e.Signature)
+	}
+
+	// The lengths are included so that moving text between adjacent
+	// fields changes the hash.
+	h := sha256.New()
+	for _, f := range fields {
+		_, _ = io.WriteString(h, fmt.Sprintf("%d:%s;", len(f), f))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// chain sets the sequence number and hashes of an entry that is to
+// follow prev, which is nil for the first entry.
+func (e *AuditEntry) chain(prev *AuditEntry) {
+
+	e.Seq = 1
+	e.PrevHash = ""
+	if prev != nil {
+		e.Seq = prev.Seq + 1
+		e.PrevHash = prev.Hash
+	}
+
+	// Firestore stores times with microsecond precision
+	e.Time = e.Time.UTC().Truncate(time.Microsecond)
+	e.Hash = e.computeHash()
+}
+
+// verifyAudit checks that the entries, in order, form an unbroken
+// hash chain ending at the given head.  An error describing the first
+// problem is returned.
+func verifyAudit(entries []*AuditEntry, head *auditHead) error {
+
+	var prev *AuditEntry
+	for i, e := range entries {
+		if e.Seq != i+1 {
+			return fmt.Errorf("entry %d has sequence number %d, entries are missing", i+1, e.Seq)
+		}
+		if prev != nil && e.PrevHash != prev.Hash {
+			return fmt.Errorf("entry %d does not follow entry %d", e.Seq, prev.Seq)
+		}
+		if prev == nil && e.PrevHash != "" {
+			return fmt.Errorf("the first entry refers to a previous entry")
+		}
+		if e.computeHash() != e.Hash {
+			return fmt.Errorf("entry %d has been altered", e.Seq)
+		}
+		prev = e
+	}
+
+	// Entries removed from the end leave an intact chain
+	if len(entries) != head.Count {
+		return fmt.Errorf("the log has %d entries, %d were written", len(entries), head.Count)
+	}
+	if prev != nil && prev.Hash != head.Hash {
+		return fmt.Errorf("entry %d is not the last entry written", prev.Seq)
+	}
+
+	return nil
+}
+
+// auditValue returns a printable version of a value for the Before or
+// After field of an audit entry.
+func auditValue(v interface{}) string {
+
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+
+	return string(b)
+}
+
+// auditHead is stored in the audit document of a project.  It holds
+// the number of entries in the log and the hash of the last one, so
+// that the removal of entries from the end of the log can be detected.
+type auditHead struct {
+	Count int
+	Hash  string
+}
+
+// last returns a stand-in for the last entry of the log, for chaining
+// the next entry, or nil if the log is empty.
+func (h *auditHead) last() *AuditEntry {
+	if h.Count == 0 {
+		return nil
+	}
+	return &AuditEntry{Seq: h.Count, Hash: h.Hash}
+}
+
+// auditDoc returns the reference to the audit document of a project,
+// which holds the head of the log.
+func auditDoc(client *firestore.Client, pkey string) *firestore.DocumentRef {
+	return client.Collection(auditCollection).Doc(pkey)
+}
+
+// auditEntries returns the reference to the collection holding the
+// audit log of a project.
+func auditEntries(client *firestore.Client, pkey string) *firestore.CollectionRef {
+	return auditDoc(client, pkey).Collection("Entries")
+}
+
+// auditEntryDoc returns the reference to the document holding the
+// audit log entry with the given sequence number.
+func auditEntryDoc(client *firestore.Client, pkey string, seq int) *firestore.DocumentRef {
+	return auditEntries(client, pkey).Doc(fmt.Sprintf("%010d", seq))
+}
+
+// readAuditHead returns the head of the audit log of a project.  Logs
+// written before the head was kept are read from their last entry.
+// The reads are made in tx if it is not nil.
+func readAuditHead(ctx context.Context, client *firestore.Client, tx *firestore.Transaction, pkey string) (*auditHead, error) {
+
+	var doc *firestore.DocumentSnapshot
+	var err error
+	if tx != nil {
+		doc, err = tx.Get(auditDoc(client, pkey))
+	} else {
+		doc, err = auditDoc(client, pkey).Get(ctx)
+	}
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+	head := new(auditHead)
+	if err == nil && hasFields(doc, "Count") {
+		if err := doc.DataTo(head); err != nil {
+			return nil, err
+		}
+		return head, nil
+	}
+
+	q := auditEntries(client, pkey).OrderBy("Seq", firestore.Desc).Limit(1)
+	var iter *firestore.DocumentIterator
+	if tx != nil {
+		iter = tx.Documents(q)
+	} else {
+		iter = q.Documents(ctx)
+	}
+	defer iter.Stop()
+	doc, err = iter.Next()
+	if err == iterator.Done {
+		return head, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var last AuditEntry
+	if err := doc.DataTo(&last); err != nil {
+		return nil, err
+	}
+
+	return &auditHead{Count: last.Seq, Hash: last.Hash}, nil
+}
+
+// chainAudit chains the entries, in order, to the end of the log with
+// the given head, and returns the new head.
+func chainAudit(head *auditHead, entries []*AuditEntry) *auditHead {
+
+	prev := head.last()
+	for _, e := range entries {
+		e.chain(prev)
+		prev = e
+	}
+	if prev == nil {
+		return head
+	}
+
+	return &auditHead{Count: prev.Seq, Hash: prev.Hash}
+}
+
+// newAuditEntry returns an unchained audit log entry for an action
+// taken now.
+func newAuditEntry(actor, action, target string, before, after interface{}, sig *Signature) *AuditEntry {
+
+	e := &AuditEntry{
+		Time:   time.Now(),
+		Actor:  actor,
+		Action: action,
+		Target: target,
+	}
+	if sig != nil {
+		e.Signature = sig.String()
+	}
+	if before != nil {
+		e.Before = auditValue(before)
+	}
+	if after != nil {
+		e.After = auditValue(after)
+	}
+
+	return e
+}
+
+// logAudit adds an entry to the audit log of a project for a change
+// to the project.  The entry is written by saveProject, together with
+// the change, so that neither is stored without the other.
+func (proj *Project) logAudit(actor, action, target string, before, after interface{}) {
+	proj.logSignedAudit(actor, action, target, before, after, nil)
+}
+
+// logSignedAudit adds an entry to the audit log of a project for a
+// change to the project, including the signature applied to the
+// change.
+func (proj *Project) logSignedAudit(actor, action, target string, before, after interface{}, sig *Signature) {
+	proj.pendingAudit = append(proj.pendingAudit, newAuditEntry(actor, action, target, before, after, sig))
+}
+
+// appendAudit adds an entry to the audit log of a project.  The new
+// entry is created, never overwritten, within a transaction that also
+// moves the head of the log, so that concurrent writers cannot lose
+// entries or break the chain.  Any writes added by extra are made in
+// the same transaction.
+func appendAudit(ctx context.Context, client *firestore.Client, pkey string, e *AuditEntry, extra func(*firestore.Transaction) error) error {
+
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+
+		head, err := readAuditHead(ctx, client, tx, pkey)
+		if err != nil {
+			return err
+		}
+
+		head = chainAudit(head, []*AuditEntry{e})
+		if err := tx.Create(auditEntryDoc(client, pkey, e.Seq), e); err != nil {
+			return err
+		}
+		if err := tx.Set(auditDoc(client, pkey), head); err != nil {
+			return err
+		}
+		if extra != nil {
+			return extra(tx)
+		}
+		return nil
+	})
+}
+
+// recordAudit adds an entry to the audit log of a project, for actions
+// that do not change the project document.  Changes to the project are
+// recorded with logAudit instead.
+func recordAudit(ctx context.Context, pkey, actor, action, target string, before, after interface{}) error {
+	return recordSignedAudit(ctx, pkey, actor, action, target, before, after, nil)
+}
+
+// recordSignedAudit adds an entry to the audit log of a project,
+// including the signature applied to the action.
+func recordSignedAudit(ctx context.Context, pkey, actor, action, target string, before, after interface{}, sig *Signature) error {
+
+	ctx = context.Background()
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	e := newAuditEntry(actor, action, target, before, after, sig)
+	if err := appendAudit(ctx, client, pkey, e, nil); err != nil {
+		log.Printf("recordAudit: %s %s %s: %v", pkey, action, target, err)
+		return err
+	}
+
+	return nil
+}
+
+// getAudit returns the audit log of a project in order, and its head.
+func getAudit(ctx context.Context, pkey string) ([]*AuditEntry, *auditHead, error) {
+
+	ctx = context.Background()
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer client.Close()
+
+	head, err := readAuditHead(ctx, client, nil, pkey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []*AuditEntry
+	iter := auditEntries(client, pkey).OrderBy("Seq", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		e := new(AuditEntry)
+		if err := doc.DataTo(e); err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, head, nil
+}
+
+// ViewAudit displays the audit log of a project and the result of
+// verifying its hash chain.
+func ViewAudit(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionViewData, r) {
+		msg := "You don't have permission to view the audit log of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ViewAudit [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	entries, head, err := getAudit(ctx, pkey)
+	if err != nil {
+		log.Printf("ViewAudit [2]: %v", err)
+		msg := "Datastore error: unable to retrieve the audit log."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	verified := fmt.Sprintf("The audit log contains %d entries and its hash chain is intact.", len(entries))
+	if err := verifyAudit(entries, head); err != nil {
+		verified = fmt.Sprintf("The audit log failed verification: %v.", err)
+	}
+
+	type entryView struct {
+		Seq       int
+		Time      string
+		Actor     string
+		Action    string
+		Target    string
+		Before    string
+		After     string
+		Hash      string
+		Signature string
+	}
+	loc, _ := time.LoadLocation("America/New_York")
+	var ev []entryView
+	for _, e := range entries {
+		hash := e.Hash
+		if len(hash) > 12 {
+			hash = hash[0:12]
+		}
+		ev = append(ev, entryView{
+			Seq:       e.Seq,
+			Time:      e.Time.In(loc).Format("2006-01-02 3:04:05 PM"),
+			Actor:     e.Actor,
+			Action:    e.Action,
+			Target:    e.Target,
+			Before:    e.Before,
+			After:     e.After,
+			Hash:      hash,
+			Signature: e.Signature,
+		})
+	}
+
+	tvals := struct {
+		User     string
+		LoggedIn bool
+		Pkey     string
+		Project  *Project
+		Verified string
+		Entries  []entryView
+	}{
+		User:     useremail,
+		LoggedIn: useremail != "",
+		Pkey:     pkey,
+		Project:  proj,
+		Verified: verified,
+		Entries:  ev,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "view_audit.html", tvals); err != nil {
+		log.Printf("viewAudit failed to execute template: %v", err)
+	}
+}
+
+// VerifyAudit checks the hash chain of the audit log of a project and
+// reports the result in plain text, for use from scripts.
+func VerifyAudit(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionViewData, r) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+
+	entries, head, err := getAudit(ctx, pkey)
+	if err != nil {
+		log.Printf("VerifyAudit: %v", err)
+		http.Error(w, "unable to retrieve the audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := verifyAudit(entries, head); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = io.WriteString(w, fmt.Sprintf("FAILED: %v\n", err))
+		return
+	}
+
+	var last string
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].Hash
+	}
+	_, _ = io.WriteString(w, strings.Join([]string{
+		"OK",
+		fmt.Sprintf("entries: %d", len(entries)),
+		"last hash: " + last,
+	}, "\n")+"\n")
+}
@@ -0,0 +1,101 @@
+package randomize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditChain(t *testing.T) {
+
+	var entries []*AuditEntry
+	var prev *AuditEntry
+	for i, action := range []string{AuditCreate, AuditAssign, AuditEdit, AuditRemove} {
+		e := &AuditEntry{
+			Time:   time.Date(2021, 3, 1, 10, i, 0, 123456789, time.UTC),
+			Actor:  "owner@example.com",
+			Action: action,
+			Target: "s1",
+			Before: "A",
+			After:  "B",
+		}
+		e.chain(prev)
+		entries = append(entries, e)
+		prev = e
+	}
+	head := &auditHead{Count: 4, Hash: entries[3].Hash}
+
+	if err := verifyAudit(entries, head); err != nil {
+		t.Fatalf("intact chain failed verification: %v", err)
+	}
+	if entries[3].Seq != 4 || entries[3].PrevHash != entries[2].Hash {
+		t.Errorf("entries are not chained")
+	}
+
+	// Altering a value is detected
+	entries[1].After = "A"
+	if verifyAudit(entries, head) == nil {
+		t.Errorf("altered entry was not detected")
+	}
+	entries[1].After = "B"
+
+	// Moving text between fields is detected
+	entries[2].Before, entries[2].After = "AB", ""
+	if verifyAudit(entries, head) == nil {
+		t.Errorf("moved text was not detected")
+	}
+	entries[2].Before, entries[2].After = "A", "B"
+
+	// Rehashing an altered entry breaks the link to the next entry
+	entries[1].Actor = "someone@example.com"
+	entries[1].Hash = entries[1].computeHash()
+	if verifyAudit(entries, head) == nil {
+		t.Errorf("rehashed entry was not detected")
+	}
+	entries[1].Actor = "owner@example.com"
+	entries[1].Hash = entries[1].computeHash()
+
+	// Removing an entry is detected
+	if verifyAudit(append([]*AuditEntry{entries[0]}, entries[2:]...), head) == nil {
+		t.Errorf("removed entry was not detected")
+	}
+
+	// Removing the last entries leaves an intact chain, but not the
+	// one that was written
+	if verifyAudit(entries[0:3], head) == nil {
+		t.Errorf("removed last entry was not detected")
+	}
+	if verifyAudit(entries[0:3], &auditHead{Count: 4, Hash: entries[2].Hash}) == nil {
+		t.Errorf("a head that does not match the last entry was not detected")
+	}
+
+	if err := verifyAudit(entries, head); err != nil {
+		t.Errorf("restored chain failed verification: %v", err)
+	}
+}
+
+func TestPendingAudit(t *testing.T) {
+
+	// Changes to the project are chained to the head of the stored log
+	var proj Project
+	proj.logAudit("owner@example.com", AuditSettings, "targets", "10", "20")
+	proj.logSignedAudit("owner@example.com", AuditEdit, "s1", "A", "B", &Signature{
+		Signer: "owner@example.com", Meaning: "approved", Time: time.Now(),
+	})
+
+	first := &AuditEntry{Time: time.Now(), Actor: "owner@example.com", Action: AuditCreate}
+	first.chain(nil)
+	head := chainAudit(&auditHead{Count: 1, Hash: first.Hash}, proj.pendingAudit)
+
+	entries := append([]*AuditEntry{first}, proj.pendingAudit...)
+	if err := verifyAudit(entries, head); err != nil {
+		t.Errorf("pending entries do not continue the log: %v", err)
+	}
+	if head.Count != 3 || proj.pendingAudit[1].Signature == "" {
+		t.Errorf("unexpected head %+v", head)
+	}
+
+	// An empty log starts at the first entry
+	if h := chainAudit(&auditHead{}, nil); h.Count != 0 || h.last() != nil {
+		t.Errorf("unexpected head %+v for an empty log", h)
+	}
+}
@@ -0,0 +1,312 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DesignCluster is the design of projects that randomize
+	// clusters (e.g. clinics or households) rather than individuals.
+	DesignCluster = "cluster"
+)
+
+// ClusterMember is an individual enrolled into a cluster that has
+// already been assigned to a treatment group.  The member receives
+// the treatment of the cluster.
+type ClusterMember struct {
+
+	// MemberId identifies the individual
+	MemberId string
+
+	// ClusterId identifies the cluster that the individual belongs to
+	ClusterId string
+
+	// Enrolled is the time at which the individual was enrolled
+	Enrolled time.Time
+
+	// Enroller is the person who enrolled the individual
+	Enroller string
+}
+
+// IsCluster returns true if the project randomizes clusters.
+func (proj *Project) IsCluster() bool {
+	return proj.Design == DesignCluster
+}
+
+// enrollMember enrolls an individual into an assigned cluster and
+// returns the treatment group of the cluster.
+func (proj *Project) enrollMember(memberId, clusterId, user string, now time.Time) (string, error) {
+
+	if memberId == "" {
+		return "", fmt.Errorf("the individual id may not be blank")
+	}
+	if m := proj.findMember(memberId); m != nil {
+		return "", fmt.Errorf("individual '%s' is already enrolled in cluster '%s'", memberId, m.ClusterId)
+	}
+
+	rec := proj.findSubject(clusterId)
+	if rec == nil {
+		return "", fmt.Errorf("cluster '%s' has not been assigned to a treatment group", clusterId)
+	}
+	if !rec.Included {
+		return "", fmt.Errorf("cluster '%s' has been removed from the study", clusterId)
+	}
+
+	member := &ClusterMember{
+		MemberId:  memberId,
+		ClusterId: clusterId,
+		Enrolled:  now,
+		Enroller:  user,
+	}
+	proj.Members = append(proj.Members, member)
+
+	return rec.CurrentGroup, nil
+}
+
+// indexMembers adds the members that have been appended to Members
+// since the last call to the member index.
+func (proj *Project) indexMembers() {
+
+	if proj.memberIndex == nil || proj.membersIndexed > len(proj.Members) {
+		proj.memberIndex = make(map[string]int)
+		proj.membersIndexed = 0
+	}
+
+	for ; proj.membersIndexed < len(proj.Members); proj.membersIndexed++ {
+		id := proj.Members[proj.membersIndexed].MemberId
+		if _, ok := proj.memberIndex[id]; !ok {
+			proj.memberIndex[id] = proj.membersIndexed
+		}
+	}
+}
+
+// indexedMember returns the enrolled individual with the given id
+// among the records in Members, or nil if there is no such record.
+func (proj *Project) indexedMember(memberId string) *ClusterMember {
+
+	proj.indexMembers()
+	i, ok := proj.memberIndex[memberId]
+	if ok && proj.Members[i].MemberId != memberId {
+		// Members was replaced, index it again
+		proj.memberIndex = nil
+		proj.indexMembers()
+		i, ok = proj.memberIndex[memberId]
+	}
+	if !ok {
+		return nil
+	}
+
+	return proj.Members[i]
+}
+
+// findMember returns the enrolled individual with the given id, or nil
+// if there is no such individual.  The individual is read from the
+// database if the members of the project were not read.
+func (proj *Project) findMember(memberId string) *ClusterMember {
+
+	m, err := proj.loadMember(memberId)
+	if err != nil {
+		log.Printf("findMember: %s: %v", memberId, err)
+	}
+
+	return m
+}
+
+// memberTotals returns the number of individuals in included clusters
+// assigned to each group, and the corresponding counts within each
+// level of each variable, using the covariates of the clusters.  The
+// counts are laid out in the same way as CellTotals.
+func (proj *Project) memberTotals() ([]int, []float64) {
+
+	p := len(proj.Variables)
+	q := len(proj.GroupNames)
+	r := proj.maxLevels()
+
+	asgn := make([]int, q)
+	cells := make([]float64, p*q*r)
+
+	for _, m := range proj.Members {
+		rec := proj.findSubject(m.ClusterId)
+		if rec == nil || !rec.Included {
+			continue
+		}
+		g := getIndex(proj.GroupNames, rec.CurrentGroup)
+		if g == -1 {
+			continue
+		}
+		asgn[g]++
+		for j, va := range proj.Variables {
+			if j >= len(rec.Data) {
+				break
+			}
+			if k := getIndex(va.Levels, rec.Data[j]); k != -1 {
+				cells[q*r*j+q*k+g]++
+			}
+		}
+	}
+
+	return asgn, cells
+}
+
+// EnrollMember displays the individuals enrolled in clusters, and a
+// form for enrolling a new individual.
+func EnrollMember(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionAssign, r) {
+		msg := "You don't have permission to enroll individuals in this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EnrollMember [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !proj.IsCluster() {
+		msg := "This project does not randomize clusters."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	var clusters []string
+	for _, rec := range proj.RawData {
+		if rec.Included {
+			clusters = append(clusters, rec.SubjectId)
+		}
+	}
+
+	type memberView struct {
+		MemberId  string
+		ClusterId string
+		Group     string
+		Enrolled  string
+		Enroller  string
+	}
+	loc, _ := time.LoadLocation("America/New_York")
+	var members []memberView
+	for _, m := range proj.Members {
+		mv := memberView{
+			MemberId:  m.MemberId,
+			ClusterId: m.ClusterId,
+			Enrolled:  m.Enrolled.In(loc).Format("2006-01-02"),
+			Enroller:  m.Enroller,
+		}
+		if rec := proj.findSubject(m.ClusterId); rec != nil {
+			mv.Group = rec.CurrentGroup
+			if !rec.Included {
+				mv.Group += " (cluster removed)"
+			}
+		}
+		members = append(members, mv)
+	}
+
+	tvals := struct {
+		User     string
+		LoggedIn bool
+		Pkey     string
+		Project  *Project
+		Clusters []string
+		Members  []memberView
+	}{
+		User:     useremail,
+		LoggedIn: useremail != "",
+		Pkey:     pkey,
+		Project:  proj,
+		Clusters: clusters,
+		Members:  members,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "enroll_member.html", tvals); err != nil {
+		log.Printf("enrollMember failed to execute template: %v", err)
+	}
+}
+
+// EnrollMemberConfirm enrolls an individual into a cluster.
+func EnrollMemberConfirm(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionAssign, r) {
+		msg := "You don't have permission to enroll individuals in this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	memberId := strings.TrimSpace(r.FormValue("member_id"))
+	clusterId := r.FormValue("cluster_id")
+
+	// Only the cluster and the individual are read
+	proj, err := getProjectHeader(ctx, pkey)
+	if err == nil {
+		_, err = proj.loadSubject(clusterId)
+	}
+	if err == nil {
+		_, err = proj.loadMember(memberId)
+	}
+	if err != nil {
+		log.Printf("EnrollMemberConfirm [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !checkEnrollmentOpen(proj, pkey, w, r) {
+		return
+	}
+
+	group, err := proj.enrollMember(memberId, clusterId, useremail, time.Now())
+	if err != nil {
+		msg := fmt.Sprintf("The individual was not enrolled: %v.", err)
+		rmsg := "Return to enrollment"
+		messagePage(w, r, msg, rmsg, "/enroll_member?pkey="+pkey)
+		return
+	}
+	proj.Modified = time.Now()
+
+	proj.logAudit(useremail, AuditAssign, memberId, nil, map[string]interface{}{
+		"Cluster": clusterId, "Group": group,
+	})
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("EnrollMemberConfirm [2]: %v", err)
+		msg := "A database error occurred, the individual was not enrolled."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("Individual '%s' has been enrolled in cluster '%s' and receives treatment '%s'.", memberId, clusterId, group)
+	rmsg := "Return to enrollment"
+	messagePage(w, r, msg, rmsg, "/enroll_member?pkey="+pkey)
+}
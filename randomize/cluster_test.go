@@ -0,0 +1,108 @@
+package randomize
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestClusterMembers(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		Design:     DesignCluster,
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Size", Levels: []string{"small", "large"}, Weight: 1},
+		},
+	}, 1, 10, "clinic%d", [][]string{{"small"}, {"large"}})
+
+	// Three individuals in each cluster
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		cluster := fmt.Sprintf("clinic%d", i)
+		for j := 0; j < 3; j++ {
+			grp, err := proj.enrollMember(fmt.Sprintf("p%d-%d", i, j), cluster, "user", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if grp != proj.findSubject(cluster).CurrentGroup {
+				t.Errorf("individual did not inherit the group of cluster %s", cluster)
+			}
+		}
+	}
+
+	if _, err := proj.enrollMember("p0-0", "clinic1", "user", now); err == nil {
+		t.Errorf("an individual cannot be enrolled twice")
+	}
+	if _, err := proj.enrollMember("q", "clinic99", "user", now); err == nil {
+		t.Errorf("the cluster must have been assigned")
+	}
+
+	asgn, cells := proj.memberTotals()
+	for g, n := range asgn {
+		if n != 3*proj.Assignments[g] {
+			t.Errorf("group %d has %d individuals in %d clusters", g, n, proj.Assignments[g])
+		}
+		for k := range proj.Variables[0].Levels {
+			if cells[2*k+g] != 3*proj.GetData(0, k, g) {
+				t.Errorf("individual counts do not match cluster counts")
+			}
+		}
+	}
+
+	// Individuals in a removed cluster are not counted
+	rec := proj.findSubject("clinic0")
+	removeFromAggregate(rec, proj)
+	rec.Included = false
+	asgn, _ = proj.memberTotals()
+	if asgn[0]+asgn[1] != 27 {
+		t.Errorf("expected 27 individuals, got %v", asgn)
+	}
+	if _, err := proj.enrollMember("q", "clinic0", "user", now); err == nil {
+		t.Errorf("individuals cannot be enrolled in a removed cluster")
+	}
+}
+
+func TestClusterMemberStorage(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		Design:     DesignCluster,
+		GroupNames: []string{"A", "B"},
+	}, 1, 2, "clinic%d", nil)
+	proj.markWritten(proj.pendingWrites(false))
+
+	// New members are written as child records
+	now := time.Now()
+	for _, id := range []string{"p1", "p2"} {
+		if _, err := proj.enrollMember(id, "clinic1", "user", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ids []string
+	for _, cw := range proj.pendingWrites(false) {
+		if cw.collection == memberCollection {
+			ids = append(ids, cw.record.(*ClusterMember).MemberId)
+		}
+	}
+	if len(ids) != 2 || ids[0] != "p1" || ids[1] != "p2" {
+		t.Errorf("got member writes %v, want [p1 p2]", ids)
+	}
+
+	// Members that are not in memory are looked up when the members
+	// were not read
+	var queries []string
+	proj.stored = &childState{
+		fetch: func(collection, field, value string) (*firestore.DocumentSnapshot, error) {
+			queries = append(queries, collection+"."+field+"="+value)
+			return nil, nil
+		},
+	}
+	if m := proj.findMember("p2"); m == nil || m.ClusterId != "clinic1" {
+		t.Errorf("enrolled member not found")
+	}
+	if m := proj.findMember("p3"); m != nil || len(queries) != 1 || queries[0] != "Members.MemberId=p3" {
+		t.Errorf("got %v after looking up p3", queries)
+	}
+}
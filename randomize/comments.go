@@ -22,7 +22,7 @@ func ViewComments(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionView, r) {
 		msg := "You don't have permission to access this project."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
@@ -71,8 +71,8 @@ func AddComment(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
-		msg := "You don't have permission to access this project."
+	if !checkPermission(susers, ActionComment, r) {
+		msg := "You don't have permission to comment on this project."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
@@ -113,8 +113,8 @@ func ConfirmAddComment(w http.ResponseWriter, r *http.Request) {
 	pkey := r.FormValue("pkey")
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
-		msg := "You don't have permission to access this project."
+	if !checkPermission(susers, ActionComment, r) {
+		msg := "You don't have permission to comment on this project."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
@@ -151,6 +151,8 @@ func ConfirmAddComment(w http.ResponseWriter, r *http.Request) {
 	}
 	proj.Comments = append(proj.Comments, comment)
 
+	proj.logAudit(user, AuditComment, "", nil, commentText)
+
 	err = storeProject(ctx, proj, pkey)
 	if err != nil {
 		msg := "Error, your project was not saved."
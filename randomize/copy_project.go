@@ -7,8 +7,6 @@ import (
 	"strings"
 
 	"cloud.google.com/go/firestore"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 func CopyProject(w http.ResponseWriter, r *http.Request) {
@@ -23,8 +21,8 @@ func CopyProject(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
-		msg := "Only the project owner can copy a project."
+	if !checkPermission(susers, ActionViewData, r) {
+		msg := "You don't have permission to copy this project."
 		rmsg := "Return to project dashboard"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 		return
@@ -68,7 +66,7 @@ func CopyProjectCompleted(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionViewData, r) {
 		msg := "You do not have access to the requested project."
 		rmsg := "Return to project dashboard"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
@@ -105,23 +103,23 @@ func CopyProjectCompleted(w http.ResponseWriter, r *http.Request) {
 	defer client.Close()
 
 	// Check if the project name has already been used.
-	newkey := useremail + "::" + newName
-	_, err = client.Doc("Project/" + newkey).Get(ctx)
-	if status.Code(err) == codes.NotFound {
-		// OK
-	} else if err != nil {
+	exists, err := projectNameExists(ctx, client, useremail, newName)
+	if err != nil {
 		msg := "Database error"
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
-	} else {
+	} else if exists {
 		msg := fmt.Sprintf("A project named \"%s\" belonging to user %s already exists.", newName, useremail)
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
 	}
 
-	if _, err := client.Doc("Project/"+newkey).Set(ctx, &proj); err != nil {
+	proj.logAudit(useremail, AuditCreate, proj.Name, nil, "Copied from project "+pkey)
+
+	newkey, err := storeNewProject(ctx, client, proj)
+	if err != nil {
 		log.Printf("Copy_project: %v", err)
 		msg := "Database error, the project was not copied."
 		rmsg := "Return to dashboard"
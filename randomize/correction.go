@@ -0,0 +1,293 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Correction records a change to the value of a variable for a
+// subject who has already been randomized.
+type Correction struct {
+
+	// Variable is the name of the corrected variable
+	Variable string
+
+	// From and To are the levels before and after the correction
+	From string
+	To   string
+
+	// Time is the time of the correction
+	Time time.Time
+
+	// User is the person who made the correction
+	User string
+
+	// Reason is the reason given for the correction
+	Reason string
+}
+
+// MisStratified returns true if the subject was randomized using a
+// value of a variable that was later corrected.
+func (rec *DataRecord) MisStratified() bool {
+	for j, x := range rec.OriginalData {
+		if j < len(rec.Data) && rec.Data[j] != x {
+			return true
+		}
+	}
+	return false
+}
+
+// counted returns true if the subject is included in the aggregate
+// counts.
+func (rec *DataRecord) counted() bool {
+	return rec.Included || rec.BalanceRetained
+}
+
+// correctCovariate changes the level of a variable for a randomized
+// subject, keeping the value originally entered.  The aggregate counts
+// are updated, but the subject's treatment group is not changed.
+func (proj *Project) correctCovariate(rec *DataRecord, variable int, level string, user, reason string, now time.Time) error {
+
+	if variable < 0 || variable >= len(proj.Variables) || variable >= len(rec.Data) {
+		return fmt.Errorf("there is no variable with index %d", variable)
+	}
+	va := proj.Variables[variable]
+	if getIndex(va.Levels, level) == -1 {
+		return fmt.Errorf("'%s' is not a level of variable '%s'", level, va.Name)
+	}
+	if rec.Data[variable] == level {
+		return fmt.Errorf("the value of '%s' for subject '%s' is already '%s'", va.Name, rec.SubjectId, level)
+	}
+	if reason == "" {
+		return fmt.Errorf("a reason for the correction must be provided")
+	}
+
+	proj.logEvent(&Event{
+		Time:      now,
+		Kind:      EventCorrect,
+		SubjectId: rec.SubjectId,
+		Variable:  va.Name,
+		Level:     level,
+		User:      user,
+	})
+
+	if rec.OriginalData == nil {
+		rec.OriginalData = make([]string, len(rec.Data))
+		copy(rec.OriginalData, rec.Data)
+	}
+
+	if rec.counted() {
+		removeFromAggregate(rec, proj)
+	}
+	old := rec.Data[variable]
+	rec.Data[variable] = level
+	if rec.counted() {
+		addToAggregate(rec, proj)
+	}
+
+	rec.Corrections = append(rec.Corrections, &Correction{
+		Variable: va.Name,
+		From:     old,
+		To:       level,
+		Time:     now,
+		User:     user,
+		Reason:   reason,
+	})
+	proj.Corrected = true
+
+	return nil
+}
+
+// misStratifiedSubjects returns the ids of the subjects who were
+// randomized using values that were later corrected.
+func (proj *Project) misStratifiedSubjects() []string {
+	var ids []string
+	for _, rec := range proj.RawData {
+		if rec.MisStratified() {
+			ids = append(ids, rec.SubjectId)
+		}
+	}
+	return ids
+}
+
+// CorrectCovariate displays a form for correcting the value of a
+// variable for a randomized subject.
+func CorrectCovariate(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionCorrect, r) {
+		msg := "Only the project owner can correct the data of randomized subjects."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("CorrectCovariate [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !proj.StoreRawData || len(proj.Variables) == 0 {
+		msg := "Data can only be corrected for projects that store the subject-level data and have variables."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	type option struct {
+		Value string
+		Label string
+	}
+	var options []option
+	for j, va := range proj.Variables {
+		for _, lev := range va.Levels {
+			options = append(options, option{
+				Value: fmt.Sprintf("%d:%s", j, lev),
+				Label: levelKey(va.Name, lev),
+			})
+		}
+	}
+
+	type correctionView struct {
+		SubjectId string
+		Variable  string
+		From      string
+		To        string
+		Time      string
+		User      string
+		Reason    string
+	}
+	loc, _ := time.LoadLocation("America/New_York")
+	var corrections []correctionView
+	for _, rec := range proj.RawData {
+		for _, c := range rec.Corrections {
+			corrections = append(corrections, correctionView{
+				SubjectId: rec.SubjectId,
+				Variable:  c.Variable,
+				From:      c.From,
+				To:        c.To,
+				Time:      c.Time.In(loc).Format("2006-01-02 3:04 PM"),
+				User:      c.User,
+				Reason:    c.Reason,
+			})
+		}
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Pkey        string
+		Project     *Project
+		Options     []option
+		Corrections []correctionView
+	}{
+		User:        useremail,
+		LoggedIn:    useremail != "",
+		Pkey:        pkey,
+		Project:     proj,
+		Options:     options,
+		Corrections: corrections,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "correct_covariate.html", tvals); err != nil {
+		log.Printf("correctCovariate failed to execute template: %v", err)
+	}
+}
+
+// CorrectCovariateCompleted corrects the value of a variable for a
+// randomized subject.
+func CorrectCovariateCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionCorrect, r) {
+		msg := "Only the project owner can correct the data of randomized subjects."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("CorrectCovariateCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	subjectId := strings.TrimSpace(r.FormValue("subject_id"))
+	reason := strings.TrimSpace(r.FormValue("reason"))
+
+	// The new value has the form "variable index:level"
+	variable, level := -1, ""
+	if v := strings.SplitN(r.FormValue("value"), ":", 2); len(v) == 2 {
+		if j, err := strconv.Atoi(v[0]); err == nil {
+			variable, level = j, v[1]
+		}
+	}
+
+	rec := proj.findSubject(subjectId)
+	if rec == nil {
+		err = fmt.Errorf("there is no subject with id '%s'", subjectId)
+	} else {
+		err = proj.correctCovariate(rec, variable, level, useremail, reason, time.Now())
+	}
+	if err != nil {
+		msg := fmt.Sprintf("The data were not corrected: %v.", err)
+		rmsg := "Return to data corrections"
+		messagePage(w, r, msg, rmsg, "/correct_covariate?pkey="+pkey)
+		return
+	}
+
+	c := rec.Corrections[len(rec.Corrections)-1]
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  c.Time,
+		Comment: []string{
+			fmt.Sprintf("Variable '%s' of subject '%s' corrected from '%s' to '%s', the subject is mis-stratified.",
+				c.Variable, subjectId, c.From, c.To),
+			reason,
+		},
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditCorrect, subjectId, c.Variable+"="+c.From, map[string]string{
+		"Value": c.Variable + "=" + c.To, "Reason": reason,
+	})
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("CorrectCovariateCompleted [2]: %v", err)
+		msg := "Database error, the data were not corrected."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	http.Redirect(w, r, "/correct_covariate?pkey="+pkey, http.StatusSeeOther)
+}
@@ -0,0 +1,47 @@
+package randomize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCorrectCovariate(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+			{Name: "Site", Levels: []string{"1", "2", "3"}, Weight: 1},
+		},
+	}, 1, 12, "", [][]string{{"F", "1"}, {"F", "2"}, {"F", "3"}})
+
+	rec := proj.findSubject("4")
+	g := getIndex(proj.GroupNames, rec.CurrentGroup)
+	nf, nm := proj.GetData(0, 0, g), proj.GetData(0, 1, g)
+
+	if err := proj.correctCovariate(rec, 0, "F", "owner", "typo", time.Now()); err == nil {
+		t.Errorf("a correction to the same value should fail")
+	}
+	if err := proj.correctCovariate(rec, 0, "X", "owner", "typo", time.Now()); err == nil {
+		t.Errorf("a correction to an unknown level should fail")
+	}
+	if err := proj.correctCovariate(rec, 0, "M", "owner", "", time.Now()); err == nil {
+		t.Errorf("a correction without a reason should fail")
+	}
+
+	if err := proj.correctCovariate(rec, 0, "M", "owner", "typo", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if proj.GetData(0, 0, g) != nf-1 || proj.GetData(0, 1, g) != nm+1 {
+		t.Errorf("cell totals were not updated")
+	}
+	if !rec.MisStratified() || rec.OriginalData[0] != "F" || rec.Data[0] != "M" {
+		t.Errorf("the original value was not retained: %v %v", rec.OriginalData, rec.Data)
+	}
+	if proj.NumAssignments() != 12 || rec.CurrentGroup != proj.GroupNames[g] {
+		t.Errorf("the correction changed the assignments")
+	}
+	if ids := proj.misStratifiedSubjects(); len(ids) != 1 || ids[0] != "4" {
+		t.Errorf("expected subject 4 to be mis-stratified, got %v", ids)
+	}
+}
@@ -9,8 +9,6 @@ import (
 	"time"
 
 	"cloud.google.com/go/firestore"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 // CreateProjectStep1 gets the project name from the user.
@@ -60,16 +58,13 @@ func CreateProjectStep2(w http.ResponseWriter, r *http.Request) {
 	projectName := r.FormValue("project_name")
 
 	// Check if the project name has already been used.
-	pkey := useremail + "::" + projectName
-	_, err = client.Doc("Project/" + pkey).Get(ctx)
-	if status.Code(err) == codes.NotFound {
-		// OK
-	} else if err != nil {
+	exists, err := projectNameExists(ctx, client, useremail, projectName)
+	if err != nil {
 		msg := "Database error"
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
-	} else if err == nil {
+	} else if exists {
 		msg := fmt.Sprintf("A project named '%s' belonging to user %s already exists.", projectName, useremail)
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
@@ -109,17 +104,24 @@ func CreateProjectStep3(w http.ResponseWriter, r *http.Request) {
 
 	useremail := userEmail(r)
 
+	// Individuals are enrolled into clusters by cluster id, so the
+	// cluster-level data must be stored.
+	design := r.FormValue("design")
+	storeRawData := r.FormValue("store_rawdata") == "yes" || design == DesignCluster
+
 	tvals := struct {
 		User         string
 		LoggedIn     bool
 		Name         string
 		Pkey         string
 		StoreRawData bool
+		Design       string
 	}{
 		User:         useremail,
 		LoggedIn:     useremail != "",
 		Name:         r.FormValue("project_name"),
-		StoreRawData: r.FormValue("store_rawdata") == "yes",
+		StoreRawData: storeRawData,
+		Design:       design,
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step3.html", tvals); err != nil {
@@ -144,6 +146,52 @@ func CreateProjectStep4(w http.ResponseWriter, r *http.Request) {
 
 	useremail := userEmail(r)
 
+	// The groups of a factorial design are the combinations of the
+	// factor levels, so there are no group names to enter.
+	if r.FormValue("factors") != "" {
+		factors, err := parseFactors(r.FormValue("factors"))
+		if err != nil {
+			msg := fmt.Sprintf("The factors could not be used: %v.", err)
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+		names := factorialGroupNames(factors)
+		r.Form.Set("factors", formatFactors(factors))
+		r.Form.Set("numgroups", fmt.Sprintf("%d", len(names)))
+		for i, x := range names {
+			r.Form.Set(fmt.Sprintf("name%d", i+1), x)
+		}
+		CreateProjectStep5(w, r)
+		return
+	}
+
+	// The groups of a crossover design are the sequences of a
+	// Williams design for the treatments.
+	if r.FormValue("treatments") != "" {
+		if r.FormValue("design") == DesignCluster {
+			msg := "Cluster randomized projects cannot use a crossover design."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+		treatments, err := parseTreatments(r.FormValue("treatments"))
+		if err != nil {
+			msg := fmt.Sprintf("The treatments could not be used: %v.", err)
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+		names := crossoverGroupNames(treatments)
+		r.Form.Set("design", DesignCrossover)
+		r.Form.Set("numgroups", fmt.Sprintf("%d", len(names)))
+		for i, x := range names {
+			r.Form.Set(fmt.Sprintf("name%d", i+1), x)
+		}
+		CreateProjectStep5(w, r)
+		return
+	}
+
 	numgroups, _ := strconv.Atoi(r.FormValue("numgroups"))
 
 	// Group numbers (they don't have names yet)
@@ -160,6 +208,7 @@ func CreateProjectStep4(w http.ResponseWriter, r *http.Request) {
 		StoreRawData bool
 		NumGroups    int
 		IX           []int
+		Design       string
 	}{
 		User:         useremail,
 		LoggedIn:     useremail != "",
@@ -167,6 +216,7 @@ func CreateProjectStep4(w http.ResponseWriter, r *http.Request) {
 		StoreRawData: r.FormValue("store_rawdata") == "true",
 		IX:           groupix,
 		NumGroups:    numgroups,
+		Design:       r.FormValue("design"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step4.html", tvals); err != nil {
@@ -215,6 +265,8 @@ func CreateProjectStep5(w http.ResponseWriter, r *http.Request) {
 		StoreRawData   bool
 		NumGroups      int
 		IX             []int
+		Factors        string
+		Design         string
 	}{
 		User:           useremail,
 		LoggedIn:       useremail != "",
@@ -224,6 +276,8 @@ func CreateProjectStep5(w http.ResponseWriter, r *http.Request) {
 		NumGroups:      len(GroupNames),
 		StoreRawData:   r.FormValue("store_rawdata") == "true",
 		IX:             groupix,
+		Factors:        r.FormValue("factors"),
+		Design:         r.FormValue("design"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step5.html", tvals); err != nil {
@@ -285,6 +339,8 @@ func CreateProjectStep6(w http.ResponseWriter, r *http.Request) {
 		StoreRawData  bool
 		SamplingRates string
 		NumGroups     int
+		Factors       string
+		Design        string
 	}{
 		User:          useremail,
 		LoggedIn:      useremail != "",
@@ -293,6 +349,8 @@ func CreateProjectStep6(w http.ResponseWriter, r *http.Request) {
 		StoreRawData:  r.FormValue("store_rawdata") == "true",
 		SamplingRates: strings.Join(samplingRates, ","),
 		NumGroups:     numgroups,
+		Factors:       r.FormValue("factors"),
+		Design:        r.FormValue("design"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step6.html", tvals); err != nil {
@@ -338,6 +396,8 @@ func CreateProjectStep7(w http.ResponseWriter, r *http.Request) {
 		NumVar        int
 		AnyVars       bool
 		SamplingRates string
+		Factors       string
+		Design        string
 	}{
 		User:          useremail,
 		LoggedIn:      useremail != "",
@@ -349,6 +409,8 @@ func CreateProjectStep7(w http.ResponseWriter, r *http.Request) {
 		AnyVars:       numvar > 0,
 		StoreRawData:  r.FormValue("store_rawdata") == "true",
 		SamplingRates: r.FormValue("rates"),
+		Factors:       r.FormValue("factors"),
+		Design:        r.FormValue("design"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step7.html", tvals); err != nil {
@@ -438,6 +500,8 @@ func CreateProjectStep8(w http.ResponseWriter, r *http.Request) {
 		Numvar        int
 		Variables     string
 		SamplingRates string
+		Factors       string
+		Design        string
 	}{
 		User:          useremail,
 		LoggedIn:      useremail != "",
@@ -449,6 +513,8 @@ func CreateProjectStep8(w http.ResponseWriter, r *http.Request) {
 		Variables:     variables,
 		StoreRawData:  r.FormValue("store_rawdata") == "true",
 		SamplingRates: r.FormValue("rates"),
+		Factors:       r.FormValue("factors"),
+		Design:        r.FormValue("design"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step8.html", tvals); err != nil {
@@ -512,6 +578,21 @@ func CreateProjectStep9(w http.ResponseWriter, r *http.Request) {
 
 	gn := cleanSplit(GroupNames, ",")
 
+	var factors []Factor
+	if r.FormValue("factors") != "" {
+		factors, err = parseFactors(r.FormValue("factors"))
+		if err == nil && strings.Join(factorialGroupNames(factors), ",") != strings.Join(gn, ",") {
+			err = fmt.Errorf("the treatment groups do not match the factors")
+		}
+		if err != nil {
+			log.Printf("createProjectStep9: %v", err)
+			msg := fmt.Sprintf("The factors could not be used: %v.", err)
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+	}
+
 	proj := Project{
 		Owner:        useremail,
 		Created:      time.Now(),
@@ -519,6 +600,8 @@ func CreateProjectStep9(w http.ResponseWriter, r *http.Request) {
 		Variables:    vars,
 		Bias:         bias,
 		GroupNames:   gn,
+		Design:       r.FormValue("design"),
+		Factors:      factors,
 		Assignments:  make([]int, len(gn)),
 		StoreRawData: r.FormValue("store_rawdata") == "true",
 		Open:         true,
@@ -536,6 +619,30 @@ func CreateProjectStep9(w http.ResponseWriter, r *http.Request) {
 	}
 	proj.SamplingRates = ratesNum
 
+	// Crossover projects can use permuted blocks of sequences instead
+	// of minimization.  Each block must contain every sequence in
+	// proportion to its sampling rate.
+	if proj.IsCrossover() && r.FormValue("block_size") != "" {
+		proj.BlockSize, err = strconv.Atoi(r.FormValue("block_size"))
+		if err == nil && proj.BlockSize > 0 {
+			all := make([]int, len(gn))
+			for i := range all {
+				all[i] = i
+			}
+			if len(ratesNum) != len(gn) {
+				err = fmt.Errorf("there are %d sampling rates for %d sequences", len(ratesNum), len(gn))
+			} else if _, exact := blockPlaces(ratesNum, all, proj.BlockSize); !exact {
+				err = fmt.Errorf("a block of size %d cannot be divided in proportion to the rates", proj.BlockSize)
+			}
+		}
+		if err != nil || proj.BlockSize < 0 {
+			msg := "The block size must allow each block to contain every sequence in proportion to its sampling rate."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+	}
+
 	// Set up the data.
 	{
 		// Maximum number of levels
@@ -551,8 +658,9 @@ func CreateProjectStep9(w http.ResponseWriter, r *http.Request) {
 		proj.CellTotals = make([]float64, m)
 	}
 
-	pkey := makeKey(useremail, projectName)
-	if _, err := client.Doc("Project/"+pkey).Set(ctx, proj); err != nil {
+	proj.logAudit(useremail, AuditCreate, proj.Name, nil, &proj)
+
+	if _, err := storeNewProject(ctx, client, &proj); err != nil {
 		msg := "A database error occurred, the project was not created."
 		log.Printf("Create_project_step9: %v", err)
 		rmsg := "Return to dashboard"
@@ -560,12 +668,6 @@ func CreateProjectStep9(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Remove any stale SharingByProject entities so that this project starts out
-	// with no sharing
-	if _, err := client.Doc("SharingByProject/" + pkey).Delete(ctx); err != nil {
-		log.Printf("Create_project_step9 [3]: %v", err)
-	}
-
 	tvals := struct {
 		User     string
 		LoggedIn bool
@@ -614,6 +716,8 @@ func validationErrorStep8(w http.ResponseWriter, r *http.Request) {
 		StoreRawData  bool
 		Numvar        int
 		SamplingRates string
+		Factors       string
+		Design        string
 	}{
 		User:          useremail,
 		LoggedIn:      useremail != "",
@@ -623,6 +727,8 @@ func validationErrorStep8(w http.ResponseWriter, r *http.Request) {
 		Numvar:        numvar,
 		StoreRawData:  r.FormValue("store_rawdata") == "true",
 		SamplingRates: r.FormValue("rates"),
+		Factors:       r.FormValue("factors"),
+		Design:        r.FormValue("design"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "validation_error_step8.html", tvals); err != nil {
@@ -0,0 +1,203 @@
+package randomize
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+const (
+	// DesignCrossover is the design of projects that randomize
+	// subjects to a sequence of treatments.
+	DesignCrossover = "crossover"
+
+	// sequenceSep separates the treatments in the name of a crossover
+	// sequence.
+	sequenceSep = "-"
+)
+
+// IsCrossover returns true if the project randomizes subjects to
+// treatment sequences.
+func (proj *Project) IsCrossover() bool {
+	return proj.Design == DesignCrossover
+}
+
+// parseTreatments parses a comma-separated list of crossover
+// treatments.
+func parseTreatments(s string) ([]string, error) {
+
+	treatments := cleanSplit(s, ",")
+	if len(treatments) < 2 {
+		return nil, fmt.Errorf("a crossover design needs at least two treatments")
+	}
+	for i, x := range treatments {
+		if err := checkLabel(x, treatments[0:i]); err != nil {
+			return nil, err
+		}
+		if strings.Contains(x, sequenceSep) {
+			return nil, fmt.Errorf("the treatment '%s' may not contain '%s'", x, sequenceSep)
+		}
+	}
+
+	return treatments, nil
+}
+
+// williamsDesign returns the treatment sequences of a Williams design
+// for n treatments, as indices into the treatments.  Each treatment
+// appears once in each period and follows every other treatment
+// equally often.  There are n sequences if n is even and 2n if n is
+// odd.  For two treatments this is the AB/BA design.
+func williamsDesign(n int) [][]int {
+
+	// The first sequence is 0, 1, n-1, 2, n-2, ...
+	first := make([]int, n)
+	lo, hi := 1, n-1
+	for j := 1; j < n; j++ {
+		if j%2 == 1 {
+			first[j] = lo
+			lo++
+		} else {
+			first[j] = hi
+			hi--
+		}
+	}
+
+	var seqs [][]int
+	for i := 0; i < n; i++ {
+		seq := make([]int, n)
+		for j, x := range first {
+			seq[j] = (x + i) % n
+		}
+		seqs = append(seqs, seq)
+	}
+
+	// With an odd number of treatments the mirror images are needed
+	// to balance the first-order carryover effects.
+	if n%2 == 1 {
+		for i := 0; i < n; i++ {
+			seq := make([]int, n)
+			for j := range seq {
+				seq[j] = seqs[i][n-1-j]
+			}
+			seqs = append(seqs, seq)
+		}
+	}
+
+	return seqs
+}
+
+// crossoverGroupNames returns the names of the treatment sequences of
+// a Williams design for the given treatments.
+func crossoverGroupNames(treatments []string) []string {
+
+	var names []string
+	for _, seq := range williamsDesign(len(treatments)) {
+		var x []string
+		for _, j := range seq {
+			x = append(x, treatments[j])
+		}
+		names = append(names, strings.Join(x, sequenceSep))
+	}
+
+	return names
+}
+
+// sequence returns the treatment given in each period for a subject
+// assigned to the named group.  For designs other than crossover
+// designs the sequence has a single period.
+func (proj *Project) sequence(group string) []string {
+	if !proj.IsCrossover() {
+		return []string{group}
+	}
+	return strings.Split(group, sequenceSep)
+}
+
+// NumPeriods returns the number of treatment periods of the project.
+func (proj *Project) NumPeriods() int {
+	if !proj.IsCrossover() || len(proj.GroupNames) == 0 {
+		return 1
+	}
+	return len(proj.sequence(proj.GroupNames[0]))
+}
+
+// blockPlaces returns the number of places for each of the given
+// groups in a block of the given size, in proportion to their
+// sampling rates.  The places are rounded by the largest remainder
+// method so that they add up to the block size.  The second return
+// value is false if the block cannot be divided exactly in proportion
+// to the rates.
+func blockPlaces(rates []float64, groups []int, size int) ([]int, bool) {
+
+	var sum float64
+	for _, g := range groups {
+		sum += rates[g]
+	}
+
+	places := make([]int, len(groups))
+	rem := make([]float64, len(groups))
+	exact := true
+	left := size
+	for i, g := range groups {
+		x := rates[g] / sum * float64(size)
+		places[i] = int(math.Floor(x))
+		rem[i] = x - float64(places[i])
+		if rem[i] > 1e-9 && rem[i] < 1-1e-9 {
+			exact = false
+		} else if rem[i] >= 1-1e-9 {
+			places[i]++
+			rem[i] = 0
+		}
+		left -= places[i]
+	}
+
+	// Give the remaining places to the groups with the largest
+	// remainders, the earlier group if there is a tie
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return rem[order[i]] > rem[order[j]] })
+	for k := 0; k < left; k++ {
+		places[order[k]]++
+	}
+
+	return places, exact
+}
+
+// blockAssignment chooses a group by permuted block randomization
+// among the open groups.  Each block contains every group a number of
+// times proportional to its sampling rate.  A new block is started
+// when no open group has places remaining in the current block.
+func (proj *Project) blockAssignment(rgen *rand.Rand, open []int) int {
+
+	if len(proj.BlockRemaining) != len(proj.GroupNames) {
+		proj.BlockRemaining = make([]int, len(proj.GroupNames))
+	}
+
+	total := 0
+	for _, g := range open {
+		total += proj.BlockRemaining[g]
+	}
+
+	if total == 0 {
+		places, _ := blockPlaces(proj.SamplingRates, open, proj.BlockSize)
+		for i, g := range open {
+			proj.BlockRemaining[g] = places[i]
+			total += places[i]
+		}
+	}
+
+	// Choose a place in the block uniformly at random
+	u := rgen.Intn(total)
+	for _, g := range open {
+		if u < proj.BlockRemaining[g] {
+			proj.BlockRemaining[g]--
+			return g
+		}
+		u -= proj.BlockRemaining[g]
+	}
+
+	panic("unreachable")
+}
@@ -0,0 +1,129 @@
+package randomize
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWilliamsDesign(t *testing.T) {
+
+	for n := 2; n <= 7; n++ {
+
+		seqs := williamsDesign(n)
+		ns := n
+		if n%2 == 1 {
+			ns = 2 * n
+		}
+		if len(seqs) != ns {
+			t.Fatalf("n=%d: expected %d sequences, got %d", n, ns, len(seqs))
+		}
+
+		// Each treatment appears equally often in each period
+		for k := 0; k < n; k++ {
+			count := make([]int, n)
+			for _, seq := range seqs {
+				count[seq[k]]++
+			}
+			for _, c := range count {
+				if c != ns/n {
+					t.Errorf("n=%d: period %d is not balanced: %v", n, k, count)
+				}
+			}
+		}
+
+		// Each treatment follows every other treatment equally often
+		pairs := make(map[[2]int]int)
+		for _, seq := range seqs {
+			for k := 1; k < n; k++ {
+				pairs[[2]int{seq[k-1], seq[k]}]++
+			}
+		}
+		if len(pairs) != n*(n-1) {
+			t.Errorf("n=%d: only %d of %d ordered pairs occur", n, len(pairs), n*(n-1))
+		}
+		for p, c := range pairs {
+			if c != pairs[[2]int{0, 1}] {
+				t.Errorf("n=%d: pair %v occurs %d times", n, p, c)
+			}
+		}
+	}
+
+	names := crossoverGroupNames([]string{"A", "B"})
+	if fmt.Sprintf("%v", names) != "[A-B B-A]" {
+		t.Errorf("unexpected sequences %v", names)
+	}
+
+	if _, err := parseTreatments("A"); err == nil {
+		t.Errorf("a single treatment should be rejected")
+	}
+	if _, err := parseTreatments("A-1, B"); err == nil {
+		t.Errorf("treatments containing '-' should be rejected")
+	}
+}
+
+func TestCrossoverBlocks(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		Design:     DesignCrossover,
+		GroupNames: crossoverGroupNames([]string{"A", "B", "C"}),
+		BlockSize:  12,
+	}, 1, 0, "", nil)
+
+	for i := 0; i < 36; i++ {
+		if _, err := proj.doAssignment(map[string]string{}, fmt.Sprintf("%d", i), "user"); err != nil {
+			t.Fatal(err)
+		}
+
+		// At the end of each block all sequences are balanced
+		if (i+1)%12 == 0 {
+			for _, n := range proj.Assignments {
+				if n != 2*(i+1)/12 {
+					t.Errorf("sequences are not balanced after %d subjects: %v", i+1, proj.Assignments)
+				}
+			}
+		}
+	}
+
+	rec := proj.RawData[0]
+	if len(rec.Sequence) != 3 || rec.Sequence[0]+"-"+rec.Sequence[1]+"-"+rec.Sequence[2] != rec.AssignedGroup {
+		t.Errorf("the record does not store the sequence: %v", rec.Sequence)
+	}
+	if proj.NumPeriods() != 3 {
+		t.Errorf("expected 3 periods, got %d", proj.NumPeriods())
+	}
+}
+
+func TestBlockPlaces(t *testing.T) {
+
+	for _, tc := range []struct {
+		rates  []float64
+		groups []int
+		size   int
+		places string
+		exact  bool
+	}{
+		{[]float64{1, 1}, []int{0, 1}, 4, "[2 2]", true},
+		{[]float64{2, 1}, []int{0, 1}, 6, "[4 2]", true},
+		{[]float64{0.5, 0.5}, []int{0, 1}, 4, "[2 2]", true},
+		{[]float64{0.1, 0.2, 0.7}, []int{0, 1, 2}, 10, "[1 2 7]", true},
+		{[]float64{2, 1}, []int{0, 1}, 4, "[3 1]", false},
+		{[]float64{1, 1, 1}, []int{0, 1, 2}, 4, "[2 1 1]", false},
+		{[]float64{1, 5, 1}, []int{0, 2}, 4, "[2 2]", true},
+	} {
+		places, exact := blockPlaces(tc.rates, tc.groups, tc.size)
+		if fmt.Sprint(places) != tc.places || exact != tc.exact {
+			t.Errorf("rates %v, size %d: got %v %v", tc.rates, tc.size, places, exact)
+		}
+	}
+
+	// A block contains the sequences in proportion to their rates
+	proj := testProject(t, &Project{
+		Design:        DesignCrossover,
+		GroupNames:    crossoverGroupNames([]string{"A", "B"}),
+		SamplingRates: []float64{2, 1},
+		BlockSize:     6,
+	}, 1, 6, "", nil)
+	if proj.Assignments[0] != 4 || proj.Assignments[1] != 2 {
+		t.Errorf("unexpected block contents %v", proj.Assignments)
+	}
+}
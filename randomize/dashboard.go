@@ -3,6 +3,7 @@ package randomize
 import (
 	"log"
 	"net/http"
+	"strings"
 )
 
 // Dashboard displays a list of projects for the current user.
@@ -28,16 +29,29 @@ func Dashboard(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Got %d projects for %s", len(projlist), user)
 
+	invs, err := getInvitations(ctx, "Email", strings.ToLower(user))
+	if err != nil {
+		log.Printf("Dashboard: %v", err)
+	}
+	var invv []InvitationView
+	for _, inv := range invs {
+		invv = append(invv, formatInvitation(inv))
+	}
+
 	tvals := struct {
-		User        string
-		LoggedIn    bool
-		AnyProjects bool
-		Projects    []*ProjectView
+		User           string
+		LoggedIn       bool
+		AnyProjects    bool
+		Projects       []*ProjectView
+		AnyInvitations bool
+		Invitations    []InvitationView
 	}{
-		User:        user,
-		LoggedIn:    user != "",
-		AnyProjects: len(projlist) > 0,
-		Projects:    formatProjects(projlist),
+		User:           user,
+		LoggedIn:       user != "",
+		AnyProjects:    len(projlist) > 0,
+		Projects:       formatProjects(projlist),
+		AnyInvitations: len(invv) > 0,
+		Invitations:    invv,
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "dashboard.html", tvals); err != nil {
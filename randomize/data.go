@@ -1,6 +1,8 @@
 package randomize
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"html/template"
 	"io"
@@ -47,14 +49,6 @@ func userEmail(r *http.Request) string {
 	return e
 }
 
-// checkAccess returns true if and only if the currently
-// logged in user has access to the project with the given key.
-func checkAccess(key string, shared map[string]bool, r *http.Request) bool {
-	email := userEmail(r)
-	toks := splitKey(key)
-	return toks[0] == email || shared[email]
-}
-
 // DataRecord stores one record of raw data.
 type DataRecord struct {
 
@@ -70,6 +64,10 @@ type DataRecord struct {
 	// CurrentGroup
 	CurrentGroup string
 
+	// Sequence is the treatment given in each period, for crossover
+	// designs this is the sequence of the assigned group
+	Sequence []string
+
 	// Includes is true if the subject has not been removed from the study
 	Included bool
 
@@ -78,11 +76,47 @@ type DataRecord struct {
 
 	// Assigner is the id of the person who last assigned this person to a group
 	Assigner string
+
+	// Period is the index of the allocation period in which the
+	// subject was assigned
+	Period int
+
+	// Eligibility contains the answers to the eligibility checklist,
+	// keyed by criterion text
+	Eligibility map[string]string
+
+	// Status is the lifecycle state of the subject, see CurrentStatus
+	Status string
+
+	// History contains the lifecycle transitions of the subject,
+	// including those made while the subject was being screened
+	History []*StatusChange
+
+	// RemovalCategory and RemovalReason describe why the subject was
+	// removed from the study
+	RemovalCategory string
+	RemovalReason   string
+
+	// BalanceRetained is true if the subject was removed from the
+	// study but still counts toward the balance of new assignments
+	BalanceRetained bool
+
+	// OriginalData contains the values of the variables as entered at
+	// randomization, if any of them have since been corrected
+	OriginalData []string
+
+	// Corrections records the changes made to Data
+	Corrections []*Correction
 }
 
 // Project stores all information about one project.
 type Project struct {
 
+	// Key is the opaque database key of the project.  It is not
+	// stored in the project document, but is set when the project is
+	// loaded.
+	Key string `firestore:"-"`
+
 	// Owner is the Google id of the project owner
 	Owner string
 
@@ -92,9 +126,33 @@ type Project struct {
 	// Name contains the name of the project as selected by its creator
 	Name string
 
+	// ProtocolNumber is the sponsor's or institution's protocol number
+	ProtocolNumber string
+
+	// PrincipalInvestigator is the name of the principal investigator
+	PrincipalInvestigator string
+
+	// IRBNumber is the IRB approval number
+	IRBNumber string
+
+	// RegistrationID is the trial registration identifier, e.g. an NCT number
+	RegistrationID string
+
+	// Description is a free-text description of the project
+	Description string
+
 	// The names of the groups
 	GroupNames []string
 
+	// Design is the study design, blank for parallel group designs
+	// that randomize individuals
+	Design string
+
+	// Factors contains the factors of a factorial design, in which
+	// case each group is a combination of factor levels.  It is empty
+	// for other designs.
+	Factors []Factor
+
 	// Variables is a slice containing all variables being balanced
 	Variables []Variable
 
@@ -108,8 +166,9 @@ type Project struct {
 	// Bias controls the level of determinism in the group assignments
 	Bias int
 
-	// Comments is a list of comments for the subject.
-	Comments []*Comment
+	// Comments is a list of comments for the subject.  They are
+	// stored as separate documents, see storage.go.
+	Comments []*Comment `firestore:"-"`
 
 	// The date and time of the last assignment
 	Modified time.Time
@@ -117,8 +176,9 @@ type Project struct {
 	// If true, store the individual-level data, otherwise only store aggregates
 	StoreRawData bool
 
-	// The individual-level data, if stored
-	RawData []*DataRecord
+	// The individual-level data, if stored.  Each record is stored
+	// as a separate document, see storage.go.
+	RawData []*DataRecord `firestore:"-"`
 
 	// RemovedSubjects is a slice containing the ids of all subjects
 	// who have been removed from the study
@@ -130,6 +190,107 @@ type Project struct {
 	// SamplingRates contains the sampling rates for each treatment group.
 	// The default sampleing rates are 1 for each group.
 	SamplingRates []float64
+
+	// Amendments records changes to the variables, levels or
+	// treatment groups made after the project was created
+	Amendments []*Amendment
+
+	// Periods contains the allocation periods of the project.  It is
+	// empty until a treatment group is first opened or closed.
+	Periods []*AllocationPeriod
+
+	// ArmEvents records the opening and closing of treatment groups
+	ArmEvents []*ArmEvent
+
+	// BlockSize is the size of the permuted blocks for projects using
+	// block randomization, or zero for minimization
+	BlockSize int
+
+	// BlockRemaining contains the number of places remaining for each
+	// group in the current block
+	BlockRemaining []int
+
+	// Window restricts the times at which randomizations are accepted
+	Window EnrollmentWindow
+
+	// SubjectIDs restricts the subject ids that can be randomized
+	SubjectIDs SubjectIDRule
+
+	// TargetTotal is the target sample size, enrollment closes
+	// automatically when it is reached.  Zero means no target.
+	TargetTotal int
+
+	// GroupTargets contains the maximum number of subjects for each
+	// group, zero means no maximum
+	GroupTargets []int
+
+	// LevelTargets contains the maximum number of subjects with a
+	// given level of a variable, keyed by "variable=level"
+	LevelTargets map[string]int
+
+	// Members contains the individuals enrolled into clusters, for
+	// cluster randomized projects.  Each member is stored as a
+	// separate document, see storage.go.
+	Members []*ClusterMember `firestore:"-"`
+
+	// Criteria is the eligibility checklist that must be completed
+	// before a subject is randomized
+	Criteria []Criterion
+
+	// Screening is the screening log, containing the subjects who
+	// have been screened but not randomized
+	Screening []*ScreeningRecord
+
+	// RequireSignatures is true if critical actions must be
+	// electronically signed
+	RequireSignatures bool
+
+	// RequireApproval is true if assignment edits and subject
+	// removals must be approved by a second user
+	RequireApproval bool
+
+	// ChangeRequests contains the pending and decided requests for
+	// changes that need approval
+	ChangeRequests []*ChangeRequest
+
+	// Events is the ordered log of changes to the subjects, from
+	// which the aggregate counts can be rebuilt.  It is only kept
+	// for projects that store the subject-level data.
+	Events []*Event `firestore:"-"`
+
+	// SchemaVersion is the number of migrations that have been
+	// applied to the stored project, see schema.go
+	SchemaVersion int
+
+	// Revision is incremented each time the project is stored, so
+	// that changes made at the same time by different requests are
+	// detected, see saveProject
+	Revision int
+
+	// Corrected is true if the variables of any randomized subject
+	// have been corrected
+	Corrected bool
+
+	// stored records the child documents as they were read
+	stored *childState
+
+	// eventSeq is the sequence number of the last stored event, for
+	// projects whose events were not read
+	eventSeq int
+
+	// pendingAudit holds the audit log entries for the changes made
+	// since the project was read, they are written with the project
+	pendingAudit []*AuditEntry
+
+	// subjectIndex maps subject ids to their position in RawData,
+	// for the first indexed records of RawData
+	subjectIndex map[string]int
+	indexed      int
+
+	// memberIndex maps the ids of cluster members to their position
+	// in Members, for the first membersIndexed members
+	memberIndex    map[string]int
+	membersIndexed int
 }
 
 // NumAssignments returns the total number of current treatment group assignments.
@@ -293,12 +454,7 @@ func getProjectFromKey(pkey string) (*Project, error) {
 		return nil, err
 	}
 
-	var proj Project
-	if err := ds.DataTo(&proj); err != nil {
-		return nil, err
-	}
-
-	return &proj, nil
+	return loadProject(ctx, client, ds, true)
 }
 
 // storeProject
@@ -311,17 +467,75 @@ func storeProject(ctx context.Context, proj *Project, pkey string) error {
 	}
 	defer client.Close()
 
-	_, err = client.Doc("Project/"+pkey).Set(ctx, proj)
+	return saveProject(ctx, client, pkey, proj, false, nil)
+}
 
-	return err
+// newProjectKey returns a new random key for a project.  Keys do not
+// depend on the project owner or name, so both can be changed.
+func newProjectKey() string {
+
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
 }
 
-func makeKey(owner, name string) string {
-	return owner + "::" + name
+// storeNewProject stores a new project under a new key, and creates
+// its sharing record containing only the owner.  The key is returned.
+func storeNewProject(ctx context.Context, client *firestore.Client, proj *Project) (string, error) {
+
+	pkey := newProjectKey()
+	shares := map[string]Share{strings.ToLower(proj.Owner): {Role: RoleOwner}}
+
+	err := saveProject(ctx, client, pkey, proj, true, func(tx *firestore.Transaction) error {
+		return tx.Set(client.Doc("SharingByProject/"+pkey), encodeSharing(shares))
+	})
+	if err != nil {
+		return "", err
+	}
+	proj.Key = pkey
+
+	return pkey, nil
 }
 
-func splitKey(key string) []string {
-	return strings.Split(key, "::")
+// projectNameExists returns true if the given user already owns a
+// project with the given name.
+func projectNameExists(ctx context.Context, client *firestore.Client, owner, name string) (bool, error) {
+
+	docs, err := client.Collection("Project").Where("Owner", "==", owner).Where("Name", "==", name).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return false, err
+	}
+
+	return len(docs) > 0, nil
+}
+
+// setSharingByUser adds (if shared is true) or removes (if shared is
+// false) the project with the given key from the list of projects that
+// are shared with the given user.
+func setSharingByUser(ctx context.Context, client *firestore.Client, user, pkey string, shared bool) error {
+
+	sbu := make(map[string]bool)
+	na := "SharingByUser/" + strings.ToLower(user)
+	doc, err := client.Doc(na).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		// OK
+	} else if err != nil {
+		return err
+	} else if err := doc.DataTo(&sbu); err != nil {
+		return err
+	}
+
+	if shared {
+		sbu[pkey] = true
+	} else {
+		delete(sbu, pkey)
+	}
+
+	_, err = client.Doc(na).Set(ctx, &sbu)
+	return err
 }
 
 // formatProject returns a ProjectView object corresponding to the
@@ -343,7 +557,7 @@ func formatProject(proj *Project) *ProjectView {
 		Variables:       make([]VariableView, len(proj.Variables)),
 		RemovedSubjects: proj.RemovedSubjects,
 		Open:            proj.Open,
-		Key:             makeKey(proj.Owner, proj.Name),
+		Key:             proj.Key,
 		Project:         proj,
 	}
 
@@ -401,8 +615,21 @@ func formatVariable(va Variable) VariableView {
 }
 
 // getSharedUsers returns the user id's for for users who are
-// shared for the given project.
-func getSharedUsers(ctx context.Context, projectName string) (map[string]bool, error) {
+// shared for the given project, along with the role of each user.
+// Users whose access has expired are not included.
+func getSharedUsers(ctx context.Context, projectName string) (map[string]Role, error) {
+
+	shares, err := getShares(ctx, projectName)
+	if err != nil {
+		return nil, err
+	}
+
+	return activeRoles(shares, time.Now()), nil
+}
+
+// getShares returns the sharing information for the given project,
+// including shares that have expired.
+func getShares(ctx context.Context, projectName string) (map[string]Share, error) {
 
 	client, err := firestore.NewClient(ctx, projectID)
 	if err != nil {
@@ -415,19 +642,12 @@ func getSharedUsers(ctx context.Context, projectName string) (map[string]bool, e
 		return nil, err
 	}
 
-	sbp := make(map[string]bool)
-	if doc.Exists() {
-		if err := doc.DataTo(&sbp); err != nil {
-			return nil, err
-		}
-	}
-
-	return sbp, nil
+	return decodeSharing(doc.Data()), nil
 }
 
-// addSharing adds all the given users to be shared for the given
-// project.
-func addSharing(projectName string, userNames []string) error {
+// addSharing shares the given project with the given users.  If a user
+// already has access, their role and expiry date are replaced.
+func addSharing(projectName string, shares map[string]Share) error {
 
 	ctx := context.Background()
 	client, err := firestore.NewClient(ctx, projectID)
@@ -437,11 +657,11 @@ func addSharing(projectName string, userNames []string) error {
 	}
 	defer client.Close()
 
-	if len(userNames) == 0 {
+	if len(shares) == 0 {
 		return nil
 	}
 
-	sbp := make(map[string]bool)
+	shared := make(map[string]Share)
 	doc, err := client.Doc("SharingByProject/" + projectName).Get(ctx)
 	if status.Code(err) == codes.NotFound {
 		// OK
@@ -449,24 +669,21 @@ func addSharing(projectName string, userNames []string) error {
 		log.Printf("addSharing [2]: %v", err)
 		return err
 	} else {
-		if err := doc.DataTo(&sbp); err != nil {
-			log.Printf("addSharing [3]: %v", err)
-			return err
-		}
+		shared = decodeSharing(doc.Data())
 	}
 
-	for _, u := range userNames {
-		sbp[u] = true
+	for u, sh := range shares {
+		shared[u] = sh
 	}
 
 	// Store the update sharing by project information
-	if _, err = client.Doc("SharingByProject/"+projectName).Set(ctx, &sbp); err != nil {
+	if _, err = client.Doc("SharingByProject/"+projectName).Set(ctx, encodeSharing(shared)); err != nil {
 		log.Printf("addSharing [4]: %v", err)
 		return err
 	}
 
 	// Update SharingByUser
-	for _, uname := range userNames {
+	for uname := range shares {
 
 		sbu := make(map[string]bool)
 		na := "SharingByUser/" + strings.ToLower(uname)
@@ -506,7 +723,7 @@ func removeSharing(projectName string, userNames []string) error {
 	defer client.Close()
 
 	// Update SharingByProject.
-	sbp := make(map[string]bool)
+	shared := make(map[string]Share)
 	doc, err := client.Doc("SharingByProject/" + projectName).Get(ctx)
 	if status.Code(err) == codes.NotFound {
 		// OK
@@ -514,16 +731,13 @@ func removeSharing(projectName string, userNames []string) error {
 		log.Printf("removeSharing [2]: %v", err)
 		return err
 	} else {
-		if err := doc.DataTo(&sbp); err != nil {
-			log.Printf("removeSharing [3]: %v", err)
-			return err
-		}
+		shared = decodeSharing(doc.Data())
 		for _, u := range userNames {
-			delete(sbp, u)
+			delete(shared, u)
 		}
 	}
 
-	if _, err = client.Doc("SharingByProject/"+projectName).Set(ctx, sbp); err != nil {
+	if _, err = client.Doc("SharingByProject/"+projectName).Set(ctx, encodeSharing(shared)); err != nil {
 		log.Printf("removeSharing [4]: %v", err)
 		return err
 	}
@@ -582,12 +796,21 @@ func getProjects(ctx context.Context, user string, includeShared bool) ([]*Proje
 	log.Printf("Got %d owned projects for %s", len(adocs), user)
 
 	for _, doc := range adocs {
-		var proj Project
-		if err := doc.DataTo(&proj); err != nil {
+		proj, err := loadProject(ctx, client, doc, false)
+		if err != nil {
 			log.Printf("GetProjects[3]: %v", err)
 			return nil, err
 		}
-		projlist = append(projlist, &proj)
+
+		// Projects created before opaque keys were introduced are
+		// moved to a new key the first time they are listed.
+		if isLegacyKey(proj.Key) {
+			if err := migrateLegacyProject(ctx, client, proj); err != nil {
+				log.Printf("GetProjects[10]: %v", err)
+			}
+		}
+
+		projlist = append(projlist, proj)
 	}
 
 	if !includeShared {
@@ -611,8 +834,33 @@ func getProjects(ctx context.Context, user string, includeShared bool) ([]*Proje
 	}
 
 	// Get the shared projects
+	now := time.Now()
 	for spv := range sbu {
 
+		if isLegacyKey(spv) {
+			newkey, err := resolveLegacyKey(ctx, client, spv)
+			if status.Code(err) == codes.NotFound {
+				continue
+			} else if err != nil {
+				log.Printf("getProjects[10]: %v", err)
+				return nil, err
+			}
+			spv = newkey
+		}
+
+		// Skip projects where the user's access has expired
+		sdoc, err := client.Doc("SharingByProject/" + spv).Get(ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			log.Printf("getProjects[9]: %v", err)
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		if sh, ok := decodeSharing(sdoc.Data())[user]; !ok || sh.Expired(now) {
+			continue
+		}
+
 		doc, err := client.Doc("Project/" + spv).Get(ctx)
 		if status.Code(err) == codes.NotFound {
 			log.Printf("getProjects[6]: %v", err)
@@ -622,13 +870,13 @@ func getProjects(ctx context.Context, user string, includeShared bool) ([]*Proje
 			return nil, err
 		}
 
-		var proj Project
-		if err := doc.DataTo(&proj); err != nil {
+		proj, err := loadProject(ctx, client, doc, false)
+		if err != nil {
 			log.Printf("getProjects[8]: %v\n%v", spv, err)
 			return nil, err
 		}
 
-		projlist = append(projlist, &proj)
+		projlist = append(projlist, proj)
 	}
 	log.Printf("Got %d shared projects for user %s", len(sbu), user)
 
@@ -696,6 +944,7 @@ func removeFromAggregate(rec *DataRecord, proj *Project) {
 
 	// Update the overall assignment totals
 	proj.Assignments[grpIx]--
+	proj.updatePeriodCount(rec.Period, rec.Data, grpIx, -1)
 
 	// Update the within-variable assignment totals
 	for j, va := range proj.Variables {
@@ -718,6 +967,7 @@ func addToAggregate(rec *DataRecord,
 
 	// Update the overall assignment totals
 	proj.Assignments[grpIx]++
+	proj.updatePeriodCount(rec.Period, rec.Data, grpIx, 1)
 
 	// Update the within-variable assignment totals
 	for j, va := range proj.Variables {
@@ -74,16 +74,18 @@ func DeleteProjectStep2(w http.ResponseWriter, r *http.Request) {
 
 	pkey := r.FormValue("project_list")
 	log.Printf("Selected project '%s' for deletion", pkey)
-	svec := splitKey(pkey)
 
 	if pkey == "" {
 		msg := "You did not select a project to delete."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
 	}
 
-	if len(svec) != 2 {
-		msg := "Malformed project key"
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("deleteProjectStep2: %v", err)
+		msg := "Unable to retrieve the selected project."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
@@ -98,7 +100,7 @@ func DeleteProjectStep2(w http.ResponseWriter, r *http.Request) {
 	}{
 		User:        user,
 		LoggedIn:    user != "",
-		ProjectName: svec[1],
+		ProjectName: proj.Name,
 		Pkey:        pkey,
 		Nokey:       len(pkey) == 0,
 	}
@@ -109,7 +111,7 @@ func DeleteProjectStep2(w http.ResponseWriter, r *http.Request) {
 }
 
 // Delete the project from each user's SharingByUser record.
-func cleanSharing(sbp map[string]bool, pkey string) {
+func cleanSharing(sbp map[string]Share, pkey string) {
 
 	ctx := context.Background()
 	client, err := firestore.NewClient(ctx, projectID)
@@ -163,8 +165,8 @@ func DeleteProjectStep3(w http.ResponseWriter, r *http.Request) {
 	}
 	defer client.Close()
 
-	if !checkAccess(pkey, susers, r) {
-		msg := "You do not have access to this project."
+	if !checkPermission(susers, ActionDelete, r) {
+		msg := "Only the project owner can delete a project."
 		rmsg := "Return"
 		messagePage(w, r, msg, rmsg, "/")
 		return
@@ -176,8 +178,14 @@ func DeleteProjectStep3(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete the project
-	if _, err := client.Doc("Project/" + pkey).Delete(ctx); err != nil {
+	// Delete the project.  The audit log is kept after the project
+	// is deleted, the deletion is recorded in it together with the
+	// deletion itself.
+	e := newAuditEntry(user, AuditDelete, "", nil, nil, nil)
+	err = appendAudit(ctx, client, pkey, e, func(tx *firestore.Transaction) error {
+		return tx.Delete(client.Doc("Project/" + pkey))
+	})
+	if err != nil {
 		msg := "A database error occurred, the project may not have been deleted."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
@@ -185,10 +193,15 @@ func DeleteProjectStep3(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Subcollections are not deleted with their parent document
+	if err := deleteChildren(ctx, client, pkey); err != nil {
+		log.Printf("deleteProjectStep3 [12] %v", err)
+	}
+
 	// Delete the SharingByProject object, but first read the
 	// users list from it so we can delete the project from their
 	// SharingByUsers records.
-	sbp := make(map[string]bool)
+	sbp := make(map[string]Share)
 	doc, err := client.Doc("SharingByProject/" + pkey).Get(ctx)
 	if status.Code(err) == codes.NotFound {
 		// OK
@@ -199,10 +212,7 @@ func DeleteProjectStep3(w http.ResponseWriter, r *http.Request) {
 		log.Printf("deleteProjectStep3 [3] %v", err)
 		return
 	} else {
-		if err := doc.DataTo(&sbp); err != nil {
-			log.Printf("deleteProjectStep3 [4] %v", err)
-			return
-		}
+		sbp = decodeSharing(doc.Data())
 
 		// Delete the sharing information
 		if _, err := client.Doc("SharingByProject/" + pkey).Delete(ctx); err != nil {
@@ -213,6 +223,19 @@ func DeleteProjectStep3(w http.ResponseWriter, r *http.Request) {
 
 	cleanSharing(sbp, pkey)
 
+	// Withdraw any invitations that have not been answered
+	invs, err := getInvitations(ctx, "Pkey", pkey)
+	if err != nil {
+		log.Printf("deleteProjectStep3 [10] %v", err)
+	}
+	var ids []string
+	for _, inv := range invs {
+		ids = append(ids, inv.ID)
+	}
+	if err := deleteInvitations(ctx, ids); err != nil {
+		log.Printf("deleteProjectStep3 [11] %v", err)
+	}
+
 	tvals := struct {
 		User     string
 		LoggedIn bool
@@ -41,61 +41,47 @@ func genPocockSimon(n, bias int) []float64 {
 	return prob
 }
 
+// newRandom returns the random number generator used to choose the
+// group of a subject.  The seed is set to a random time.  Not sure if
+// this is needed, but since each assignment runs as a new instance we
+// might be getting the same "random numbers" every time if we don't
+// do this.  Tests replace it with a seeded generator so that the
+// assignments are reproducible.
+var newRandom = func() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
 // doAssignment
 func (proj *Project) doAssignment(mpv map[string]string, subjectId string, userId string) (string, error) {
 
-	// Set the seed to a random time.  Not sure if this is needed,
-	// but since each assignment runs as a new instance we might
-	// be getting the same "random numbers" every time if we don't
-	// do this.
-	source := rand.NewSource(time.Now().UnixNano())
-	rgen := rand.New(source)
+	rgen := newRandom()
 
-	numgroups := len(proj.GroupNames)
 	numvar := len(proj.Variables)
 
-	// Calculate the scores if assigning the new subject
-	// to each possible group.
-	potentialScores := make([]float64, numgroups)
-	for i := 0; i < numgroups; i++ {
-
-		// The score is a weighted linear combination over the
-		// variables.
-		for j, va := range proj.Variables {
-			x := mpv[va.Name]
-			score := proj.Score(x, i, j)
-			potentialScores[i] += va.Weight * score
-		}
+	// Only groups that are currently open and have not reached
+	// their targets can receive subjects.
+	if len(proj.openGroups()) == 0 {
+		return "", fmt.Errorf("no treatment groups are open for assignment")
 	}
-
-	// Get a sorted copy of the scores.
-	sortedScores := make([]float64, len(potentialScores))
-	copy(sortedScores, potentialScores)
-	sort.Float64s(sortedScores)
-
-	// Construct the Pocock/Simon probabilities.
-	prob := genPocockSimon(len(proj.GroupNames), proj.Bias)
-
-	// The cumulative Pocock Simon probabilities.
-	cumprob := cumsum(prob)
-
-	// A random value distributed according to the Pocock Simon
-	// probabilities.
-	jr := sample(rgen, cumprob)
-
-	// Get all groups whose score is tied with the score of the selected value.
-	var ties []int
-	for i, x := range potentialScores {
-		if x == sortedScores[jr] {
-			ties = append(ties, i)
-		}
+	if err := proj.capError(mpv); err != nil {
+		return "", err
+	}
+	open := proj.eligibleGroups()
+
+	// Choose the group.
+	var ii int
+	switch {
+	case proj.BlockSize > 0:
+		ii = proj.blockAssignment(rgen, open)
+	case len(proj.Factors) > 0:
+		ii = proj.factorialAssignment(rgen, mpv, open)
+	default:
+		ii = proj.minimizationAssignment(rgen, mpv, open)
 	}
-
-	// Assign to this group.
-	ii := ties[rgen.Intn(len(ties))]
 
 	// Update the cell totals.
 	proj.Assignments[ii]++
+	data := make([]string, numvar)
 	for j := 0; j < numvar; j++ {
 
 		va := proj.Variables[j]
@@ -118,34 +104,114 @@ func (proj *Project) doAssignment(mpv map[string]string, subjectId string, userI
 
 		z := proj.GetData(j, kk, ii)
 		proj.SetData(j, kk, ii, z+1)
+		data[j] = x
+	}
+
+	// Update the counts for the current allocation period.
+	period := len(proj.Periods) - 1
+	proj.updatePeriodCount(period, data, ii, 1)
+
+	// Subjects assigned before the first allocation period is
+	// created become part of it.
+	if period < 0 {
+		period = 0
 	}
 
 	// Update the stored data
 	if proj.StoreRawData {
 
-		data := make([]string, len(proj.Variables))
-		for j, v := range proj.Variables {
-			data[j] = mpv[v.Name]
-		}
-
 		rec := DataRecord{
 			SubjectId:     subjectId,
+			Sequence:      proj.sequence(proj.GroupNames[ii]),
 			AssignedTime:  time.Now(),
 			AssignedGroup: proj.GroupNames[ii],
 			CurrentGroup:  proj.GroupNames[ii],
 			Included:      true,
 			Data:          data,
 			Assigner:      userId,
+			Period:        period,
 		}
-
+		proj.markRandomized(&rec, userId, rec.AssignedTime)
+
+		proj.logEvent(&Event{
+			Time:      rec.AssignedTime,
+			Kind:      EventAssign,
+			SubjectId: subjectId,
+			Group:     rec.AssignedGroup,
+			Data:      append([]string(nil), data...),
+			Period:    period,
+			User:      userId,
+		})
 		proj.RawData = append(proj.RawData, &rec)
 	}
 
+	proj.autoClose(userId, time.Now())
+
 	return proj.GroupNames[ii], nil
 }
 
+// minimizationAssignment chooses a group among the open groups using
+// the Pocock/Simon minimization method.
+func (proj *Project) minimizationAssignment(rgen *rand.Rand, mpv map[string]string, open []int) int {
+
+	// Calculate the scores if assigning the new subject
+	// to each possible group.
+	potentialScores := make([]float64, len(open))
+	for i, grp := range open {
+
+		// The score is a weighted linear combination over the
+		// variables.
+		for j, va := range proj.Variables {
+			x := mpv[va.Name]
+			score := proj.Score(x, grp, j)
+			potentialScores[i] += va.Weight * score
+		}
+	}
+
+	return open[proj.pocockSimon(rgen, potentialScores)]
+}
+
+// pocockSimon chooses one of several options with the given scores,
+// using the Pocock/Simon probabilities so that options with lower
+// scores are more likely to be chosen.  Options with tied scores are
+// equally likely to be chosen.
+func (proj *Project) pocockSimon(rgen *rand.Rand, potentialScores []float64) int {
+
+	// Get a sorted copy of the scores.
+	sortedScores := make([]float64, len(potentialScores))
+	copy(sortedScores, potentialScores)
+	sort.Float64s(sortedScores)
+
+	// Construct the Pocock/Simon probabilities.  With a single option
+	// there is nothing to choose.
+	jr := 0
+	if len(potentialScores) > 1 {
+		prob := genPocockSimon(len(potentialScores), proj.Bias)
+
+		// The cumulative Pocock Simon probabilities.
+		cumprob := cumsum(prob)
+
+		// A random value distributed according to the Pocock Simon
+		// probabilities.
+		jr = sample(rgen, cumprob)
+	}
+
+	// Get all options whose score is tied with the score of the
+	// selected value.
+	var ties []int
+	for i, x := range potentialScores {
+		if x == sortedScores[jr] {
+			ties = append(ties, i)
+		}
+	}
+
+	return ties[rgen.Intn(len(ties))]
+}
+
 // Score calculates the contribution to the overall score if we assign
 // a subject with level `x` for the kth variable into group `grp`.
+// Only groups that are currently open are compared, using the counts
+// from the current allocation period.
 func (proj *Project) Score(x string, grp, k int) float64 {
 
 	numGroups := len(proj.GroupNames)
@@ -161,10 +227,15 @@ func (proj *Project) Score(x string, grp, k int) float64 {
 		// Get the count for each group if we were to assign
 		// this unit to group `grp`.
 		var mn, mx float64
+		first := true
 		for i := 0; i < numGroups; i++ {
 
+			if !proj.GroupOpen(i) {
+				continue
+			}
+
 			// The current count for variable k, level j, group i.
-			nc := proj.GetData(k, j, i)
+			nc := proj.balanceCount(k, j, i)
 
 			// Add 1 if we are assigning the current subject to this
 			// group.
@@ -173,12 +244,13 @@ func (proj *Project) Score(x string, grp, k int) float64 {
 			}
 
 			nc /= proj.SamplingRates[i]
-			if i == 0 || nc < mn {
+			if first || nc < mn {
 				mn = nc
 			}
-			if i == 0 || nc > mx {
+			if first || nc > mx {
 				mx = nc
 			}
+			first = false
 		}
 
 		scoreChange += mx - mn
@@ -22,8 +22,8 @@ func EditAssignment(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
-		msg := "Only the project owner can edit treatment group assignments that have already been made."
+	if !checkPermission(susers, ActionEditAssignment, r) {
+		msg := "You don't have permission to edit treatment group assignments that have already been made."
 		rmsg := "Return to project dashboard"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 		return
@@ -38,13 +38,6 @@ func EditAssignment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if proj.Owner != useremail {
-		msg := "Only the project owner can edit treatment group assignments that have already been made."
-		rmsg := "Return to project dashboard"
-		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
-		return
-	}
-
 	if proj.NumAssignments() == 0 {
 		msg := "There are no assignments to edit."
 		rmsg := "Return to project dashboard"
@@ -91,7 +84,7 @@ func EditAssignmentConfirm(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionEditAssignment, r) {
 		msg := "You do not have access to this page."
 		rmsg := "Return"
 		messagePage(w, r, msg, rmsg, "/")
@@ -107,13 +100,6 @@ func EditAssignmentConfirm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if proj.Owner != useremail {
-		msg := "Only the project owner can edit treatment group assignments that have already been made."
-		rmsg := "Return to project dashboard"
-		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
-		return
-	}
-
 	if !proj.StoreRawData {
 		msg := "Assignments cannot be edited in a project in which the subject level data is not stored"
 		rmsg := "Return to project dashboard"
@@ -131,6 +117,8 @@ func EditAssignmentConfirm(w http.ResponseWriter, r *http.Request) {
 		CurrentGroupName string
 		NewGroupName     string
 		SubjectId        string
+		Signature        *SignatureForm
+		Approval         bool
 	}{
 		User:         useremail,
 		LoggedIn:     useremail != "",
@@ -138,15 +126,15 @@ func EditAssignmentConfirm(w http.ResponseWriter, r *http.Request) {
 		ProjectName:  proj.Name,
 		NewGroupName: r.FormValue("NewGroupName"),
 		SubjectId:    subjectId,
+		Signature:    proj.signatureForm(MeaningApproved),
+		Approval:     proj.RequireApproval,
 	}
 
 	found, included := false, false
-	for _, rec := range proj.RawData {
-		if rec.SubjectId == subjectId {
-			tvals.CurrentGroupName = rec.CurrentGroup
-			found = true
-			included = rec.Included
-		}
+	if rec := proj.findSubject(subjectId); rec != nil {
+		tvals.CurrentGroupName = rec.CurrentGroup
+		found = true
+		included = rec.Included
 	}
 
 	if !found {
@@ -188,7 +176,7 @@ func EditAssignmentCompleted(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionEditAssignment, r) {
 		msg := "You do not have access to this page."
 		rmsg := "Return"
 		messagePage(w, r, msg, rmsg, "/")
@@ -204,13 +192,6 @@ func EditAssignmentCompleted(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if proj.Owner != useremail {
-		msg := "Only the project owner can edit treatment group assignments that have already been made."
-		rmsg := "Return to project dashboard"
-		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
-		return
-	}
-
 	if !proj.StoreRawData {
 		msg := "Group assignments cannot be edited in a project in which the subject level data is not stored."
 		rmsg := "Return to project"
@@ -218,36 +199,46 @@ func EditAssignmentCompleted(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sig, ok := requireSignature(ctx, proj, w, r, "/edit_assignment?pkey="+pkey)
+	if !ok {
+		return
+	}
+
 	newGroupName := r.FormValue("new_group_name")
 	subjectId := r.FormValue("subject_id")
 
-	found := false
-	for _, rec := range proj.RawData {
-		if rec.SubjectId == subjectId {
-			removeFromAggregate(rec, proj)
-			oldGroupName := rec.CurrentGroup
-			rec.CurrentGroup = newGroupName
-			addToAggregate(rec, proj)
-
-			comment := &Comment{
-				Commenter: useremail,
-				DateTime:  time.Now(),
-				Comment: []string{
-					fmt.Sprintf("Group assignment for subject '%s' changed from '%s' to '%s'",
-						subjectId, oldGroupName, newGroupName)},
-			}
-			proj.Comments = append(proj.Comments, comment)
-
-			found = true
+	if proj.RequireApproval {
+		req := &ChangeRequest{
+			Kind:      RequestEdit,
+			SubjectId: subjectId,
+			NewGroup:  newGroupName,
 		}
+		submitChangeRequest(ctx, proj, pkey, req, sig, w, r)
+		return
 	}
-	if !found {
+
+	rec := proj.findSubject(subjectId)
+	if rec == nil {
 		msg := fmt.Sprintf("There is no subject with id '%s' in this project, the assignment was not changed.", subjectId)
 		rmsg := "Return to project"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 		return
 	}
 
+	oldGroupName := rec.CurrentGroup
+	proj.changeGroup(rec, newGroupName, useremail, time.Now())
+
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  time.Now(),
+		Comment: signedComment([]string{
+			fmt.Sprintf("Group assignment for subject '%s' changed from '%s' to '%s'",
+				subjectId, oldGroupName, newGroupName)}, sig),
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logSignedAudit(useremail, AuditEdit, subjectId, oldGroupName, newGroupName, sig)
+
 	err = storeProject(ctx, proj, pkey)
 	if err != nil {
 		msg := "Database error, your project was not saved."
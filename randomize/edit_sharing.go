@@ -1,13 +1,55 @@
 package randomize
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 )
 
+// SharedUser describes one user that a project is shared with.
+type SharedUser struct {
+
+	// Email identifies the user
+	Email string
+
+	// Role is the role that the user has in the project
+	Role Role
+
+	// Expires is the date (YYYY-MM-DD) on which access ends, or blank
+	Expires string
+
+	// Expired is true if the user's access has already ended
+	Expired bool
+}
+
+// sortedSharedUsers returns the shared users (other than the owner)
+// ordered by email address.
+func sortedSharedUsers(shared map[string]Share) []SharedUser {
+
+	now := time.Now()
+	loc, _ := time.LoadLocation("America/New_York")
+
+	var sul []SharedUser
+	for k, v := range shared {
+		if v.Role == RoleOwner {
+			continue
+		}
+		su := SharedUser{Email: k, Role: v.Role, Expired: v.Expired(now)}
+		if !v.Expires.IsZero() {
+			su.Expires = v.Expires.In(loc).Format("2006-01-02")
+		}
+		sul = append(sul, su)
+	}
+	sort.Slice(sul, func(i, j int) bool { return sul[i].Email < sul[j].Email })
+
+	return sul
+}
+
 // EditSharing is page 1 for changing the sharing settings
 func EditSharing(w http.ResponseWriter, r *http.Request) {
 
@@ -19,32 +61,48 @@ func EditSharing(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	user := userEmail(r)
 	pkey := r.FormValue("pkey")
-	shr := splitKey(pkey)
-	owner := shr[0]
-	projectName := shr[1]
 
-	if strings.ToLower(owner) != strings.ToLower(user) {
+	shares, err := getShares(ctx, pkey)
+	if err != nil {
+		log.Printf("editSharing failed to retrieve sharing: %v %v", pkey, err)
+	}
+
+	if !checkPermission(activeRoles(shares, time.Now()), ActionManageSharing, r) {
 		msg := "Only the owner of a project can manage sharing."
 		rmsg := "Return to dashboard"
 		messagePage(w, r, msg, rmsg, "/dashboard")
 		return
 	}
 
-	sharedUsers, err := getSharedUsers(ctx, pkey)
+	proj, err := getProjectFromKey(pkey)
 	if err != nil {
-		log.Printf("editSharing failed to retrieve sharing: %v %v", projectName, owner)
+		log.Printf("editSharing failed to retrieve project: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
 	}
+	projectName := proj.Name
+
+	sul := sortedSharedUsers(shares)
 
-	var sul []string
-	for k := range sharedUsers {
-		sul = append(sul, k)
+	invs, err := getInvitations(ctx, "Pkey", pkey)
+	if err != nil {
+		log.Printf("editSharing failed to retrieve invitations: %v", err)
+	}
+	var invv []InvitationView
+	for _, inv := range invs {
+		invv = append(invv, formatInvitation(inv))
 	}
 
 	tvals := struct {
 		User           string
 		LoggedIn       bool
-		SharedUsers    []string
+		SharedUsers    []SharedUser
 		AnySharedUsers bool
+		Invitations    []InvitationView
+		AnyInvitations bool
+		Roles          []Role
 		ProjectName    string
 		Pkey           string
 	}{
@@ -52,6 +110,9 @@ func EditSharing(w http.ResponseWriter, r *http.Request) {
 		LoggedIn:       user != "",
 		SharedUsers:    sul,
 		AnySharedUsers: len(sul) > 0,
+		Invitations:    invv,
+		AnyInvitations: len(invv) > 0,
+		Roles:          assignableRoles,
 		ProjectName:    projectName,
 		Pkey:           pkey,
 	}
@@ -69,19 +130,69 @@ func EditSharingConfirm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx := r.Context()
 	user := userEmail(r)
 	pkey := r.FormValue("pkey")
 
-	spkey := splitKey(pkey)
-	projectName := spkey[1]
+	shares, _ := getShares(ctx, pkey)
+	if !checkPermission(activeRoles(shares, time.Now()), ActionManageSharing, r) {
+		msg := "Only the owner of a project can manage sharing."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	}
 
-	ap := r.FormValue("additional_people")
-	addUsers := cleanSplit(ap, ",")
-	for k, x := range addUsers {
-		addUsers[k] = strings.ToLower(x)
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("editSharingConfirm [0]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	}
+	projectName := proj.Name
+
+	// Check the new addresses before changing anything
+	newUsers, invalid := parseEmails(r.FormValue("additional_people"))
+	if len(invalid) > 0 {
+		msg := fmt.Sprintf("The following are not valid email addresses, sharing was not changed: %s",
+			strings.Join(invalid, ", "))
+		rmsg := "Return to sharing settings"
+		messagePage(w, r, msg, rmsg, "/edit_sharing?pkey="+pkey)
+		return
+	}
+
+	accessExpires, err := parseExpiry(r.FormValue("access_expires"))
+	if err != nil || (!accessExpires.IsZero() && accessExpires.Before(time.Now())) {
+		msg := "The access expiry date must be a future date in the form YYYY-MM-DD, sharing was not changed."
+		rmsg := "Return to sharing settings"
+		messagePage(w, r, msg, rmsg, "/edit_sharing?pkey="+pkey)
+		return
 	}
 
-	err := addSharing(pkey, addUsers)
+	// Changes to the roles and expiry dates of people who already have access
+	updates := make(map[string]Share)
+	for u, sh := range shares {
+		if sh.Role == RoleOwner {
+			continue
+		}
+		newRole := Role(r.FormValue("role_" + u))
+		if !validRole(newRole) {
+			newRole = sh.Role
+		}
+		expires, err := parseExpiry(r.FormValue("expires_" + u))
+		if err != nil {
+			msg := fmt.Sprintf("The expiry date for %s must be in the form YYYY-MM-DD, sharing was not changed.", u)
+			rmsg := "Return to sharing settings"
+			messagePage(w, r, msg, rmsg, "/edit_sharing?pkey="+pkey)
+			return
+		}
+		if newRole != sh.Role || !expires.Equal(sh.Expires) {
+			updates[u] = Share{Role: newRole, Expires: expires}
+		}
+	}
+
+	err = addSharing(pkey, updates)
 	if err != nil {
 		msg := "Database error: unable to update sharing information."
 		rmsg := "Return to dashboard"
@@ -90,7 +201,56 @@ func EditSharingConfirm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	removeUsers := r.Form["remove_users"]
+	// People who are being given access for the first time must
+	// accept an invitation.
+	newRole := Role(r.FormValue("new_role"))
+	if !validRole(newRole) {
+		newRole = RoleEnroller
+	}
+	var invs []*Invitation
+	for _, u := range newUsers {
+		if _, ok := shares[u]; ok || u == strings.ToLower(user) {
+			continue
+		}
+		invs = append(invs, &Invitation{
+			Pkey:          pkey,
+			ProjectName:   projectName,
+			Email:         u,
+			Role:          newRole,
+			Inviter:       user,
+			Created:       time.Now(),
+			Expires:       time.Now().Add(invitationLifetime),
+			AccessExpires: accessExpires,
+		})
+	}
+	if err := createInvitations(ctx, invs); err != nil {
+		msg := "Database error: unable to send invitations."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		log.Printf("editSharingConfirm [3]: %v", err)
+		return
+	}
+
+	// Only invitations to this project can be withdrawn
+	pending, err := getInvitations(ctx, "Pkey", pkey)
+	if err == nil {
+		err = deleteInvitations(ctx, selectInvitations(pending, r.Form["cancel_invitations"]))
+	}
+	if err != nil {
+		msg := "Database error: unable to withdraw invitations."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		log.Printf("editSharingConfirm [4]: %v", err)
+		return
+	}
+
+	// The owner cannot be removed
+	var removeUsers []string
+	for _, u := range r.Form["remove_users"] {
+		if shares[u].Role != RoleOwner {
+			removeUsers = append(removeUsers, u)
+		}
+	}
 	err = removeSharing(pkey, removeUsers)
 	if err != nil {
 		msg := "Database error: unable to update sharing information."
@@ -100,16 +260,37 @@ func EditSharingConfirm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var invited []string
+	for _, inv := range invs {
+		invited = append(invited, inv.Email)
+	}
+
+	if len(updates) > 0 || len(removeUsers) > 0 || len(invited) > 0 {
+		err := recordAudit(ctx, pkey, user, AuditShare, "", shares, map[string]interface{}{
+			"Changed": updates, "Removed": removeUsers, "Invited": invited,
+		})
+		if err != nil {
+			msg := "The sharing was changed, but the change could not be recorded in the audit log."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+	}
+
 	tvals := struct {
 		User        string
 		LoggedIn    bool
 		ProjectName string
 		Pkey        string
+		Invited     string
+		AnyInvited  bool
 	}{
 		User:        user,
 		LoggedIn:    user != "",
 		ProjectName: projectName,
 		Pkey:        pkey,
+		Invited:     strings.Join(invited, ", "),
+		AnyInvited:  len(invited) > 0,
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "edit_sharing_confirm.html", tvals); err != nil {
@@ -0,0 +1,389 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// CriterionYesNo is a criterion answered yes or no
+	CriterionYesNo = "yesno"
+
+	// CriterionNumber is a criterion answered with a number
+	CriterionNumber = "number"
+
+	// CriterionDate is a criterion answered with a date
+	CriterionDate = "date"
+)
+
+// Criterion is one item of the eligibility checklist of a project.
+type Criterion struct {
+
+	// Text is the question shown to the enroller
+	Text string
+
+	// Kind is one of CriterionYesNo, CriterionNumber or CriterionDate
+	Kind string
+
+	// Required is the answer ("yes" or "no") that a subject must
+	// give to a yes/no criterion to be eligible
+	Required string
+
+	// Min and Max are the inclusive limits for a number or date
+	// (YYYY-MM-DD) criterion, blank for no limit
+	Min string
+	Max string
+}
+
+// Describe returns a printable description of the condition for
+// eligibility.
+func (c *Criterion) Describe() string {
+
+	switch c.Kind {
+	case CriterionYesNo:
+		return "must be " + c.Required
+	case CriterionNumber, CriterionDate:
+		switch {
+		case c.Min != "" && c.Max != "":
+			return fmt.Sprintf("between %s and %s", c.Min, c.Max)
+		case c.Min != "":
+			return "at least " + c.Min
+		case c.Max != "":
+			return "at most " + c.Max
+		}
+	}
+
+	return "any value"
+}
+
+// validate returns an error if the criterion is incomplete or its
+// limits cannot be parsed.
+func (c *Criterion) validate() error {
+
+	if strings.TrimSpace(c.Text) == "" {
+		return fmt.Errorf("the criterion text may not be blank")
+	}
+
+	switch c.Kind {
+	case CriterionYesNo:
+		if c.Required != "yes" && c.Required != "no" {
+			return fmt.Errorf("the required answer to '%s' must be yes or no", c.Text)
+		}
+	case CriterionNumber, CriterionDate:
+		for _, x := range []string{c.Min, c.Max} {
+			if x == "" {
+				continue
+			}
+			if _, err := c.parse(x); err != nil {
+				return fmt.Errorf("the limit '%s' of '%s' is invalid", x, c.Text)
+			}
+		}
+		if c.Min != "" && c.Max != "" {
+			lo, _ := c.parse(c.Min)
+			hi, _ := c.parse(c.Max)
+			if lo > hi {
+				return fmt.Errorf("the limits of '%s' are in the wrong order", c.Text)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown criterion type '%s'", c.Kind)
+	}
+
+	return nil
+}
+
+// parse converts an answer to a number or date criterion into a value
+// that can be compared to the limits.  Dates are converted to days
+// since 1970.
+func (c *Criterion) parse(x string) (float64, error) {
+
+	x = strings.TrimSpace(x)
+	if c.Kind == CriterionDate {
+		t, err := time.Parse("2006-01-02", x)
+		if err != nil {
+			return 0, err
+		}
+		return float64(t.Unix() / 86400), nil
+	}
+
+	return strconv.ParseFloat(x, 64)
+}
+
+// check returns a description of the problem if the answer does not
+// meet the criterion, or an empty string if it does.
+func (c *Criterion) check(answer string) string {
+
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return fmt.Sprintf("%s: no answer was given", c.Text)
+	}
+
+	switch c.Kind {
+	case CriterionYesNo:
+		if answer != c.Required {
+			return fmt.Sprintf("%s: the answer was %s, it %s", c.Text, answer, c.Describe())
+		}
+	case CriterionNumber, CriterionDate:
+		x, err := c.parse(answer)
+		if err != nil {
+			return fmt.Sprintf("%s: '%s' is not a valid %s", c.Text, answer, c.Kind)
+		}
+		lo, errlo := c.parse(c.Min)
+		hi, errhi := c.parse(c.Max)
+		if (errlo == nil && x < lo) || (errhi == nil && x > hi) {
+			return fmt.Sprintf("%s: the answer was %s, it must be %s", c.Text, answer, c.Describe())
+		}
+	}
+
+	return ""
+}
+
+// checkEligibility returns the reasons that a subject with the given
+// answers to the checklist is not eligible, or nil if the subject is
+// eligible.
+func (proj *Project) checkEligibility(answers map[string]string) []string {
+
+	var reasons []string
+	for i := range proj.Criteria {
+		c := &proj.Criteria[i]
+		if msg := c.check(answers[c.Text]); msg != "" {
+			reasons = append(reasons, msg)
+		}
+	}
+
+	return reasons
+}
+
+// eligibilityAnswers reads the answers to the checklist from the
+// submitted form, where the answer to criterion i is in field
+// "criterion<i>".
+func (proj *Project) eligibilityAnswers(r *http.Request) map[string]string {
+
+	answers := make(map[string]string)
+	for i, c := range proj.Criteria {
+		answers[c.Text] = strings.TrimSpace(r.FormValue(fmt.Sprintf("criterion%d", i)))
+	}
+
+	return answers
+}
+
+// CriterionView is a printable version of a criterion together with
+// the answer given for a subject.
+type CriterionView struct {
+	Field     string
+	Text      string
+	Kind      string
+	Condition string
+	Answer    string
+}
+
+// criterionViews returns printable versions of the eligibility
+// criteria with the given answers.
+func (proj *Project) criterionViews(answers map[string]string) []*CriterionView {
+
+	var cv []*CriterionView
+	for i := range proj.Criteria {
+		c := &proj.Criteria[i]
+		cv = append(cv, &CriterionView{
+			Field:     fmt.Sprintf("criterion%d", i),
+			Text:      c.Text,
+			Kind:      c.Kind,
+			Condition: c.Describe(),
+			Answer:    answers[c.Text],
+		})
+	}
+
+	return cv
+}
+
+// screenSubject checks the eligibility checklist submitted for a
+// subject.  If the subject is not eligible the attempt is logged as a
+// screen failure, a refusal is shown, and false is returned.
+func screenSubject(ctx context.Context, proj *Project, pkey, subjectId, user string, answers map[string]string, w http.ResponseWriter, r *http.Request) bool {
+
+	reasons := proj.checkEligibility(answers)
+	if len(reasons) == 0 {
+		return true
+	}
+
+	proj.recordScreenFailure(subjectId, user, answers, reasons, time.Now())
+	proj.logAudit(user, AuditStatus, subjectId, nil, map[string]interface{}{
+		"Status": StatusScreenFailed, "Answers": answers, "Reasons": reasons,
+	})
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("screenSubject: %v", err)
+	}
+
+	msg := fmt.Sprintf("Subject '%s' is not eligible and has not been randomized.  The following criteria were not met: %s.  The attempt has been recorded as a screen failure.",
+		subjectId, strings.Join(reasons, "; "))
+	rmsg := "Return to project"
+	messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+
+	return false
+}
+
+// EditCriteria displays the eligibility checklist and a form for
+// changing it.
+func EditCriteria(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionAmend, r) {
+		msg := "Only the project owner can change the eligibility criteria."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EditCriteria [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	tvals := struct {
+		User     string
+		LoggedIn bool
+		Pkey     string
+		Project  *Project
+	}{
+		User:     useremail,
+		LoggedIn: useremail != "",
+		Pkey:     pkey,
+		Project:  proj,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "edit_criteria.html", tvals); err != nil {
+		log.Printf("editCriteria failed to execute template: %v", err)
+	}
+}
+
+// EditCriteriaCompleted adds a criterion to, or removes criteria from,
+// the eligibility checklist.
+func EditCriteriaCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionAmend, r) {
+		msg := "Only the project owner can change the eligibility criteria."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EditCriteriaCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	var changes []string
+
+	// Criteria to remove
+	remove := make(map[int]bool)
+	for _, x := range r.Form["remove"] {
+		if i, err := strconv.Atoi(x); err == nil {
+			remove[i] = true
+		}
+	}
+	var criteria []Criterion
+	for i, c := range proj.Criteria {
+		if remove[i] {
+			changes = append(changes, fmt.Sprintf("Eligibility criterion removed: %s (%s).", c.Text, c.Describe()))
+			continue
+		}
+		criteria = append(criteria, c)
+	}
+
+	// A new criterion
+	if text := strings.TrimSpace(r.FormValue("text")); text != "" {
+		c := Criterion{
+			Text:     text,
+			Kind:     r.FormValue("kind"),
+			Required: r.FormValue("required"),
+			Min:      strings.TrimSpace(r.FormValue("min")),
+			Max:      strings.TrimSpace(r.FormValue("max")),
+		}
+		if c.Kind != CriterionYesNo {
+			c.Required = ""
+		} else {
+			c.Min, c.Max = "", ""
+		}
+		err := c.validate()
+		for _, x := range criteria {
+			if x.Text == c.Text {
+				err = fmt.Errorf("there is already a criterion '%s'", c.Text)
+			}
+		}
+		if err != nil {
+			msg := fmt.Sprintf("The criterion was not added: %v.", err)
+			rmsg := "Return to eligibility criteria"
+			messagePage(w, r, msg, rmsg, "/edit_criteria?pkey="+pkey)
+			return
+		}
+		criteria = append(criteria, c)
+		changes = append(changes, fmt.Sprintf("Eligibility criterion added: %s (%s).", c.Text, c.Describe()))
+	}
+
+	if len(changes) == 0 {
+		msg := "No changes were made."
+		rmsg := "Return to eligibility criteria"
+		messagePage(w, r, msg, rmsg, "/edit_criteria?pkey="+pkey)
+		return
+	}
+
+	before := proj.Criteria
+	proj.Criteria = criteria
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  time.Now(),
+		Comment:   changes,
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditSettings, "eligibility criteria", before, proj.Criteria)
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("EditCriteriaCompleted [2]: %v", err)
+		msg := "Database error, the eligibility criteria were not saved."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	http.Redirect(w, r, "/edit_criteria?pkey="+pkey, http.StatusSeeOther)
+}
@@ -0,0 +1,51 @@
+package randomize
+
+import (
+	"testing"
+)
+
+func TestEligibility(t *testing.T) {
+
+	proj := &Project{
+		Criteria: []Criterion{
+			{Text: "Consent signed", Kind: CriterionYesNo, Required: "yes"},
+			{Text: "Age", Kind: CriterionNumber, Min: "18", Max: "65"},
+			{Text: "Diagnosis date", Kind: CriterionDate, Min: "2020-01-01"},
+		},
+	}
+
+	for i := range proj.Criteria {
+		if err := proj.Criteria[i].validate(); err != nil {
+			t.Fatalf("criterion %d: %v", i, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		answers map[string]string
+		fail    int
+	}{
+		{map[string]string{"Consent signed": "yes", "Age": "18", "Diagnosis date": "2021-05-01"}, 0},
+		{map[string]string{"Consent signed": "yes", "Age": "65", "Diagnosis date": "2020-01-01"}, 0},
+		{map[string]string{"Consent signed": "no", "Age": "40", "Diagnosis date": "2021-05-01"}, 1},
+		{map[string]string{"Consent signed": "yes", "Age": "17.5", "Diagnosis date": "2019-12-31"}, 2},
+		{map[string]string{"Consent signed": "yes", "Age": "old", "Diagnosis date": "yesterday"}, 2},
+		{map[string]string{}, 3},
+	} {
+		reasons := proj.checkEligibility(tc.answers)
+		if len(reasons) != tc.fail {
+			t.Errorf("%v: expected %d failures, got %v", tc.answers, tc.fail, reasons)
+		}
+	}
+
+	for _, c := range []Criterion{
+		{Text: "", Kind: CriterionYesNo, Required: "yes"},
+		{Text: "Consent", Kind: CriterionYesNo, Required: "maybe"},
+		{Text: "Age", Kind: CriterionNumber, Min: "65", Max: "18"},
+		{Text: "Date", Kind: CriterionDate, Max: "01/01/2020"},
+		{Text: "Other", Kind: "text"},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("criterion %+v should be invalid", c)
+		}
+	}
+}
@@ -0,0 +1,640 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The kinds of events in the event log of a project
+	EventAssign      = "assign"
+	EventRegroup     = "change group"
+	EventRemove      = "remove"
+	EventReinstate   = "reinstate"
+	EventCorrect     = "correct"
+	EventAddVariable = "add variable"
+)
+
+// Event is one entry in the ordered log of changes to the subjects of
+// a project.  The subject-level state, and therefore the aggregate
+// counts, can be rebuilt by replaying the events.
+type Event struct {
+
+	// Seq is the position of the event in the log, starting from 1
+	Seq int
+
+	// Time is the time of the event
+	Time time.Time
+
+	// Kind is one of the Event constants
+	Kind string
+
+	// SubjectId identifies the subject, blank for EventAddVariable
+	SubjectId string
+
+	// Group is the treatment group, for EventAssign and EventRegroup
+	Group string
+
+	// Data contains the levels of the variables, for EventAssign
+	Data []string
+
+	// Period is the allocation period, for EventAssign
+	Period int
+
+	// Retain is true if a removed subject still counts toward the
+	// balance, for EventRemove
+	Retain bool
+
+	// Variable and Level are the variable and its new level, for
+	// EventCorrect and EventAddVariable
+	Variable string
+	Level    string
+
+	// User is the person who caused the event
+	User string
+
+	// Derived is true for events that were reconstructed from the
+	// subject-level data of a project that predates the event log
+	Derived bool
+}
+
+// subjectState is the state of one subject obtained by replaying the
+// event log.
+type subjectState struct {
+	SubjectId string
+	Assigned  time.Time
+	Group     string
+	Data      []string
+	Period    int
+	Included  bool
+	Retained  bool
+}
+
+// counted returns true if the subject is included in the aggregate
+// counts.
+func (s *subjectState) counted() bool {
+	return s.Included || s.Retained
+}
+
+// logEvent appends an event to the event log of a project that stores
+// subject-level data.  It must be called before the subject-level
+// data are changed, so that the log of a project created before the
+// event log existed can first be reconstructed from those data.
+func (proj *Project) logEvent(e *Event) {
+
+	if !proj.StoreRawData {
+		return
+	}
+
+	// Only a project holding all of its subjects can reconstruct its log
+	if len(proj.Events) == 0 && len(proj.RawData) > 0 && proj.eventSeq == 0 && (proj.stored == nil || proj.stored.loaded) {
+		proj.Events = proj.deriveEvents()
+	}
+
+	seq := proj.eventSeq
+	if n := len(proj.Events); n > 0 && proj.Events[n-1].Seq > seq {
+		seq = proj.Events[n-1].Seq
+	}
+	e.Seq = seq + 1
+	proj.Events = append(proj.Events, e)
+}
+
+// deriveEvents reconstructs an event log from the subject-level data.
+// The times of group changes are not recorded in the data, so these
+// are placed at the assignment time.
+func (proj *Project) deriveEvents() []*Event {
+
+	var events []*Event
+	for _, rec := range proj.RawData {
+
+		data := rec.OriginalData
+		if data == nil {
+			data = rec.Data
+		}
+		events = append(events, &Event{
+			Time:      rec.AssignedTime,
+			Kind:      EventAssign,
+			SubjectId: rec.SubjectId,
+			Group:     rec.AssignedGroup,
+			Data:      append([]string(nil), data...),
+			Period:    rec.Period,
+			User:      rec.Assigner,
+			Derived:   true,
+		})
+
+		if rec.CurrentGroup != rec.AssignedGroup {
+			events = append(events, &Event{
+				Time:      rec.AssignedTime,
+				Kind:      EventRegroup,
+				SubjectId: rec.SubjectId,
+				Group:     rec.CurrentGroup,
+				Derived:   true,
+			})
+		}
+
+		for _, c := range rec.Corrections {
+			events = append(events, &Event{
+				Time:      c.Time,
+				Kind:      EventCorrect,
+				SubjectId: rec.SubjectId,
+				Variable:  c.Variable,
+				Level:     c.To,
+				User:      c.User,
+				Derived:   true,
+			})
+		}
+
+		if !rec.Included {
+			t, user := rec.AssignedTime, ""
+			if c := rec.LastChange(); c != nil {
+				t, user = c.Time, c.User
+			}
+			events = append(events, &Event{
+				Time:      t,
+				Kind:      EventRemove,
+				SubjectId: rec.SubjectId,
+				Retain:    rec.BalanceRetained,
+				User:      user,
+				Derived:   true,
+			})
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	for i, e := range events {
+		e.Seq = i + 1
+	}
+
+	return events
+}
+
+// replay returns the state of each subject after applying, in order,
+// the events that occurred no later than until.  If until is zero all
+// events are applied.  The subjects are in the order of assignment.
+func (proj *Project) replay(until time.Time) ([]*subjectState, error) {
+
+	events := proj.Events
+	if len(events) == 0 && len(proj.RawData) > 0 {
+		events = proj.deriveEvents()
+	}
+
+	varIx := make(map[string]int)
+	for j, va := range proj.Variables {
+		varIx[va.Name] = j
+	}
+
+	var states []*subjectState
+	bySubject := make(map[string]*subjectState)
+	for _, e := range events {
+
+		if !until.IsZero() && e.Time.After(until) {
+			break
+		}
+
+		if e.Kind == EventAddVariable {
+			for _, s := range states {
+				s.Data = append(s.Data, e.Level)
+			}
+			continue
+		}
+
+		s := bySubject[e.SubjectId]
+		if e.Kind == EventAssign {
+			if s != nil {
+				return nil, fmt.Errorf("event %d: subject '%s' is assigned twice", e.Seq, e.SubjectId)
+			}
+			s = &subjectState{
+				SubjectId: e.SubjectId,
+				Assigned:  e.Time,
+				Group:     e.Group,
+				Data:      append([]string(nil), e.Data...),
+				Period:    e.Period,
+				Included:  true,
+			}
+			states = append(states, s)
+			bySubject[e.SubjectId] = s
+			continue
+		}
+
+		if s == nil {
+			return nil, fmt.Errorf("event %d: subject '%s' has not been assigned", e.Seq, e.SubjectId)
+		}
+
+		switch e.Kind {
+		case EventRegroup:
+			s.Group = e.Group
+		case EventRemove:
+			s.Included = false
+			s.Retained = e.Retain
+		case EventReinstate:
+			s.Included = true
+			s.Retained = false
+		case EventCorrect:
+			j, ok := varIx[e.Variable]
+			if !ok || j >= len(s.Data) {
+				return nil, fmt.Errorf("event %d: subject '%s' has no variable '%s'", e.Seq, e.SubjectId, e.Variable)
+			}
+			s.Data[j] = e.Level
+		default:
+			return nil, fmt.Errorf("event %d has unknown kind '%s'", e.Seq, e.Kind)
+		}
+	}
+
+	return states, nil
+}
+
+// rawStates returns the current state of each subject, taken from the
+// subject-level data.
+func (proj *Project) rawStates() []*subjectState {
+
+	var states []*subjectState
+	for _, rec := range proj.RawData {
+		states = append(states, &subjectState{
+			SubjectId: rec.SubjectId,
+			Assigned:  rec.AssignedTime,
+			Group:     rec.CurrentGroup,
+			Data:      rec.Data,
+			Period:    rec.Period,
+			Included:  rec.Included,
+			Retained:  rec.BalanceRetained,
+		})
+	}
+
+	return states
+}
+
+// Aggregates contains the counts that are maintained incrementally
+// as subjects are assigned and changed.
+type Aggregates struct {
+
+	// Assignments contains the number of subjects in each group
+	Assignments []int
+
+	// CellTotals contains the cell counts, laid out in the same way
+	// as the project cell totals
+	CellTotals []float64
+
+	// PeriodAssignments and PeriodCells contain the counts for each
+	// allocation period
+	PeriodAssignments [][]int
+	PeriodCells       [][]float64
+}
+
+// aggregate returns the counts for the given subject states, using
+// the current groups, variables and allocation periods of the project.
+func (proj *Project) aggregate(states []*subjectState) *Aggregates {
+
+	p := len(proj.Variables)
+	q := len(proj.GroupNames)
+	r := 0
+	if p > 0 && q > 0 {
+		r = len(proj.CellTotals) / (p * q)
+	}
+
+	agg := &Aggregates{
+		Assignments: make([]int, q),
+		CellTotals:  make([]float64, p*q*r),
+	}
+	for range proj.Periods {
+		agg.PeriodAssignments = append(agg.PeriodAssignments, make([]int, q))
+		agg.PeriodCells = append(agg.PeriodCells, make([]float64, p*q*r))
+	}
+
+	for _, s := range states {
+		if !s.counted() {
+			continue
+		}
+		g := getIndex(proj.GroupNames, s.Group)
+		if g == -1 {
+			continue
+		}
+		agg.Assignments[g]++
+		inPeriod := s.Period >= 0 && s.Period < len(proj.Periods)
+		if inPeriod {
+			agg.PeriodAssignments[s.Period][g]++
+		}
+		for j, va := range proj.Variables {
+			if j >= len(s.Data) {
+				break
+			}
+			k := getIndex(va.Levels, s.Data[j])
+			if k == -1 || k >= r {
+				continue
+			}
+			agg.CellTotals[q*r*j+q*k+g]++
+			if inPeriod {
+				agg.PeriodCells[s.Period][q*r*j+q*k+g]++
+			}
+		}
+	}
+
+	return agg
+}
+
+// storedAggregates returns the aggregate counts stored in the project.
+func (proj *Project) storedAggregates() *Aggregates {
+
+	agg := &Aggregates{
+		Assignments: proj.Assignments,
+		CellTotals:  proj.CellTotals,
+	}
+	for _, per := range proj.Periods {
+		agg.PeriodAssignments = append(agg.PeriodAssignments, per.Assignments)
+		agg.PeriodCells = append(agg.PeriodCells, per.CellTotals)
+	}
+
+	return agg
+}
+
+// diffAggregates describes the differences between two sets of counts.
+func (proj *Project) diffAggregates(label string, want, got *Aggregates) []string {
+
+	var diffs []string
+
+	q := len(proj.GroupNames)
+	p := len(proj.Variables)
+	r := 0
+	if p > 0 && q > 0 {
+		r = len(proj.CellTotals) / (p * q)
+	}
+
+	cellName := func(i int) string {
+		j, k, g := i/(q*r), (i%(q*r))/q, i%q
+		if j < p && k < len(proj.Variables[j].Levels) {
+			return fmt.Sprintf("%s, group %s", levelKey(proj.Variables[j].Name, proj.Variables[j].Levels[k]), proj.GroupNames[g])
+		}
+		return fmt.Sprintf("cell %d", i)
+	}
+
+	compare := func(where string, a, b []int) {
+		if len(a) != len(b) {
+			diffs = append(diffs, fmt.Sprintf("%s: %s has %d groups, expected %d", label, where, len(b), len(a)))
+			return
+		}
+		for g := range a {
+			if a[g] != b[g] {
+				diffs = append(diffs, fmt.Sprintf("%s: %s for group %s is %d, expected %d",
+					label, where, proj.GroupNames[g], b[g], a[g]))
+			}
+		}
+	}
+	compareCells := func(where string, a, b []float64) {
+		if len(a) != len(b) {
+			diffs = append(diffs, fmt.Sprintf("%s: %s has %d cells, expected %d", label, where, len(b), len(a)))
+			return
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				diffs = append(diffs, fmt.Sprintf("%s: %s for %s is %v, expected %v",
+					label, where, cellName(i), b[i], a[i]))
+			}
+		}
+	}
+
+	compare("assignment count", want.Assignments, got.Assignments)
+	compareCells("cell count", want.CellTotals, got.CellTotals)
+	for i := range want.PeriodAssignments {
+		if i >= len(got.PeriodAssignments) {
+			break
+		}
+		compare(fmt.Sprintf("period %d assignment count", i+1), want.PeriodAssignments[i], got.PeriodAssignments[i])
+		compareCells(fmt.Sprintf("period %d cell count", i+1), want.PeriodCells[i], got.PeriodCells[i])
+	}
+
+	return diffs
+}
+
+// checkConsistency reports drift between the stored aggregate counts,
+// the subject-level data and the event log.  An empty result means
+// that all three agree.
+func (proj *Project) checkConsistency() []string {
+
+	var problems []string
+
+	fromRaw := proj.aggregate(proj.rawStates())
+	problems = append(problems, proj.diffAggregates("stored counts", fromRaw, proj.storedAggregates())...)
+
+	if len(proj.Events) == 0 {
+		return problems
+	}
+
+	states, err := proj.replay(time.Time{})
+	if err != nil {
+		return append(problems, fmt.Sprintf("event log: %v", err))
+	}
+
+	return append(problems, proj.compareStates(states)...)
+}
+
+// compareStates describes the differences between the subject states
+// replayed from the event log and the subject-level data.
+func (proj *Project) compareStates(states []*subjectState) []string {
+
+	var problems []string
+
+	if len(states) != len(proj.RawData) {
+		problems = append(problems, fmt.Sprintf("event log: %d subjects, the data contain %d", len(states), len(proj.RawData)))
+	}
+	raw := make(map[string]*DataRecord)
+	for _, rec := range proj.RawData {
+		raw[rec.SubjectId] = rec
+	}
+	for _, s := range states {
+		rec, ok := raw[s.SubjectId]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("event log: subject '%s' is not in the data", s.SubjectId))
+			continue
+		}
+		if rec.CurrentGroup != s.Group {
+			problems = append(problems, fmt.Sprintf("event log: subject '%s' is in group %s, the data have %s",
+				s.SubjectId, s.Group, rec.CurrentGroup))
+		}
+		if rec.Included != s.Included || rec.BalanceRetained != s.Retained {
+			problems = append(problems, fmt.Sprintf("event log: subject '%s' has a different removal status", s.SubjectId))
+		}
+		if fmt.Sprint(rec.Data) != fmt.Sprint(s.Data) {
+			problems = append(problems, fmt.Sprintf("event log: subject '%s' has data %v, the data have %v",
+				s.SubjectId, s.Data, rec.Data))
+		}
+	}
+
+	return problems
+}
+
+// rebuildStates returns the subject states from which the aggregate
+// counts are rebuilt, and a description of where they were taken from.
+// The event log is replayed when there is one.  A log that cannot be
+// replayed, or that disagrees with the subject-level data, is reported
+// as an error, since it is not clear which of the two is correct.
+func (proj *Project) rebuildStates() ([]*subjectState, string, error) {
+
+	if len(proj.Events) == 0 {
+		return proj.rawStates(), "the subject-level data", nil
+	}
+
+	states, err := proj.replay(time.Time{})
+	if err != nil {
+		return nil, "", fmt.Errorf("the event log cannot be replayed: %v", err)
+	}
+	if diffs := proj.compareStates(states); len(diffs) > 0 {
+		return nil, "", fmt.Errorf("the event log and the subject-level data disagree: %s", strings.Join(diffs, "; "))
+	}
+
+	return states, "the event log", nil
+}
+
+// rebuildAggregates replaces the stored aggregate counts with counts
+// computed from the given subject states.
+func (proj *Project) rebuildAggregates(states []*subjectState) {
+
+	agg := proj.aggregate(states)
+	proj.Assignments = agg.Assignments
+	proj.CellTotals = agg.CellTotals
+	for i, per := range proj.Periods {
+		per.Assignments = agg.PeriodAssignments[i]
+		per.CellTotals = agg.PeriodCells[i]
+	}
+}
+
+// CheckConsistency compares the stored aggregate counts of a project
+// with its subject-level data and event log.
+func CheckConsistency(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionViewData, r) {
+		msg := "You don't have permission to check the data of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("CheckConsistency [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !proj.StoreRawData {
+		msg := "The counts can only be checked for projects that store the subject-level data."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	tvals := struct {
+		User       string
+		LoggedIn   bool
+		Pkey       string
+		Project    *Project
+		Problems   []string
+		NumEvents  int
+		CanRebuild bool
+	}{
+		User:       useremail,
+		LoggedIn:   useremail != "",
+		Pkey:       pkey,
+		Project:    proj,
+		Problems:   proj.checkConsistency(),
+		NumEvents:  len(proj.Events),
+		CanRebuild: checkPermission(susers, ActionCorrect, r),
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "check_consistency.html", tvals); err != nil {
+		log.Printf("checkConsistency failed to execute template: %v", err)
+	}
+}
+
+// RebuildAggregates replaces the stored aggregate counts of a project
+// with counts computed from its event log, or from its subject-level
+// data if it has no event log.
+func RebuildAggregates(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionCorrect, r) {
+		msg := "Only the project owner can rebuild the counts."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("RebuildAggregates [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !proj.StoreRawData {
+		msg := "The counts can only be rebuilt for projects that store the subject-level data."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	states, source, err := proj.rebuildStates()
+	if err != nil {
+		msg := fmt.Sprintf("The counts were not rebuilt, %v.", err)
+		rmsg := "Return to consistency check"
+		messagePage(w, r, msg, rmsg, "/check_consistency?pkey="+pkey)
+		return
+	}
+
+	stored := proj.storedAggregates()
+	problems := proj.diffAggregates("stored counts", proj.aggregate(states), stored)
+	if len(problems) == 0 {
+		msg := "The stored counts agree with the data, nothing was changed."
+		rmsg := "Return to consistency check"
+		messagePage(w, r, msg, rmsg, "/check_consistency?pkey="+pkey)
+		return
+	}
+
+	proj.rebuildAggregates(states)
+
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  time.Now(),
+		Comment:   append([]string{"Aggregate counts rebuilt from " + source + "."}, problems...),
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditRebuild, "", stored, proj.storedAggregates())
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("RebuildAggregates [2]: %v", err)
+		msg := "Database error, the counts were not rebuilt."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	http.Redirect(w, r, "/check_consistency?pkey="+pkey, http.StatusSeeOther)
+}
@@ -0,0 +1,165 @@
+package randomize
+
+import (
+	"testing"
+	"time"
+)
+
+// eventLevels cycles through the combinations of the two variables.
+var eventLevels = [][]string{{"F", "Young"}, {"M", "Young"}, {"F", "Old"}, {"M", "Old"}}
+
+func TestEventReplay(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+			{Name: "Age", Levels: []string{"Young", "Old"}, Weight: 1},
+		},
+	}, 1, 12, "", eventLevels)
+	if len(proj.Events) != 12 {
+		t.Fatalf("expected 12 events, got %d", len(proj.Events))
+	}
+	now := time.Now()
+
+	// Make one change of each kind
+	rec := proj.findSubject("1")
+	other := "A"
+	if rec.CurrentGroup == "A" {
+		other = "B"
+	}
+	proj.changeGroup(rec, other, "dm", now)
+	if err := proj.removeSubject(proj.findSubject("2"), "Other", "moved", false, "dm", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.removeSubject(proj.findSubject("3"), "Other", "moved", true, "dm", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.reinstateSubject(proj.findSubject("2"), "owner", "in error", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.correctCovariate(proj.findSubject("4"), 1, "Old", "owner", "typo", now); err != nil {
+		t.Fatal(err)
+	}
+	va := Variable{Name: "Site", Levels: []string{"X", "Y"}, Weight: 1}
+	if err := proj.addVariable(va, "X"); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := proj.checkConsistency(); len(p) != 0 {
+		t.Errorf("unexpected problems: %v", p)
+	}
+
+	states, err := proj.replay(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := proj.diffAggregates("replay", proj.aggregate(states), proj.storedAggregates()); len(d) != 0 {
+		t.Errorf("replayed counts differ: %v", d)
+	}
+
+	// Replaying up to a time before the changes gives the original
+	// assignments
+	states, err = proj.replay(proj.RawData[11].AssignedTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agg := proj.aggregate(states)
+	if agg.Assignments[0]+agg.Assignments[1] != 12 || states[1].Group == other {
+		t.Errorf("replay up to a time applied later events")
+	}
+	for _, s := range states {
+		if len(s.Data) != 2 {
+			t.Errorf("replay up to a time applied a later variable")
+		}
+	}
+}
+
+func TestConsistencyDrift(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+			{Name: "Age", Levels: []string{"Young", "Old"}, Weight: 1},
+		},
+	}, 1, 12, "", eventLevels)
+
+	// A lost write leaves the counts out of step with the data
+	proj.Assignments[0]++
+	proj.CellTotals[3]--
+	if p := proj.checkConsistency(); len(p) != 2 {
+		t.Errorf("expected 2 problems, got %v", p)
+	}
+	states, source, err := proj.rebuildStates()
+	if err != nil || source != "the event log" {
+		t.Fatalf("got %q, %v rebuilding the counts", source, err)
+	}
+	proj.rebuildAggregates(states)
+	if p := proj.checkConsistency(); len(p) != 0 {
+		t.Errorf("problems remain after rebuilding: %v", p)
+	}
+
+	// A change to the data that was not logged
+	proj.RawData[0].Included = false
+	if p := proj.checkConsistency(); len(p) == 0 {
+		t.Errorf("unlogged change was not detected")
+	}
+
+	// The counts are not rebuilt while the log and the data disagree
+	if _, _, err := proj.rebuildStates(); err == nil {
+		t.Errorf("the counts were rebuilt from a log that disagrees with the data")
+	}
+
+	// Without a log the counts are rebuilt from the data
+	proj.Events = nil
+	if states, source, err = proj.rebuildStates(); err != nil || source != "the subject-level data" {
+		t.Fatalf("got %q, %v rebuilding the counts", source, err)
+	}
+	proj.rebuildAggregates(states)
+	if proj.NumAssignments() != 11 {
+		t.Errorf("expected 11 subjects after rebuilding, got %d", proj.NumAssignments())
+	}
+}
+
+func TestDeriveEvents(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+			{Name: "Age", Levels: []string{"Young", "Old"}, Weight: 1},
+		},
+	}, 1, 12, "", eventLevels)
+	now := time.Now()
+	rec := proj.findSubject("5")
+	other := "A"
+	if rec.CurrentGroup == "A" {
+		other = "B"
+	}
+	proj.changeGroup(rec, other, "dm", now)
+	if err := proj.removeSubject(proj.findSubject("6"), "Other", "moved", false, "dm", now); err != nil {
+		t.Fatal(err)
+	}
+
+	// A project from before the event log
+	proj.Events = nil
+	states, err := proj.replay(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := proj.diffAggregates("derived", proj.aggregate(states), proj.storedAggregates()); len(d) != 0 {
+		t.Errorf("derived counts differ: %v", d)
+	}
+
+	// The first change creates the log from the existing data
+	if err := proj.reinstateSubject(proj.findSubject("6"), "owner", "in error", now); err != nil {
+		t.Fatal(err)
+	}
+	if len(proj.Events) != 15 || !proj.Events[0].Derived || proj.Events[14].Derived {
+		t.Errorf("event log was not derived, %d events", len(proj.Events))
+	}
+	if p := proj.checkConsistency(); len(p) != 0 {
+		t.Errorf("unexpected problems: %v", p)
+	}
+}
@@ -0,0 +1,113 @@
+package randomize
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ProjectExport is the content of a project export.  It contains the
+// protocol information, the design and the subject-level data, but not
+// the bookkeeping used to assign new subjects.
+type ProjectExport struct {
+	Name                  string
+	Owner                 string
+	Created               time.Time
+	ProtocolNumber        string
+	PrincipalInvestigator string
+	IRBNumber             string
+	RegistrationID        string
+	Description           string
+	Design                string `json:",omitempty"`
+	GroupNames            []string
+	SamplingRates         []float64
+	Variables             []Variable
+	Amendments            []*Amendment       `json:",omitempty"`
+	Subjects              []*DataRecord      `json:",omitempty"`
+	Screening             []*ScreeningRecord `json:",omitempty"`
+}
+
+// exportProject returns the export of a project whose subjects have
+// been read.
+func exportProject(proj *Project) *ProjectExport {
+	return &ProjectExport{
+		Name:                  proj.Name,
+		Owner:                 proj.Owner,
+		Created:               proj.Created,
+		ProtocolNumber:        proj.ProtocolNumber,
+		PrincipalInvestigator: proj.PrincipalInvestigator,
+		IRBNumber:             proj.IRBNumber,
+		RegistrationID:        proj.RegistrationID,
+		Description:           proj.Description,
+		Design:                proj.Design,
+		GroupNames:            proj.GroupNames,
+		SamplingRates:         proj.SamplingRates,
+		Variables:             proj.Variables,
+		Amendments:            proj.Amendments,
+		Subjects:              proj.RawData,
+		Screening:             proj.Screening,
+	}
+}
+
+// ExportProject writes the protocol information, design and
+// subject-level data of a project as a JSON file.
+func ExportProject(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionViewData, r) {
+		msg := "You don't have permission to export this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ExportProject [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	// The export contains the treatment groups, so it must be signed
+	// in projects that require signatures
+	if proj.RequireSignatures && r.Method == "GET" {
+		signActionPage(w, r, proj, "export the project, including the treatment group of every subject")
+		return
+	} else if r.Method == "POST" && !proj.RequireSignatures {
+		Serve404(w)
+		return
+	}
+	sig, ok := requireSignature(ctx, proj, w, r, "/project_dashboard?pkey="+pkey)
+	if !ok {
+		return
+	}
+
+	// The data are only shown once the export has been recorded
+	if err := recordSignedAudit(ctx, pkey, userEmail(r), AuditExport, "", nil, "JSON export", sig); err != nil {
+		msg := "Database error, the export could not be recorded in the audit log."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"project-%s.json\"", pkey))
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(exportProject(proj)); err != nil {
+		log.Printf("ExportProject [2]: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package randomize
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Factor is one factor of a factorial design.  Every combination of
+// the levels of the factors forms a treatment group.
+type Factor struct {
+
+	// Name identifies the factor
+	Name string
+
+	// Levels are the treatments that are compared for this factor
+	Levels []string
+}
+
+// parseFactors parses factor definitions of the form
+// "Name: level1, level2", separated by newlines or semicolons.
+func parseFactors(s string) ([]Factor, error) {
+
+	var factors []Factor
+	var names []string
+	for _, line := range strings.FieldsFunc(s, func(c rune) bool { return c == '\n' || c == ';' }) {
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("factor '%s' should have the form 'Name: level1, level2'", line)
+		}
+
+		f := Factor{
+			Name:   strings.TrimSpace(parts[0]),
+			Levels: cleanSplit(parts[1], ","),
+		}
+		if err := checkLabel(f.Name, names); err != nil {
+			return nil, err
+		}
+		if len(f.Levels) < 2 {
+			return nil, fmt.Errorf("factor '%s' must have at least two levels", f.Name)
+		}
+		for i, lev := range f.Levels {
+			if err := checkLabel(lev, f.Levels[0:i]); err != nil {
+				return nil, err
+			}
+			if strings.Contains(lev, "/") {
+				return nil, fmt.Errorf("the level '%s' may not contain '/'", lev)
+			}
+		}
+
+		names = append(names, f.Name)
+		factors = append(factors, f)
+	}
+
+	if len(factors) < 2 {
+		return nil, fmt.Errorf("a factorial design needs at least two factors")
+	}
+
+	return factors, nil
+}
+
+// formatFactors returns the factors in the form accepted by
+// parseFactors.
+func formatFactors(factors []Factor) string {
+
+	var parts []string
+	for _, f := range factors {
+		parts = append(parts, f.Name+":"+strings.Join(f.Levels, ","))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// factorialGroupNames returns the names of the treatment groups of a
+// factorial design, one for each combination of factor levels.  The
+// level of the first factor varies slowest.
+func factorialGroupNames(factors []Factor) []string {
+
+	names := []string{""}
+	for _, f := range factors {
+		var next []string
+		for _, x := range names {
+			for _, lev := range f.Levels {
+				if x == "" {
+					next = append(next, lev)
+				} else {
+					next = append(next, x+"/"+lev)
+				}
+			}
+		}
+		names = next
+	}
+
+	return names
+}
+
+// factorLevels returns the level of each factor for the given
+// treatment group of a factorial project.
+func (proj *Project) factorLevels(group int) []int {
+
+	levels := make([]int, len(proj.Factors))
+	for f := len(proj.Factors) - 1; f >= 0; f-- {
+		n := len(proj.Factors[f].Levels)
+		levels[f] = group % n
+		group /= n
+	}
+
+	return levels
+}
+
+// factorialAssignment chooses a group of a factorial design among the
+// open groups, one factor at a time.  The level of each factor is
+// chosen with the Pocock/Simon method so that the margins of every
+// factor are balanced as closely as the groups of a two group design
+// would be.  The full cells are balanced when the level of the last
+// factor is chosen.
+func (proj *Project) factorialAssignment(rgen *rand.Rand, mpv map[string]string, open []int) int {
+
+	cands := open
+	last := len(proj.Factors) - 1
+	for f, fa := range proj.Factors {
+
+		// The levels of this factor that the remaining groups have,
+		// and one group for each of them
+		var levels, groups []int
+		for m := range fa.Levels {
+			for _, g := range cands {
+				if proj.factorLevels(g)[f] == m {
+					levels = append(levels, m)
+					groups = append(groups, g)
+					break
+				}
+			}
+		}
+
+		scores := make([]float64, len(levels))
+		for i, m := range levels {
+			for k, va := range proj.Variables {
+				x := mpv[va.Name]
+				scores[i] += va.Weight * proj.marginScore(x, f, m, k)
+				if f == last {
+					scores[i] += va.Weight * proj.Score(x, groups[i], k)
+				}
+			}
+		}
+		m := levels[proj.pocockSimon(rgen, scores)]
+
+		var next []int
+		for _, g := range cands {
+			if proj.factorLevels(g)[f] == m {
+				next = append(next, g)
+			}
+		}
+		cands = next
+	}
+
+	return cands[0]
+}
+
+// marginScore calculates the imbalance of the margin of factor `f`
+// among subjects with level `x` of the kth variable, if we assign a
+// subject with this level to a group with level `m` of the factor.
+// Only open groups are compared.
+func (proj *Project) marginScore(x string, f, m, k int) float64 {
+
+	va := proj.Variables[k]
+	j := getIndex(va.Levels, x)
+	if j == -1 {
+		return 0
+	}
+
+	fa := proj.Factors[f]
+	counts := make([]float64, len(fa.Levels))
+	rates := make([]float64, len(fa.Levels))
+	for g := range proj.GroupNames {
+		if !proj.GroupOpen(g) {
+			continue
+		}
+		l := proj.factorLevels(g)[f]
+		counts[l] += proj.balanceCount(k, j, g)
+		rates[l] += proj.SamplingRates[g]
+	}
+	counts[m]++
+
+	var mn, mx float64
+	first := true
+	for l := range counts {
+		if rates[l] == 0 {
+			continue
+		}
+		nc := counts[l] / rates[l]
+		if first || nc < mn {
+			mn = nc
+		}
+		if first || nc > mx {
+			mx = nc
+		}
+		first = false
+	}
+
+	return mx - mn
+}
+
+// factorMargins returns, for each factor and level, the number of
+// subjects assigned to a group with that level.
+func (proj *Project) factorMargins() [][]int {
+
+	margins := make([][]int, len(proj.Factors))
+	for f, fa := range proj.Factors {
+		margins[f] = make([]int, len(fa.Levels))
+	}
+
+	for g, n := range proj.Assignments {
+		for f, m := range proj.factorLevels(g) {
+			margins[f][m] += n
+		}
+	}
+
+	return margins
+}
@@ -0,0 +1,73 @@
+package randomize
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseFactors(t *testing.T) {
+
+	factors, err := parseFactors("Drug: A, placebo\nDiet: low, normal, high")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatFactors(factors) != "Drug:A,placebo;Diet:low,normal,high" {
+		t.Errorf("unexpected factors %s", formatFactors(factors))
+	}
+
+	// The formatted factors can be parsed again
+	f2, err := parseFactors(formatFactors(factors))
+	if err != nil || formatFactors(f2) != formatFactors(factors) {
+		t.Errorf("factors do not round trip: %v", err)
+	}
+
+	names := factorialGroupNames(factors)
+	expected := []string{"A/low", "A/normal", "A/high", "placebo/low", "placebo/normal", "placebo/high"}
+	if fmt.Sprintf("%v", names) != fmt.Sprintf("%v", expected) {
+		t.Errorf("unexpected group names %v", names)
+	}
+
+	proj := &Project{Factors: factors, GroupNames: names}
+	for g, x := range names {
+		lev := proj.factorLevels(g)
+		if x != factors[0].Levels[lev[0]]+"/"+factors[1].Levels[lev[1]] {
+			t.Errorf("group %s has levels %v", x, lev)
+		}
+	}
+
+	for _, bad := range []string{"Drug: A", "Drug: A, B", "Drug: A, B\nDrug: C, D", "Drug A, B\nDiet: x, y", "Drug: A, A\nDiet: x, y"} {
+		if _, err := parseFactors(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestFactorialAssignment(t *testing.T) {
+
+	factors, _ := parseFactors("Drug: A, placebo; Diet: low, normal")
+
+	for seed := int64(1); seed <= 10; seed++ {
+		proj := testProject(t, &Project{
+			GroupNames: factorialGroupNames(factors),
+			Factors:    factors,
+			Variables: []Variable{
+				{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+			},
+		}, seed, 120, "", [][]string{{"F"}, {"M"}, {"M"}})
+
+		for f, m := range proj.factorMargins() {
+			if d := m[0] - m[1]; d > 6 || d < -6 {
+				t.Errorf("seed %d: margins of factor %s are not balanced: %v", seed, factors[f].Name, m)
+			}
+		}
+		for g, n := range proj.Assignments {
+			if n < 20 || n > 40 {
+				t.Errorf("seed %d: group %s received %d of 120 subjects", seed, proj.GroupNames[g], n)
+			}
+		}
+
+		if err := proj.addGroup("X", 1); err == nil {
+			t.Errorf("groups cannot be added to a factorial design")
+		}
+	}
+}
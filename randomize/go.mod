@@ -5,5 +5,6 @@ go 1.16
 require (
 	cloud.google.com/go/firestore v1.6.1
 	golang.org/x/net v0.0.0-20211118161319-6a13c67c3ce4
+	google.golang.org/api v0.59.0
 	google.golang.org/grpc v1.42.0
 )
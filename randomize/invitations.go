@@ -0,0 +1,302 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// invitationLifetime is the length of time that an invitation can be
+// accepted before it lapses.
+const invitationLifetime = 30 * 24 * time.Hour
+
+// Invitation is an offer to share a project that the recipient must
+// accept before they gain access.
+type Invitation struct {
+
+	// ID is the database key of the invitation
+	ID string `firestore:"-"`
+
+	// Pkey is the key of the project that is being shared
+	Pkey string
+
+	// ProjectName is the name of the project that is being shared
+	ProjectName string
+
+	// Email is the address of the person being invited
+	Email string
+
+	// Role is the role that the person will have after accepting
+	Role Role
+
+	// Inviter is the person who sent the invitation
+	Inviter string
+
+	// Created is the time at which the invitation was sent
+	Created time.Time
+
+	// Expires is the time after which the invitation can no longer be accepted
+	Expires time.Time
+
+	// AccessExpires is the time at which access granted by this
+	// invitation ends, or the zero time if access does not expire
+	AccessExpires time.Time
+}
+
+// InvitationView is a printable version of an Invitation.
+type InvitationView struct {
+	ID            string
+	ProjectName   string
+	Email         string
+	Role          Role
+	Inviter       string
+	Expires       string
+	AccessExpires string
+}
+
+// formatInvitation returns a printable version of the given invitation.
+func formatInvitation(inv *Invitation) InvitationView {
+
+	loc, _ := time.LoadLocation("America/New_York")
+	iv := InvitationView{
+		ID:          inv.ID,
+		ProjectName: inv.ProjectName,
+		Email:       inv.Email,
+		Role:        inv.Role,
+		Inviter:     inv.Inviter,
+		Expires:     inv.Expires.In(loc).Format("2006-1-2"),
+	}
+	if !inv.AccessExpires.IsZero() {
+		iv.AccessExpires = inv.AccessExpires.In(loc).Format("2006-1-2")
+	}
+
+	return iv
+}
+
+// parseEmails splits a comma separated list of email addresses,
+// converting them to lower case.  The second return value contains
+// all entries that are not valid bare email addresses.
+func parseEmails(s string) ([]string, []string) {
+
+	var valid, invalid []string
+	for _, x := range cleanSplit(s, ",") {
+		if x == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(x)
+		if err != nil || addr.Address != x || !strings.Contains(addr.Address, ".") {
+			invalid = append(invalid, x)
+			continue
+		}
+		valid = append(valid, strings.ToLower(x))
+	}
+
+	return valid, invalid
+}
+
+// parseExpiry parses an optional date in YYYY-MM-DD format.  Access
+// ends at the end of the given day.  The empty string returns the zero
+// time.
+func parseExpiry(s string) (time.Time, error) {
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	loc, _ := time.LoadLocation("America/New_York")
+	t, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return t.Add(24*time.Hour - time.Second), nil
+}
+
+// createInvitations stores an invitation for each of the given people.
+func createInvitations(ctx context.Context, invs []*Invitation) error {
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, inv := range invs {
+		if _, _, err := client.Collection("Invitation").Add(ctx, inv); err != nil {
+			log.Printf("createInvitations: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getInvitations returns all unexpired invitations where the given
+// field has the given value.
+func getInvitations(ctx context.Context, field, value string) ([]*Invitation, error) {
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	docs, err := client.Collection("Invitation").Where(field, "==", value).Documents(ctx).GetAll()
+	if err != nil {
+		log.Printf("getInvitations: %v", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	var invs []*Invitation
+	for _, doc := range docs {
+		var inv Invitation
+		if err := doc.DataTo(&inv); err != nil {
+			log.Printf("getInvitations: %v", err)
+			return nil, err
+		}
+		if now.After(inv.Expires) {
+			continue
+		}
+		inv.ID = doc.Ref.ID
+		invs = append(invs, &inv)
+	}
+
+	return invs, nil
+}
+
+// getInvitation returns the invitation with the given id.
+func getInvitation(ctx context.Context, id string) (*Invitation, error) {
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	doc, err := client.Doc("Invitation/" + id).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var inv Invitation
+	if err := doc.DataTo(&inv); err != nil {
+		return nil, err
+	}
+	inv.ID = id
+
+	return &inv, nil
+}
+
+// selectInvitations returns the ids in ids that belong to one of the
+// given invitations, so that a request cannot name invitations of
+// another project.
+func selectInvitations(invs []*Invitation, ids []string) []string {
+
+	known := make(map[string]bool)
+	for _, inv := range invs {
+		known[inv.ID] = true
+	}
+
+	var sel []string
+	for _, id := range ids {
+		if known[id] {
+			sel = append(sel, id)
+		}
+	}
+
+	return sel
+}
+
+// deleteInvitations removes the invitations with the given ids.
+func deleteInvitations(ctx context.Context, ids []string) error {
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, id := range ids {
+		_, err := client.Doc("Invitation/" + id).Delete(ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			log.Printf("deleteInvitations: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RespondInvitation accepts or declines an invitation to share a project.
+func RespondInvitation(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := r.Context()
+	useremail := strings.ToLower(userEmail(r))
+	id := r.FormValue("id")
+
+	inv, err := getInvitation(ctx, id)
+	if status.Code(err) == codes.NotFound || (err == nil && inv.Email != useremail) {
+		msg := "This invitation does not exist or has been withdrawn."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	} else if err != nil {
+		log.Printf("RespondInvitation [1]: %v", err)
+		msg := "A database error occurred, the invitation could not be retrieved."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if time.Now().After(inv.Expires) {
+		msg := "This invitation has expired.  Ask the project owner to send a new invitation."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	}
+
+	var msg string
+	if r.FormValue("response") == "accept" {
+		shares := map[string]Share{
+			useremail: {Role: inv.Role, Expires: inv.AccessExpires},
+		}
+		if err := addSharing(inv.Pkey, shares); err != nil {
+			log.Printf("RespondInvitation [2]: %v", err)
+			msg := "Database error: unable to update sharing information."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+		if err := recordAudit(ctx, inv.Pkey, useremail, AuditShare, useremail, nil, shares); err != nil {
+			msg := "You have been given access, but the change could not be recorded in the audit log.  Please inform the project owner."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+		msg = fmt.Sprintf("You now have access to the project \"%s\" with the role '%s'.", inv.ProjectName, inv.Role)
+	} else {
+		msg = fmt.Sprintf("You have declined the invitation to the project \"%s\".", inv.ProjectName)
+	}
+
+	if err := deleteInvitations(ctx, []string{id}); err != nil {
+		log.Printf("RespondInvitation [3]: %v", err)
+	}
+
+	rmsg := "Return to dashboard"
+	messagePage(w, r, msg, rmsg, "/dashboard")
+}
@@ -0,0 +1,522 @@
+package randomize
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// StatusScreened is a subject who is being screened for eligibility
+	StatusScreened = "screened"
+
+	// StatusScreenFailed is a subject who did not meet the
+	// eligibility criteria
+	StatusScreenFailed = "screen-failed"
+
+	// StatusRandomized is a subject who has been assigned to a
+	// treatment group and remains in the study
+	StatusRandomized = "randomized"
+
+	// StatusWithdrawn is a subject who has been removed from the study
+	StatusWithdrawn = "withdrawn"
+
+	// StatusLost is a subject who has been lost to follow-up
+	StatusLost = "lost to follow-up"
+
+	// StatusCompleted is a subject who has completed the study
+	StatusCompleted = "completed"
+)
+
+// subjectStatuses lists the states of randomized subjects, in the
+// order that they are reported.
+var subjectStatuses = []string{StatusRandomized, StatusLost, StatusCompleted, StatusWithdrawn}
+
+// statusTransitions contains the states that can be reached from
+// each state.  Randomization itself is not included, since it happens
+// only through assignment to a treatment group.
+var statusTransitions = map[string][]string{
+	StatusScreened:     {StatusScreenFailed},
+	StatusScreenFailed: {StatusScreened},
+	StatusRandomized:   {StatusWithdrawn, StatusLost, StatusCompleted},
+	StatusLost:         {StatusWithdrawn, StatusCompleted},
+	StatusCompleted:    {StatusWithdrawn},
+}
+
+// StatusChange records a transition of a subject from one lifecycle
+// state to another.
+type StatusChange struct {
+
+	// Status is the state entered
+	Status string
+
+	// Time is the time of the transition
+	Time time.Time
+
+	// User is the person who made the change
+	User string
+
+	// Reason is the reason given for the change
+	Reason string
+}
+
+// ScreeningRecord is an entry in the screening log, for a subject who
+// has been screened but not randomized.
+type ScreeningRecord struct {
+
+	// SubjectId identifies the subject
+	SubjectId string
+
+	// Status is StatusScreened or StatusScreenFailed
+	Status string
+
+	// Answers contains the most recent answers to the eligibility
+	// checklist, keyed by criterion text
+	Answers map[string]string
+
+	// Reasons describes the eligibility criteria that were not met
+	Reasons []string
+
+	// History contains the lifecycle transitions of the subject
+	History []*StatusChange
+}
+
+// Last returns the most recent lifecycle transition of the subject.
+func (sr *ScreeningRecord) Last() *StatusChange {
+	if len(sr.History) == 0 {
+		return &StatusChange{}
+	}
+	return sr.History[len(sr.History)-1]
+}
+
+// CurrentStatus returns the lifecycle state of the subject.  Subjects
+// randomized before lifecycle states were recorded are in state
+// StatusRandomized, or StatusWithdrawn if they have been removed.
+func (rec *DataRecord) CurrentStatus() string {
+	switch {
+	case rec.Status != "":
+		return rec.Status
+	case rec.Included:
+		return StatusRandomized
+	default:
+		return StatusWithdrawn
+	}
+}
+
+// LastChange returns the most recent lifecycle transition of the
+// subject, or nil if none has been recorded.
+func (rec *DataRecord) LastChange() *StatusChange {
+	if len(rec.History) == 0 {
+		return nil
+	}
+	return rec.History[len(rec.History)-1]
+}
+
+// canTransition returns an error if a subject cannot move from one
+// lifecycle state to another.
+func canTransition(from, to string) error {
+	for _, x := range statusTransitions[from] {
+		if x == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("a subject who is %s cannot become %s", from, to)
+}
+
+// setStatus moves a randomized subject to a new lifecycle state.
+func (rec *DataRecord) setStatus(status, user, reason string, now time.Time) error {
+
+	if err := canTransition(rec.CurrentStatus(), status); err != nil {
+		return err
+	}
+
+	rec.Status = status
+	rec.History = append(rec.History, &StatusChange{
+		Status: status,
+		Time:   now,
+		User:   user,
+		Reason: reason,
+	})
+
+	return nil
+}
+
+// findScreening returns the screening log entry for the given subject,
+// or nil if there is none.
+func (proj *Project) findScreening(subjectId string) *ScreeningRecord {
+	for _, sr := range proj.Screening {
+		if sr.SubjectId == subjectId {
+			return sr
+		}
+	}
+	return nil
+}
+
+// screen adds a subject to the screening log, or returns the subject's
+// existing entry.  A subject who previously failed screening is
+// screened again.
+func (proj *Project) screen(subjectId, user, reason string, now time.Time) (*ScreeningRecord, error) {
+
+	if proj.findSubject(subjectId) != nil {
+		return nil, fmt.Errorf("subject '%s' has already been randomized", subjectId)
+	}
+
+	sr := proj.findScreening(subjectId)
+	if sr == nil {
+		if err := proj.SubjectIDs.check(subjectId); err != nil {
+			return nil, err
+		}
+		sr = &ScreeningRecord{SubjectId: subjectId}
+		proj.Screening = append(proj.Screening, sr)
+	} else if sr.Status == StatusScreened {
+		return sr, nil
+	} else if err := canTransition(sr.Status, StatusScreened); err != nil {
+		return nil, err
+	}
+
+	sr.Status = StatusScreened
+	sr.History = append(sr.History, &StatusChange{
+		Status: StatusScreened,
+		Time:   now,
+		User:   user,
+		Reason: reason,
+	})
+
+	return sr, nil
+}
+
+// recordScreenFailure records in the screening log that a subject did
+// not meet the eligibility criteria.
+func (proj *Project) recordScreenFailure(subjectId, user string, answers map[string]string, reasons []string, now time.Time) {
+
+	sr := proj.findScreening(subjectId)
+	if sr == nil {
+		sr = &ScreeningRecord{SubjectId: subjectId}
+		proj.Screening = append(proj.Screening, sr)
+	}
+
+	sr.Status = StatusScreenFailed
+	sr.Answers = answers
+	sr.Reasons = reasons
+	sr.History = append(sr.History, &StatusChange{
+		Status: StatusScreenFailed,
+		Time:   now,
+		User:   user,
+		Reason: strings.Join(reasons, "; "),
+	})
+}
+
+// markRandomized removes a newly randomized subject from the screening
+// log, carrying the screening history over to the subject's record.
+func (proj *Project) markRandomized(rec *DataRecord, user string, now time.Time) {
+
+	for i, sr := range proj.Screening {
+		if sr.SubjectId == rec.SubjectId {
+			rec.History = append(rec.History, sr.History...)
+			proj.Screening = append(proj.Screening[0:i], proj.Screening[i+1:]...)
+			break
+		}
+	}
+
+	rec.Status = StatusRandomized
+	rec.History = append(rec.History, &StatusChange{
+		Status: StatusRandomized,
+		Time:   now,
+		User:   user,
+	})
+}
+
+// ScreenFailures returns the entries of the screening log for subjects
+// who did not meet the eligibility criteria.
+func (proj *Project) ScreenFailures() []*ScreeningRecord {
+	var sf []*ScreeningRecord
+	for _, sr := range proj.Screening {
+		if sr.Status == StatusScreenFailed {
+			sf = append(sf, sr)
+		}
+	}
+	return sf
+}
+
+// statusCounts returns, for each state in subjectStatuses, the number
+// of randomized subjects currently assigned to each group.
+func (proj *Project) statusCounts() [][]int {
+
+	counts := make([][]int, len(subjectStatuses))
+	for i := range counts {
+		counts[i] = make([]int, len(proj.GroupNames))
+	}
+
+	for _, rec := range proj.RawData {
+		s := getIndex(subjectStatuses, rec.CurrentStatus())
+		g := getIndex(proj.GroupNames, rec.CurrentGroup)
+		if s != -1 && g != -1 {
+			counts[s][g]++
+		}
+	}
+
+	return counts
+}
+
+// csvField quotes a free text value for inclusion in a CSV file.
+func csvField(x string) string {
+	if !strings.ContainsAny(x, ",\"\n") {
+		return x
+	}
+	return "\"" + strings.Replace(x, "\"", "\"\"", -1) + "\""
+}
+
+// ScreeningLog displays the screening log and the lifecycle states of
+// the randomized subjects, with forms for changing them.  Enrollers
+// can screen subjects, but they only see the screening log, since the
+// randomized subjects are listed with their groups.
+func ScreeningLog(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionAssign, r) && !checkPermission(susers, ActionViewData, r) {
+		msg := "You don't have permission to view the subjects of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+	unblinded := checkPermission(susers, ActionViewData, r)
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ScreeningLog [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !proj.StoreRawData {
+		msg := "The screening log is not available for a project in which the subject-level data is not stored."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	loc, _ := time.LoadLocation("America/New_York")
+
+	type subjectView struct {
+		SubjectId string
+		Group     string
+		Status    string
+		Time      string
+		Reason    string
+	}
+
+	var screening []subjectView
+	for _, sr := range proj.Screening {
+		last := sr.Last()
+		screening = append(screening, subjectView{
+			SubjectId: sr.SubjectId,
+			Status:    sr.Status,
+			Time:      last.Time.In(loc).Format("2006-01-02 3:04 PM"),
+			Reason:    last.Reason,
+		})
+	}
+
+	var subjects []subjectView
+	for _, rec := range proj.RawData {
+		if !unblinded {
+			break
+		}
+		sv := subjectView{
+			SubjectId: rec.SubjectId,
+			Group:     rec.CurrentGroup,
+			Status:    rec.CurrentStatus(),
+			Time:      rec.AssignedTime.In(loc).Format("2006-01-02 3:04 PM"),
+		}
+		if last := rec.LastChange(); last != nil {
+			sv.Time = last.Time.In(loc).Format("2006-01-02 3:04 PM")
+			sv.Reason = last.Reason
+		}
+		subjects = append(subjects, sv)
+	}
+
+	tvals := struct {
+		User      string
+		LoggedIn  bool
+		Pkey      string
+		Project   *Project
+		Screening []subjectView
+		Subjects  []subjectView
+		Unblinded bool
+		CanScreen bool
+		CanEdit   bool
+	}{
+		User:      useremail,
+		LoggedIn:  useremail != "",
+		Pkey:      pkey,
+		Project:   proj,
+		Screening: screening,
+		Subjects:  subjects,
+		Unblinded: unblinded,
+		CanScreen: checkPermission(susers, ActionAssign, r),
+		CanEdit:   checkPermission(susers, ActionEditAssignment, r),
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "screening_log.html", tvals); err != nil {
+		log.Printf("screeningLog failed to execute template: %v", err)
+	}
+}
+
+// ScreeningLogCompleted adds a subject to the screening log, or changes
+// the lifecycle state of a subject.
+func ScreeningLogCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	action := r.FormValue("action")
+	perm := ActionEditAssignment
+	if action == "screen" {
+		perm = ActionAssign
+	}
+	if !checkPermission(susers, perm, r) {
+		msg := "You don't have permission to change the status of subjects in this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ScreeningLogCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	subjectId := strings.TrimSpace(r.FormValue("subject_id"))
+	status := r.FormValue("status")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	now := time.Now()
+
+	switch {
+	case subjectId == "":
+		err = fmt.Errorf("the subject id may not be blank")
+	case action == "screen":
+		_, err = proj.screen(subjectId, useremail, reason, now)
+		status = StatusScreened
+	case reason == "":
+		err = fmt.Errorf("a reason for the change must be provided")
+	case status == StatusScreenFailed:
+		if proj.findScreening(subjectId) == nil {
+			err = fmt.Errorf("subject '%s' is not in the screening log", subjectId)
+		} else {
+			proj.recordScreenFailure(subjectId, useremail, nil, []string{reason}, now)
+		}
+	case status == StatusWithdrawn:
+		err = fmt.Errorf("subjects are withdrawn by removing them from the study")
+	default:
+		rec := proj.findSubject(subjectId)
+		if rec == nil {
+			err = fmt.Errorf("there is no randomized subject with id '%s'", subjectId)
+		} else {
+			err = rec.setStatus(status, useremail, reason, now)
+		}
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("The status was not changed: %v.", err)
+		rmsg := "Return to screening log"
+		messagePage(w, r, msg, rmsg, "/screening_log?pkey="+pkey)
+		return
+	}
+
+	change := fmt.Sprintf("Subject '%s' is %s.", subjectId, status)
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  now,
+		Comment:   []string{change},
+	}
+	if reason != "" {
+		comment.Comment = append(comment.Comment, reason)
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditStatus, subjectId, nil, map[string]string{
+		"Status": status, "Reason": reason,
+	})
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("ScreeningLogCompleted [2]: %v", err)
+		msg := "Database error, the status was not changed."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	http.Redirect(w, r, "/screening_log?pkey="+pkey, http.StatusSeeOther)
+}
+
+// ViewScreeningLog displays the screening log, including the screening
+// history of randomized subjects, in raw text form.
+func ViewScreeningLog(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionViewData, r) {
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ViewScreeningLog [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, "Subject id,Status,Date,Time,User,Reason\n")
+
+	loc, _ := time.LoadLocation("America/New_York")
+	write := func(subjectId string, history []*StatusChange) {
+		for _, sc := range history {
+			t := sc.Time.In(loc)
+			_, _ = io.WriteString(w, strings.Join([]string{
+				csvField(subjectId), sc.Status, t.Format("2006-1-2"),
+				t.Format("3:04 PM EST"), sc.User, csvField(sc.Reason),
+			}, ",")+"\n")
+		}
+	}
+
+	for _, sr := range proj.Screening {
+		write(sr.SubjectId, sr.History)
+	}
+	for _, rec := range proj.RawData {
+		write(rec.SubjectId, rec.History)
+	}
+}
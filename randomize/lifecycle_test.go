@@ -0,0 +1,70 @@
+package randomize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+
+	proj := &Project{
+		GroupNames:    []string{"A", "B"},
+		Assignments:   make([]int, 2),
+		SamplingRates: []float64{1, 1},
+		Bias:          5,
+		Open:          true,
+		StoreRawData:  true,
+	}
+	now := time.Now()
+
+	if _, err := proj.screen("s1", "user", "", now); err != nil {
+		t.Fatal(err)
+	}
+	proj.recordScreenFailure("s2", "user", nil, []string{"Age: too young"}, now)
+	if len(proj.Screening) != 2 || len(proj.ScreenFailures()) != 1 {
+		t.Fatalf("expected two screened subjects and one failure, got %d and %d",
+			len(proj.Screening), len(proj.ScreenFailures()))
+	}
+
+	// Randomization moves the subject out of the screening log
+	if _, err := proj.doAssignment(map[string]string{}, "s1", "user"); err != nil {
+		t.Fatal(err)
+	}
+	rec := proj.findSubject("s1")
+	if len(proj.Screening) != 1 || rec.CurrentStatus() != StatusRandomized || len(rec.History) != 2 {
+		t.Fatalf("s1 was not moved out of the screening log: %+v", rec)
+	}
+	if _, err := proj.screen("s1", "user", "", now); err == nil {
+		t.Errorf("a randomized subject should not be screened again")
+	}
+
+	// A failed subject can be rescreened
+	if _, err := proj.screen("s2", "user", "rescreen", now); err != nil {
+		t.Fatal(err)
+	}
+	if len(proj.ScreenFailures()) != 0 {
+		t.Errorf("s2 should no longer be a screen failure")
+	}
+
+	if err := rec.setStatus(StatusLost, "user", "moved away", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.setStatus(StatusRandomized, "user", "", now); err == nil {
+		t.Errorf("a lost subject should not return to randomized")
+	}
+	if err := rec.setStatus(StatusCompleted, "user", "final visit", now); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := proj.statusCounts()
+	g := getIndex(proj.GroupNames, rec.CurrentGroup)
+	if counts[getIndex(subjectStatuses, StatusCompleted)][g] != 1 {
+		t.Errorf("status counts are wrong: %v", counts)
+	}
+
+	// Records stored before lifecycle states existed
+	old := &DataRecord{Included: false}
+	if old.CurrentStatus() != StatusWithdrawn {
+		t.Errorf("a removed legacy subject should be withdrawn")
+	}
+}
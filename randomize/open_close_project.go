@@ -21,7 +21,7 @@ func OpenCloseProject(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionOpenClose, r) {
 		msg := "You do not have access to this page."
 		rmsg := "Return"
 		messagePage(w, r, msg, rmsg, "/")
@@ -37,13 +37,6 @@ func OpenCloseProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if proj.Owner != useremail {
-		msg := "Only the project owner can open or close a project for enrollment."
-		rmsg := "Return to project dashboard"
-		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
-		return
-	}
-
 	tvals := struct {
 		User        string
 		LoggedIn    bool
@@ -51,6 +44,7 @@ func OpenCloseProject(w http.ResponseWriter, r *http.Request) {
 		ProjectName string
 		GroupNames  []string
 		Open        bool
+		Signature   *SignatureForm
 	}{
 		User:        useremail,
 		LoggedIn:    useremail != "",
@@ -58,6 +52,7 @@ func OpenCloseProject(w http.ResponseWriter, r *http.Request) {
 		ProjectName: proj.Name,
 		GroupNames:  proj.GroupNames,
 		Open:        proj.Open,
+		Signature:   proj.signatureForm(MeaningApproved),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "openclose_project.html", tvals); err != nil {
@@ -74,11 +69,10 @@ func OpenCloseCompleted(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := context.Background()
-	useremail := userEmail(r)
 	pkey := r.FormValue("pkey")
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionOpenClose, r) {
 		msg := "You do not have access to this page."
 		rmsg := "Return"
 		messagePage(w, r, msg, rmsg, "/")
@@ -93,14 +87,13 @@ func OpenCloseCompleted(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if proj.Owner != useremail {
-		msg := "Only the project owner can open or close a project for enrollment."
-		rmsg := "Return to project dashboard"
-		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+	sig, ok := requireSignature(ctx, proj, w, r, "/openclose_project?pkey="+pkey)
+	if !ok {
 		return
 	}
 
 	status := r.FormValue("open")
+	wasOpen := proj.Open
 
 	if status == "open" {
 		msg := fmt.Sprintf("The project \"%s\" is now open for enrollment.", proj.Name)
@@ -114,10 +107,26 @@ func OpenCloseCompleted(w http.ResponseWriter, r *http.Request) {
 		proj.Open = false
 	}
 
+	if sig != nil && proj.Open != wasOpen {
+		change := "Project closed for enrollment."
+		if proj.Open {
+			change = "Project opened for enrollment."
+		}
+		comment := &Comment{
+			Commenter: userEmail(r),
+			DateTime:  sig.Time,
+			Comment:   signedComment([]string{change}, sig),
+		}
+		proj.Comments = append(proj.Comments, comment)
+	}
+
+	proj.logSignedAudit(userEmail(r), AuditOpenClose, "", boolYesNo(wasOpen), boolYesNo(proj.Open), sig)
+
 	err = storeProject(ctx, proj, pkey)
 	if err != nil {
 		msg := "Error, the project was not stored."
 		rmsg := "Return to project dashboard"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
 	}
 }
@@ -0,0 +1,210 @@
+package randomize
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Role identifies the level of access that a user has to a project.
+type Role string
+
+const (
+	// RoleViewer can see the project dashboard, statistics and comments.
+	RoleViewer Role = "viewer"
+
+	// RoleEnroller can additionally randomize subjects and add comments.
+	RoleEnroller Role = "enroller"
+
+	// RoleDataManager can additionally edit and remove assignments,
+	// and open or close the project for enrollment.
+	RoleDataManager Role = "data manager"
+
+	// RoleStatistician has read-only access to the unblinded
+	// subject-level data, but cannot randomize subjects.
+	RoleStatistician Role = "unblinded statistician"
+
+	// RoleOwner can perform every action, including managing sharing
+	// and deleting the project.
+	RoleOwner Role = "owner"
+)
+
+// Action identifies something that a user can do to a project.
+type Action int
+
+const (
+	// ActionView covers the project dashboard, statistics and comments.
+	ActionView Action = iota
+
+	// ActionAssign covers randomizing a new subject.
+	ActionAssign
+
+	// ActionComment covers adding a comment.
+	ActionComment
+
+	// ActionViewData covers viewing (or copying) the subject-level data.
+	ActionViewData
+
+	// ActionEditAssignment covers changing an existing group assignment.
+	ActionEditAssignment
+
+	// ActionRemoveSubject covers removing a subject from the study.
+	ActionRemoveSubject
+
+	// ActionOpenClose covers opening or closing the project for enrollment.
+	ActionOpenClose
+
+	// ActionManageSharing covers changing who has access to the project.
+	ActionManageSharing
+
+	// ActionDelete covers deleting the project.
+	ActionDelete
+
+	// ActionTransferOwnership covers giving the project to a new owner.
+	ActionTransferOwnership
+
+	// ActionEditProject covers renaming the project and editing its
+	// protocol information.
+	ActionEditProject
+
+	// ActionAmend covers adding variables, levels or treatment groups
+	// to a running project.
+	ActionAmend
+
+	// ActionReinstate covers returning a removed subject to the study.
+	ActionReinstate
+
+	// ActionCorrect covers correcting the covariates entered for a
+	// randomized subject.
+	ActionCorrect
+)
+
+// rolePermissions lists the actions that are permitted for each role.
+var rolePermissions = map[Role][]Action{
+	RoleViewer:       {ActionView},
+	RoleEnroller:     {ActionView, ActionAssign, ActionComment},
+	RoleStatistician: {ActionView, ActionComment, ActionViewData},
+	RoleDataManager: {ActionView, ActionAssign, ActionComment, ActionViewData,
+		ActionEditAssignment, ActionRemoveSubject, ActionOpenClose},
+	RoleOwner: {ActionView, ActionAssign, ActionComment, ActionViewData,
+		ActionEditAssignment, ActionRemoveSubject, ActionOpenClose,
+		ActionManageSharing, ActionDelete, ActionTransferOwnership,
+		ActionEditProject, ActionAmend, ActionReinstate, ActionCorrect},
+}
+
+// assignableRoles are the roles that the owner can give to other users,
+// in the order that they are presented on the sharing page.
+var assignableRoles = []Role{RoleViewer, RoleEnroller, RoleDataManager, RoleStatistician}
+
+// Can returns true if the role permits the given action.
+func (role Role) Can(action Action) bool {
+	for _, a := range rolePermissions[role] {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// validRole returns true if the role can be assigned to a shared user.
+func validRole(role Role) bool {
+	for _, x := range assignableRoles {
+		if role == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Share describes the access that one user has to a shared project.
+type Share struct {
+
+	// Role is the role that the user has in the project
+	Role Role
+
+	// Expires is the time at which the user loses access to the
+	// project, or the zero time if access does not expire
+	Expires time.Time
+}
+
+// Expired returns true if the share is no longer valid at the given time.
+func (sh Share) Expired(now time.Time) bool {
+	return !sh.Expires.IsZero() && now.After(sh.Expires)
+}
+
+// decodeSharing converts a stored SharingByProject document into a
+// map from user email to share.  Projects that were shared before roles
+// were introduced store true for each user, these users are treated as
+// enrollers, so they can continue to randomize subjects.  Projects
+// shared before expiry dates were introduced store only the role.
+func decodeSharing(data map[string]interface{}) map[string]Share {
+
+	shared := make(map[string]Share)
+	for user, v := range data {
+		switch x := v.(type) {
+		case bool:
+			if x {
+				shared[user] = Share{Role: RoleEnroller}
+			}
+		case string:
+			shared[user] = Share{Role: Role(x)}
+		case map[string]interface{}:
+			role, _ := x["Role"].(string)
+			expires, _ := x["Expires"].(time.Time)
+			shared[user] = Share{Role: Role(role), Expires: expires}
+		}
+	}
+
+	return shared
+}
+
+// encodeSharing converts a map from user email to share into the form
+// that is stored in a SharingByProject document.
+func encodeSharing(shared map[string]Share) map[string]interface{} {
+
+	data := make(map[string]interface{})
+	for user, sh := range shared {
+		v := map[string]interface{}{"Role": string(sh.Role)}
+		if !sh.Expires.IsZero() {
+			v["Expires"] = sh.Expires
+		}
+		data[user] = v
+	}
+
+	return data
+}
+
+// activeRoles returns the role of every user whose share has not
+// expired at the given time.
+func activeRoles(shared map[string]Share, now time.Time) map[string]Role {
+
+	roles := make(map[string]Role)
+	for user, sh := range shared {
+		if !sh.Expired(now) {
+			roles[user] = sh.Role
+		}
+	}
+
+	return roles
+}
+
+// userRole returns the role of the currently logged in user for a
+// project that is shared as described by the given roles, or the empty
+// role if the user has no access.  The owner of a project is stored in
+// its sharing record with the owner role.
+func userRole(shared map[string]Role, r *http.Request) Role {
+
+	email := strings.ToLower(userEmail(r))
+	if email == "" {
+		return ""
+	}
+
+	return shared[email]
+}
+
+// checkPermission returns true if and only if the currently logged in
+// user is allowed to perform the given action on a project that is
+// shared as described by the given roles.
+func checkPermission(shared map[string]Role, action Action, r *http.Request) bool {
+	return userRole(shared, r).Can(action)
+}
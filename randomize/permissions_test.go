@@ -0,0 +1,107 @@
+package randomize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRolePermissions(t *testing.T) {
+
+	if !RoleOwner.Can(ActionDelete) || !RoleOwner.Can(ActionManageSharing) {
+		t.Errorf("owner should be able to delete and manage sharing")
+	}
+
+	for _, role := range assignableRoles {
+		if !role.Can(ActionView) {
+			t.Errorf("role %s should be able to view the project", role)
+		}
+		if role.Can(ActionDelete) || role.Can(ActionManageSharing) {
+			t.Errorf("role %s should not be able to delete or manage sharing", role)
+		}
+	}
+
+	if RoleViewer.Can(ActionAssign) || RoleStatistician.Can(ActionAssign) {
+		t.Errorf("viewers and statisticians should not be able to randomize")
+	}
+
+	if !RoleEnroller.Can(ActionAssign) || RoleEnroller.Can(ActionViewData) {
+		t.Errorf("enrollers should be able to randomize but not view the subject-level data")
+	}
+
+	if RoleEnroller.Can(ActionEditAssignment) || !RoleDataManager.Can(ActionEditAssignment) {
+		t.Errorf("only data managers and owners should be able to edit assignments")
+	}
+
+	if RoleDataManager.Can(ActionReinstate) || !RoleOwner.Can(ActionReinstate) {
+		t.Errorf("only owners should be able to reinstate subjects")
+	}
+
+	if Role("").Can(ActionView) {
+		t.Errorf("the empty role should not be able to do anything")
+	}
+}
+
+func TestDecodeSharing(t *testing.T) {
+
+	data := map[string]interface{}{
+		"a@example.com": true,
+		"b@example.com": "viewer",
+		"c@example.com": false,
+	}
+
+	shared := decodeSharing(data)
+
+	if len(shared) != 2 {
+		t.Errorf("expected 2 shared users, got %d", len(shared))
+	}
+	if shared["a@example.com"].Role != RoleEnroller {
+		t.Errorf("legacy sharing should decode to the enroller role")
+	}
+	if shared["b@example.com"].Role != RoleViewer {
+		t.Errorf("expected viewer role, got '%s'", shared["b@example.com"].Role)
+	}
+
+	// Firestore returns nested maps for shares with expiry dates.
+	expires := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	shared["d@example.com"] = Share{Role: RoleStatistician, Expires: expires}
+	data = encodeSharing(shared)
+
+	back := decodeSharing(data)
+	for k, v := range shared {
+		if back[k].Role != v.Role || !back[k].Expires.Equal(v.Expires) {
+			t.Errorf("round trip changed share for %s", k)
+		}
+	}
+
+	roles := activeRoles(back, expires.Add(time.Hour))
+	if _, ok := roles["d@example.com"]; ok {
+		t.Errorf("expired share should not grant a role")
+	}
+	if roles["b@example.com"] != RoleViewer {
+		t.Errorf("share without expiry should remain active")
+	}
+}
+
+func TestParseEmails(t *testing.T) {
+
+	valid, invalid := parseEmails("A@Example.com, b@example.org,, bob, c@localhost, Bob <d@example.com>")
+
+	if len(valid) != 2 || valid[0] != "a@example.com" || valid[1] != "b@example.org" {
+		t.Errorf("unexpected valid addresses: %v", valid)
+	}
+	if len(invalid) != 3 {
+		t.Errorf("unexpected invalid addresses: %v", invalid)
+	}
+}
+
+func TestSelectInvitations(t *testing.T) {
+
+	invs := []*Invitation{{ID: "a", Pkey: "p"}, {ID: "b", Pkey: "p"}}
+	got := selectInvitations(invs, []string{"b", "other", "a"})
+	if len(got) != 2 || got[0] != "b" || got[1] != "a" {
+		t.Errorf("got %v, want [b a]", got)
+	}
+	if got := selectInvitations(nil, []string{"a"}); got != nil {
+		t.Errorf("got %v for a project without invitations", got)
+	}
+}
@@ -0,0 +1,395 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AllocationPeriod is a span of time during which the set of open
+// treatment groups did not change.  New subjects are balanced only
+// against the subjects assigned during the current period, so that
+// each open group is compared with contemporaneous controls.
+type AllocationPeriod struct {
+
+	// Start is the time at which the period began
+	Start time.Time
+
+	// Open indicates, for each treatment group, whether the group
+	// accepted assignments during this period
+	Open []bool
+
+	// Assignments contains the number of subjects assigned to each
+	// group during this period
+	Assignments []int
+
+	// CellTotals contains the cell counts for subjects assigned
+	// during this period, laid out in the same way as the project
+	// cell totals
+	CellTotals []float64
+}
+
+// ArmEvent records the opening or closing of a treatment group.
+type ArmEvent struct {
+
+	// Group is the name of the treatment group
+	Group string
+
+	// Opened is true if the group was opened, false if it was closed
+	Opened bool
+
+	// Time is the time at which the group was opened or closed
+	Time time.Time
+
+	// User is the person who opened or closed the group
+	User string
+
+	// Reason is the reason given for the change
+	Reason string
+}
+
+// currentPeriod returns the allocation period in which new subjects
+// are assigned, or nil if no treatment group has ever been opened or
+// closed.
+func (proj *Project) currentPeriod() *AllocationPeriod {
+	if len(proj.Periods) == 0 {
+		return nil
+	}
+	return proj.Periods[len(proj.Periods)-1]
+}
+
+// GroupOpen returns true if the given treatment group currently
+// accepts new assignments.
+func (proj *Project) GroupOpen(group int) bool {
+	per := proj.currentPeriod()
+	if per == nil {
+		return true
+	}
+	return per.Open[group]
+}
+
+// openGroups returns the indices of the treatment groups that
+// currently accept new assignments.
+func (proj *Project) openGroups() []int {
+	var ix []int
+	for i := range proj.GroupNames {
+		if proj.GroupOpen(i) {
+			ix = append(ix, i)
+		}
+	}
+	return ix
+}
+
+// balanceCount returns the count that is balanced when assigning new
+// subjects: the number of subjects with the given level of the given
+// variable assigned to the given group during the current period.
+func (proj *Project) balanceCount(variable, level, group int) float64 {
+
+	per := proj.currentPeriod()
+	if per == nil {
+		return proj.GetData(variable, level, group)
+	}
+
+	p := len(proj.Variables)
+	q := len(proj.GroupNames)
+	r := len(per.CellTotals) / (p * q)
+
+	return per.CellTotals[q*r*variable+q*level+group]
+}
+
+// updatePeriodCount adds x to the count for the given subject data
+// and group in the given allocation period.  Nothing is done if the
+// project has no allocation periods.
+func (proj *Project) updatePeriodCount(period int, data []string, group int, x float64) {
+
+	if period < 0 || period >= len(proj.Periods) {
+		return
+	}
+	per := proj.Periods[period]
+
+	per.Assignments[group] += int(x)
+
+	p := len(proj.Variables)
+	q := len(proj.GroupNames)
+	if p == 0 {
+		return
+	}
+	r := len(per.CellTotals) / (p * q)
+
+	for j, va := range proj.Variables {
+		if j >= len(data) {
+			break
+		}
+		k := getIndex(va.Levels, data[j])
+		if k == -1 {
+			continue
+		}
+		per.CellTotals[q*r*j+q*k+group] += x
+	}
+}
+
+// ensurePeriods creates the first allocation period, containing all
+// subjects assigned so far, for a project that has none.  Before the
+// first period is created all groups are open and subjects are
+// balanced against the project totals.
+func (proj *Project) ensurePeriods() {
+
+	if len(proj.Periods) > 0 {
+		return
+	}
+
+	per := &AllocationPeriod{
+		Start:       proj.Created,
+		Open:        make([]bool, len(proj.GroupNames)),
+		Assignments: make([]int, len(proj.Assignments)),
+		CellTotals:  make([]float64, len(proj.CellTotals)),
+	}
+	for i := range per.Open {
+		per.Open[i] = true
+	}
+	copy(per.Assignments, proj.Assignments)
+	copy(per.CellTotals, proj.CellTotals)
+
+	proj.Periods = []*AllocationPeriod{per}
+}
+
+// setGroupOpen opens or closes a treatment group, starting a new
+// allocation period.  Subjects already assigned to a closed group
+// remain in it.
+func (proj *Project) setGroupOpen(group int, open bool, user, reason string, now time.Time) error {
+
+	if group < 0 || group >= len(proj.GroupNames) {
+		return fmt.Errorf("there is no treatment group with index %d", group)
+	}
+
+	proj.ensurePeriods()
+	old := proj.currentPeriod()
+
+	if old.Open[group] == open {
+		if open {
+			return fmt.Errorf("group '%s' is already open", proj.GroupNames[group])
+		}
+		return fmt.Errorf("group '%s' is already closed", proj.GroupNames[group])
+	}
+
+	per := &AllocationPeriod{
+		Start:       now,
+		Open:        make([]bool, len(old.Open)),
+		Assignments: make([]int, len(old.Assignments)),
+		CellTotals:  make([]float64, len(old.CellTotals)),
+	}
+	copy(per.Open, old.Open)
+	per.Open[group] = open
+	proj.Periods = append(proj.Periods, per)
+
+	event := &ArmEvent{
+		Group:  proj.GroupNames[group],
+		Opened: open,
+		Time:   now,
+		User:   user,
+		Reason: reason,
+	}
+	proj.ArmEvents = append(proj.ArmEvents, event)
+
+	return nil
+}
+
+// PeriodView is a printable version of an allocation period.
+type PeriodView struct {
+	Index       int
+	Start       string
+	OpenGroups  string
+	Assignments []string
+}
+
+// formatPeriods returns printable versions of the allocation periods
+// of a project.
+func formatPeriods(proj *Project) []*PeriodView {
+
+	loc, _ := time.LoadLocation("America/New_York")
+
+	var pv []*PeriodView
+	for i, per := range proj.Periods {
+		var open []string
+		for g, o := range per.Open {
+			if o {
+				open = append(open, proj.GroupNames[g])
+			}
+		}
+		var asgn []string
+		for _, n := range per.Assignments {
+			asgn = append(asgn, fmt.Sprintf("%d", n))
+		}
+		pv = append(pv, &PeriodView{
+			Index:       i + 1,
+			Start:       per.Start.In(loc).Format("2006-01-02 3:04 PM"),
+			OpenGroups:  strings.Join(open, ", "),
+			Assignments: asgn,
+		})
+	}
+
+	return pv
+}
+
+// ManageArms displays the status and history of the treatment groups,
+// and allows groups to be opened, closed or added.
+func ManageArms(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionAmend, r) {
+		msg := "Only the project owner can open or close treatment groups."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ManageArms [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	type groupStatus struct {
+		Index       int
+		Name        string
+		Open        bool
+		Assignments int
+	}
+	var groups []groupStatus
+	for i, name := range proj.GroupNames {
+		groups = append(groups, groupStatus{
+			Index:       i,
+			Name:        name,
+			Open:        proj.GroupOpen(i),
+			Assignments: proj.Assignments[i],
+		})
+	}
+
+	tvals := struct {
+		User     string
+		LoggedIn bool
+		Pkey     string
+		Project  *Project
+		Groups   []groupStatus
+	}{
+		User:     useremail,
+		LoggedIn: useremail != "",
+		Pkey:     pkey,
+		Project:  proj,
+		Groups:   groups,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "manage_arms.html", tvals); err != nil {
+		log.Printf("manageArms failed to execute template: %v", err)
+	}
+}
+
+// ManageArmsCompleted opens, closes or adds a treatment group.
+func ManageArmsCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionAmend, r) {
+		msg := "Only the project owner can open or close treatment groups."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ManageArmsCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		msg := "A reason for the change must be provided."
+		rmsg := "Return to treatment groups"
+		messagePage(w, r, msg, rmsg, "/manage_arms?pkey="+pkey)
+		return
+	}
+
+	now := time.Now()
+	var change string
+	switch r.FormValue("action") {
+	case "open", "close":
+		open := r.FormValue("action") == "open"
+		group, _ := strconv.Atoi(r.FormValue("group"))
+		err = proj.setGroupOpen(group, open, useremail, reason, now)
+		if err == nil && open {
+			change = fmt.Sprintf("Treatment group \"%s\" opened.", proj.GroupNames[group])
+		} else if err == nil {
+			change = fmt.Sprintf("Treatment group \"%s\" closed.", proj.GroupNames[group])
+		}
+	case "add":
+		var rate float64
+		rate, err = strconv.ParseFloat(strings.TrimSpace(r.FormValue("group_rate")), 64)
+		if err != nil {
+			err = fmt.Errorf("the sampling rate must be a number")
+			break
+		}
+		name := strings.TrimSpace(r.FormValue("group_name"))
+		if err = proj.addGroup(name, rate); err != nil {
+			break
+		}
+		err = proj.setGroupOpen(len(proj.GroupNames)-1, true, useremail, reason, now)
+		change = fmt.Sprintf("Treatment group \"%s\" added with sampling rate %v.", name, rate)
+	default:
+		err = fmt.Errorf("no change was selected")
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("The treatment groups were not changed: %v.", err)
+		rmsg := "Return to treatment groups"
+		messagePage(w, r, msg, rmsg, "/manage_arms?pkey="+pkey)
+		return
+	}
+
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  now,
+		Comment:   []string{change, reason},
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditSettings, "treatment groups", nil, []string{change, reason})
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("ManageArmsCompleted [2]: %v", err)
+		msg := "Database error, the treatment groups were not changed."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := change + " A new allocation period has started."
+	rmsg := "Return to treatment groups"
+	messagePage(w, r, msg, rmsg, "/manage_arms?pkey="+pkey)
+}
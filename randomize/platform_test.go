@@ -0,0 +1,120 @@
+package randomize
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPlatformArms(t *testing.T) {
+
+	// The open groups are only balanced on average at the default
+	// bias, so the balance is checked over several seeds
+	var diff, newArm int
+	seeds := 20
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		d, n := checkPlatform(t, seed)
+		diff += d
+		newArm += n
+	}
+	if diff > 2*seeds {
+		t.Errorf("open groups differ by %.1f on average", float64(diff)/float64(seeds))
+	}
+	if newArm < 9*seeds {
+		t.Errorf("the new group received %.1f of 30 subjects on average", float64(newArm)/float64(seeds))
+	}
+}
+
+// checkPlatform closes, adds and opens groups of a project assigned
+// with the given seed.  It returns the difference between the two open
+// groups after one is closed, and the number of subjects received by a
+// group that is added to them.
+func checkPlatform(t *testing.T, seed int64) (int, int) {
+
+	levels := [][]string{{"F"}, {"M"}}
+	proj := testProject(t, &Project{
+		GroupNames: []string{"Control", "A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+	}, seed, 30, "a%d", levels)
+
+	assign := func(n int, prefix string) {
+		for i := 0; i < n; i++ {
+			if _, err := proj.doAssignment(testLevels(proj, levels, i), fmt.Sprintf("%s%d", prefix, i), "user"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if len(proj.Periods) != 0 {
+		t.Fatalf("no periods expected before any group is closed")
+	}
+
+	// Close arm A, subjects should only go to Control and B
+	if err := proj.setGroupOpen(1, false, "user", "futility", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.setGroupOpen(1, false, "user", "futility", time.Now()); err == nil {
+		t.Errorf("closing a closed group should fail")
+	}
+	if len(proj.Periods) != 2 || proj.Periods[0].Assignments[1] != proj.Assignments[1] {
+		t.Fatalf("first period should contain the earlier subjects")
+	}
+
+	nA := proj.Assignments[1]
+	assign(20, "b")
+	if proj.Assignments[1] != nA {
+		t.Errorf("subjects were assigned to a closed group")
+	}
+	per := proj.Periods[1]
+	if per.Assignments[0]+per.Assignments[2] != 20 || per.Assignments[1] != 0 {
+		t.Errorf("unexpected period counts %v", per.Assignments)
+	}
+	diff := per.Assignments[0] - per.Assignments[2]
+	if diff < 0 {
+		diff = -diff
+	}
+	for _, rec := range proj.RawData[30:] {
+		if rec.Period != 1 {
+			t.Errorf("record assigned in period %d", rec.Period)
+		}
+	}
+
+	// Add a new arm, it is closed until opened
+	if err := proj.addGroup("D", 1); err != nil {
+		t.Fatal(err)
+	}
+	if proj.GroupOpen(3) {
+		t.Errorf("new group should be closed")
+	}
+	if err := proj.setGroupOpen(3, true, "user", "new arm", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	assign(30, "c")
+	newArm := proj.Periods[2].Assignments[3]
+
+	// Only one open group
+	for _, g := range []int{0, 2} {
+		if err := proj.setGroupOpen(g, false, "user", "", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := proj.Assignments[3]
+	assign(5, "d")
+	if proj.Assignments[3] != n+5 {
+		t.Errorf("all subjects should go to the only open group")
+	}
+
+	if err := proj.setGroupOpen(3, false, "user", "", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proj.doAssignment(map[string]string{"Sex": "F"}, "e", "user"); err == nil {
+		t.Errorf("assignment with no open groups should fail")
+	}
+	if len(proj.ArmEvents) != 5 {
+		t.Errorf("expected 5 arm events, got %d", len(proj.ArmEvents))
+	}
+
+	return diff, newArm
+}
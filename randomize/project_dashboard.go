@@ -1,9 +1,11 @@
 package randomize
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // ProjectDashboard gets the project name from the user.
@@ -19,20 +21,23 @@ func ProjectDashboard(w http.ResponseWriter, r *http.Request) {
 	pkey := r.FormValue("pkey")
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionView, r) {
 		log.Printf("Access check failed")
 		return
 	}
 
-	splkey := splitKey(pkey)
-	owner := splkey[0]
+	role := userRole(susers, r)
 
-	proj, _ := getProjectFromKey(pkey)
+	// The dashboard only shows the settings and counts, so the
+	// subjects and comments are not read
+	proj, _ := getProjectHeader(ctx, pkey)
 	projView := formatProject(proj)
 
 	var sul []string
-	for k := range susers {
-		sul = append(sul, k)
+	for k, v := range susers {
+		if v != RoleOwner {
+			sul = append(sul, fmt.Sprintf("%s (%s)", k, v))
+		}
 	}
 
 	tvals := struct {
@@ -45,9 +50,11 @@ func ProjectDashboard(w http.ResponseWriter, r *http.Request) {
 		Pkey            string
 		ShowEditSharing bool
 		Owner           string
+		Role            Role
 		StoreRawData    string
 		Open            string
 		AnyVars         bool
+		WindowStatus    string
 	}{
 		User:            useremail,
 		LoggedIn:        useremail != "",
@@ -57,13 +64,15 @@ func ProjectDashboard(w http.ResponseWriter, r *http.Request) {
 		Pkey:            pkey,
 		Sharing:         "Nobody",
 		SharedUsers:     sul,
-		ShowEditSharing: owner == useremail,
-		Owner:           owner,
+		ShowEditSharing: role.Can(ActionManageSharing),
+		Owner:           proj.Owner,
+		Role:            role,
 		StoreRawData:    boolYesNo(proj.StoreRawData),
 		Open:            boolYesNo(projView.Open),
+		WindowStatus:    proj.windowStatus(time.Now()),
 	}
 
-	if len(susers) > 0 {
+	if len(sul) > 0 {
 		tvals.Sharing = strings.Join(sul, ", ")
 	}
 
@@ -0,0 +1,195 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// EditProjectInfo is step 1 of renaming a project and editing its
+// protocol information.
+func EditProjectInfo(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionEditProject, r) {
+		msg := "Only the project owner can edit the project information."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EditProjectInfo [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	tvals := struct {
+		User     string
+		LoggedIn bool
+		Pkey     string
+		Project  *Project
+	}{
+		User:     useremail,
+		LoggedIn: useremail != "",
+		Pkey:     pkey,
+		Project:  proj,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "edit_project_info.html", tvals); err != nil {
+		log.Printf("editProjectInfo failed to execute template: %v", err)
+	}
+}
+
+// EditProjectInfoCompleted is step 2 of renaming a project and editing
+// its protocol information.
+func EditProjectInfoCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionEditProject, r) {
+		msg := "Only the project owner can edit the project information."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EditProjectInfoCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+	defer client.Close()
+
+	newName := strings.TrimSpace(r.FormValue("project_name"))
+	if len(newName) == 0 {
+		msg := "The project name may not be blank."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	var changes []string
+	if newName != proj.Name {
+		exists, err := projectNameExists(ctx, client, proj.Owner, newName)
+		if err != nil {
+			log.Printf("EditProjectInfoCompleted [2]: %v", err)
+			msg := "Database error"
+			rmsg := "Return to project dashboard"
+			messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		} else if exists {
+			msg := fmt.Sprintf("A project named \"%s\" belonging to user %s already exists.", newName, proj.Owner)
+			rmsg := "Return to project dashboard"
+			messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		}
+		changes = append(changes, fmt.Sprintf("Project renamed from \"%s\" to \"%s\".", proj.Name, newName))
+		proj.Name = newName
+	}
+
+	fields := []struct {
+		label string
+		name  string
+		value *string
+	}{
+		{"Protocol number", "protocol_number", &proj.ProtocolNumber},
+		{"Principal investigator", "principal_investigator", &proj.PrincipalInvestigator},
+		{"IRB number", "irb_number", &proj.IRBNumber},
+		{"Registration ID", "registration_id", &proj.RegistrationID},
+		{"Description", "description", &proj.Description},
+	}
+	for _, f := range fields {
+		x := strings.TrimSpace(r.FormValue(f.name))
+		if x != *f.value {
+			changes = append(changes, fmt.Sprintf("%s changed from \"%s\" to \"%s\".", f.label, *f.value, x))
+			*f.value = x
+		}
+	}
+
+	requireSignatures := r.FormValue("require_signatures") == "yes"
+	if requireSignatures != proj.RequireSignatures {
+		changes = append(changes, fmt.Sprintf("Electronic signatures for critical actions changed from \"%s\" to \"%s\".",
+			boolYesNo(proj.RequireSignatures), boolYesNo(requireSignatures)))
+		proj.RequireSignatures = requireSignatures
+	}
+
+	requireApproval := r.FormValue("require_approval") == "yes"
+	if requireApproval != proj.RequireApproval {
+		changes = append(changes, fmt.Sprintf("Two-person approval of assignment changes changed from \"%s\" to \"%s\".",
+			boolYesNo(proj.RequireApproval), boolYesNo(requireApproval)))
+		proj.RequireApproval = requireApproval
+	}
+
+	if len(changes) == 0 {
+		msg := "No changes were made."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  time.Now(),
+		Comment:   changes,
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditSettings, "project information", nil, changes)
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("EditProjectInfoCompleted [3]: %v", err)
+		msg := "Database error, the project information was not saved."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	// Pending invitations show the project name
+	invs, err := client.Collection("Invitation").Where("Pkey", "==", pkey).Documents(ctx).GetAll()
+	if err != nil {
+		log.Printf("EditProjectInfoCompleted [4]: %v", err)
+	}
+	for _, doc := range invs {
+		if _, err := doc.Ref.Update(ctx, []firestore.Update{{Path: "ProjectName", Value: proj.Name}}); err != nil {
+			log.Printf("EditProjectInfoCompleted [5]: %v", err)
+		}
+	}
+
+	msg := "The project information has been updated."
+	rmsg := "Return to project dashboard"
+	messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
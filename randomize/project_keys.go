@@ -0,0 +1,189 @@
+package randomize
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// KeyRedirect records the new key of a project that was stored under
+// an "owner::name" key before opaque keys were introduced.
+type KeyRedirect struct {
+
+	// NewKey is the opaque key that the project is now stored under
+	NewKey string
+}
+
+// isLegacyKey returns true if the key was constructed from the owner
+// and name of the project.
+func isLegacyKey(key string) bool {
+	return strings.Contains(key, "::")
+}
+
+// LegacyKeys wraps a handler so that links and bookmarks containing an
+// old "owner::name" project key keep working.  GET requests are
+// redirected to the same page using the new key, for other requests
+// the key is replaced before the handler runs.  Projects that have not
+// yet been moved to an opaque key are moved the first time they are
+// accessed.
+func LegacyKeys(h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		pkey := r.FormValue("pkey")
+		if !isLegacyKey(pkey) {
+			h(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		client, err := firestore.NewClient(ctx, projectID)
+		if err != nil {
+			ServeError(ctx, w, err)
+			return
+		}
+		defer client.Close()
+
+		newkey, err := resolveLegacyKey(ctx, client, pkey)
+		if status.Code(err) == codes.NotFound {
+			msg := "This project does not exist."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		} else if err != nil {
+			log.Printf("LegacyKeys: %v", err)
+			msg := "A database error occurred, the project could not be loaded."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, msg, rmsg, "/dashboard")
+			return
+		}
+
+		if r.Method == "GET" {
+			q := r.URL.Query()
+			q.Set("pkey", newkey)
+			u := *r.URL
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+
+		r.Form.Set("pkey", newkey)
+		h(w, r)
+	}
+}
+
+// resolveLegacyKey returns the opaque key for a project that was
+// stored under the given "owner::name" key, moving the project if
+// this has not already been done.
+func resolveLegacyKey(ctx context.Context, client *firestore.Client, oldkey string) (string, error) {
+
+	doc, err := client.Doc("KeyRedirect/" + oldkey).Get(ctx)
+	if err == nil {
+		var kr KeyRedirect
+		if err := doc.DataTo(&kr); err != nil {
+			return "", err
+		}
+		return kr.NewKey, nil
+	} else if status.Code(err) != codes.NotFound {
+		return "", err
+	}
+
+	doc, err = client.Doc("Project/" + oldkey).Get(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var proj Project
+	if err := doc.DataTo(&proj); err != nil {
+		return "", err
+	}
+	proj.Key = oldkey
+
+	if err := migrateLegacyProject(ctx, client, &proj); err != nil {
+		return "", err
+	}
+
+	return proj.Key, nil
+}
+
+// migrateLegacyProject moves a project from its "owner::name" key to a
+// new opaque key, along with its sharing information and pending
+// invitations, and records a redirect from the old key.  The owner is
+// added to the project's sharing record.  On success the Key field of
+// the project is updated.
+func migrateLegacyProject(ctx context.Context, client *firestore.Client, proj *Project) error {
+
+	oldkey := proj.Key
+	newkey := newProjectKey()
+
+	shares := make(map[string]Share)
+	doc, err := client.Doc("SharingByProject/" + oldkey).Get(ctx)
+	if err == nil {
+		shares = decodeSharing(doc.Data())
+	} else if status.Code(err) != codes.NotFound {
+		return err
+	}
+	shares[strings.ToLower(proj.Owner)] = Share{Role: RoleOwner}
+
+	// The project may have been read without its subjects and
+	// comments, read it again in full so that they are moved too
+	doc, err = client.Doc("Project/" + oldkey).Get(ctx)
+	if err != nil {
+		return err
+	}
+	full, err := loadProject(ctx, client, doc, true)
+	if err != nil {
+		return err
+	}
+
+	err = saveProject(ctx, client, newkey, full, true, func(tx *firestore.Transaction) error {
+		if err := tx.Delete(client.Doc("Project/" + oldkey)); err != nil {
+			return err
+		}
+		if err := tx.Set(client.Doc("SharingByProject/"+newkey), encodeSharing(shares)); err != nil {
+			return err
+		}
+		if err := tx.Delete(client.Doc("SharingByProject/" + oldkey)); err != nil {
+			return err
+		}
+		return tx.Create(client.Doc("KeyRedirect/"+oldkey), &KeyRedirect{NewKey: newkey})
+	})
+	if err != nil {
+		return err
+	}
+	if err := deleteChildren(ctx, client, oldkey); err != nil {
+		return err
+	}
+	log.Printf("Moved project %s to %s", oldkey, newkey)
+
+	// Everyone the project is shared with now refers to the new key
+	for u, sh := range shares {
+		if sh.Role == RoleOwner {
+			continue
+		}
+		if err := setSharingByUser(ctx, client, u, oldkey, false); err != nil {
+			return err
+		}
+		if err := setSharingByUser(ctx, client, u, newkey, true); err != nil {
+			return err
+		}
+	}
+
+	invs, err := client.Collection("Invitation").Where("Pkey", "==", oldkey).Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, doc := range invs {
+		if _, err := doc.Ref.Update(ctx, []firestore.Update{{Path: "Pkey", Value: newkey}}); err != nil {
+			return err
+		}
+	}
+
+	proj.Key = newkey
+	return nil
+}
@@ -10,6 +10,107 @@ import (
 	"golang.org/x/net/context"
 )
 
+// removalCategories are the reasons that can be given for removing a
+// subject from the study.
+var removalCategories = []string{
+	"Withdrew consent",
+	"Adverse event",
+	"Ineligible after randomization",
+	"Protocol deviation",
+	"Investigator decision",
+	"Other",
+}
+
+// removeSubject removes a randomized subject from the study.  Unless
+// retain is true the subject no longer counts toward the balance of
+// new assignments.
+func (proj *Project) removeSubject(rec *DataRecord, category, reason string, retain bool, user string, now time.Time) error {
+
+	if !rec.Included {
+		return fmt.Errorf("subject '%s' has already been removed from the study", rec.SubjectId)
+	}
+	if getIndex(removalCategories, category) == -1 {
+		return fmt.Errorf("a reason category must be selected")
+	}
+	if reason == "" {
+		return fmt.Errorf("a description of the reason must be provided")
+	}
+	if err := rec.setStatus(StatusWithdrawn, user, category+": "+reason, now); err != nil {
+		return err
+	}
+
+	proj.logEvent(&Event{
+		Time:      now,
+		Kind:      EventRemove,
+		SubjectId: rec.SubjectId,
+		Retain:    retain,
+		User:      user,
+	})
+
+	rec.Included = false
+	rec.RemovalCategory = category
+	rec.RemovalReason = reason
+	rec.BalanceRetained = retain
+	proj.RemovedSubjects = append(proj.RemovedSubjects, rec.SubjectId)
+
+	if !retain {
+		removeFromAggregate(rec, proj)
+	}
+
+	return nil
+}
+
+// reinstateSubject returns a removed subject to the study, reversing
+// removeSubject.  A subject who no longer counts toward balance is only
+// reinstated if the enrollment targets allow it.
+func (proj *Project) reinstateSubject(rec *DataRecord, user, reason string, now time.Time) error {
+
+	if rec.Included {
+		return fmt.Errorf("subject '%s' has not been removed from the study", rec.SubjectId)
+	}
+	if reason == "" {
+		return fmt.Errorf("a reason for the reinstatement must be provided")
+	}
+	if getIndex(proj.GroupNames, rec.CurrentGroup) == -1 {
+		return fmt.Errorf("the group '%s' of subject '%s' no longer exists", rec.CurrentGroup, rec.SubjectId)
+	}
+	if err := proj.reinstateError(rec); err != nil {
+		return err
+	}
+
+	proj.logEvent(&Event{
+		Time:      now,
+		Kind:      EventReinstate,
+		SubjectId: rec.SubjectId,
+		User:      user,
+	})
+
+	if !rec.BalanceRetained {
+		addToAggregate(rec, proj)
+	}
+
+	rec.Included = true
+	rec.RemovalCategory = ""
+	rec.RemovalReason = ""
+	rec.BalanceRetained = false
+	rec.Status = StatusRandomized
+	rec.History = append(rec.History, &StatusChange{
+		Status: StatusRandomized,
+		Time:   now,
+		User:   user,
+		Reason: "Reinstated: " + reason,
+	})
+
+	for i, x := range proj.RemovedSubjects {
+		if x == rec.SubjectId {
+			proj.RemovedSubjects = append(proj.RemovedSubjects[0:i], proj.RemovedSubjects[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
 // RemoveSubject is the first step for removing a subject from a project.
 func RemoveSubject(w http.ResponseWriter, r *http.Request) {
 
@@ -23,7 +124,10 @@ func RemoveSubject(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionRemoveSubject, r) {
+		msg := "You don't have permission to remove subjects from this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 		return
 	}
 
@@ -35,13 +139,6 @@ func RemoveSubject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if proj.Owner != useremail {
-		msg := "Only the project owner can change treatment group assignments."
-		rmsg := "Return to project dashboard"
-		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
-		return
-	}
-
 	if !proj.StoreRawData {
 		msg := "Subjects cannot be removed for a project in which the subject-level data is not stored"
 		rmsg := "Return to project dashboard"
@@ -49,6 +146,24 @@ func RemoveSubject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	type removedView struct {
+		SubjectId string
+		Category  string
+		Reason    string
+		Retained  bool
+	}
+	var removed []removedView
+	for _, rec := range proj.RawData {
+		if !rec.Included {
+			removed = append(removed, removedView{
+				SubjectId: rec.SubjectId,
+				Category:  rec.RemovalCategory,
+				Reason:    rec.RemovalReason,
+				Retained:  rec.BalanceRetained,
+			})
+		}
+	}
+
 	tvals := struct {
 		User               string
 		LoggedIn           bool
@@ -56,11 +171,15 @@ func RemoveSubject(w http.ResponseWriter, r *http.Request) {
 		ProjectName        string
 		AnyRemovedSubjects bool
 		RemovedSubjects    string
+		Removed            []removedView
+		CanReinstate       bool
 	}{
-		User:        useremail,
-		LoggedIn:    useremail != "",
-		Pkey:        pkey,
-		ProjectName: proj.Name,
+		User:         useremail,
+		LoggedIn:     useremail != "",
+		Pkey:         pkey,
+		ProjectName:  proj.Name,
+		Removed:      removed,
+		CanReinstate: checkPermission(susers, ActionReinstate, r),
 	}
 
 	if len(proj.RemovedSubjects) > 0 {
@@ -84,17 +203,19 @@ func RemoveSubjectConfirm(w http.ResponseWriter, r *http.Request) {
 	useremail := userEmail(r)
 	pkey := r.FormValue("pkey")
 	subjectId := r.FormValue("subject_id")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
 
-	proj, err := getProjectFromKey(pkey)
-	if err != nil {
-		msg := "Datastore error: unable to retrieve project."
+	if !checkPermission(susers, ActionRemoveSubject, r) {
+		msg := "You don't have permission to remove subjects from this project."
 		rmsg := "Return to project dashboard"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 		return
 	}
 
-	if proj.Owner != useremail {
-		msg := "Only the project owner can remove treatment group assignments that have already been made."
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		msg := "Datastore error: unable to retrieve project."
 		rmsg := "Return to project dashboard"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 		return
@@ -111,14 +232,7 @@ func RemoveSubjectConfirm(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if the subject exists
-	found := false
-	for _, rec := range proj.RawData {
-		if rec.SubjectId == subjectId {
-			found = true
-			break
-		}
-	}
-	if !found {
+	if proj.findSubject(subjectId) == nil {
 		msg := fmt.Sprintf("There is no subject with id '%s' in the project.", subjectId)
 		rmsg := "Return to project"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
@@ -131,12 +245,18 @@ func RemoveSubjectConfirm(w http.ResponseWriter, r *http.Request) {
 		Pkey        string
 		SubjectId   string
 		ProjectName string
+		Categories  []string
+		Signature   *SignatureForm
+		Approval    bool
 	}{
 		User:        useremail,
 		LoggedIn:    useremail != "",
 		SubjectId:   subjectId,
 		Pkey:        pkey,
 		ProjectName: proj.Name,
+		Categories:  removalCategories,
+		Signature:   proj.signatureForm(MeaningApproved),
+		Approval:    proj.RequireApproval,
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "remove_subject_confirm.html", tvals); err != nil {
@@ -157,7 +277,7 @@ func RemoveSubjectCompleted(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionRemoveSubject, r) {
 		msg := "You do not have access to this page."
 		rmsg := "Return"
 		messagePage(w, r, msg, rmsg, "/")
@@ -172,49 +292,65 @@ func RemoveSubjectCompleted(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if proj.Owner != useremail {
-		msg := "Only the project owner can remove treatment group assignments that have already been made."
+	if !proj.StoreRawData {
+		msg := "Subjects cannot be removed for a project in which the subject level data is not stored"
 		rmsg := "Return to project dashboard"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 		return
 	}
 
-	if !proj.StoreRawData {
-		msg := "Subjects cannot be removed for a project in which the subject level data is not stored"
+	subjectId := r.FormValue("subject_id")
+	category := r.FormValue("category")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	retain := r.FormValue("retain_balance") == "yes"
+
+	rec := proj.findSubject(subjectId)
+	if rec == nil {
+		msg := fmt.Sprintf("Unable to remove subject '%s' from the project.", subjectId)
 		rmsg := "Return to project dashboard"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 		return
 	}
 
-	subjectId := r.FormValue("subject_id")
-	found := false
-	var removeRec *DataRecord
-	for _, rec := range proj.RawData {
-		if rec.SubjectId == subjectId {
-			rec.Included = false
-			removeRec = rec
-			found = true
-			break
+	sig, ok := requireSignature(ctx, proj, w, r, "/remove_subject?pkey="+pkey)
+	if !ok {
+		return
+	}
+
+	if proj.RequireApproval {
+		req := &ChangeRequest{
+			Kind:          RequestRemove,
+			SubjectId:     subjectId,
+			Category:      category,
+			Reason:        reason,
+			RetainBalance: retain,
 		}
+		submitChangeRequest(ctx, proj, pkey, req, sig, w, r)
+		return
 	}
 
-	if !found {
-		msg := fmt.Sprintf("Unable to remove subject '%s' from the project.", subjectId)
+	now := time.Now()
+	if err := proj.removeSubject(rec, category, reason, retain, useremail, now); err != nil {
+		msg := fmt.Sprintf("Subject '%s' was not removed: %v.", subjectId, err)
 		rmsg := "Return to project dashboard"
 		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 		return
 	}
 
-	proj.RemovedSubjects = append(proj.RemovedSubjects, subjectId)
-
+	change := fmt.Sprintf("Subject '%s' removed from the project (%s).", subjectId, category)
+	if retain {
+		change += " The subject still counts toward the balance of new assignments."
+	}
 	comment := &Comment{
 		Commenter: useremail,
-		DateTime:  time.Now(),
-		Comment:   []string{fmt.Sprintf("Subject '%s' removed from the project.", subjectId)},
+		DateTime:  now,
+		Comment:   signedComment([]string{change, reason}, sig),
 	}
 	proj.Comments = append(proj.Comments, comment)
 
-	removeFromAggregate(removeRec, proj)
+	proj.logSignedAudit(useremail, AuditRemove, subjectId, StatusRandomized, map[string]interface{}{
+		"Category": category, "Reason": reason, "BalanceRetained": retain,
+	}, sig)
 
 	if err := storeProject(ctx, proj, pkey); err != nil {
 		msg := "Error, unable to save project."
@@ -227,3 +363,139 @@ func RemoveSubjectCompleted(w http.ResponseWriter, r *http.Request) {
 	rmsg := "Return to project dashboard"
 	messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
 }
+
+// ReinstateSubject is the first step for returning a removed subject
+// to the study.
+func ReinstateSubject(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	subjectId := r.FormValue("subject_id")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionReinstate, r) {
+		msg := "Only the project owner can reinstate removed subjects."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ReinstateSubject [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	rec := proj.findSubject(subjectId)
+	if rec == nil || rec.Included {
+		msg := fmt.Sprintf("There is no removed subject with id '%s' in the project.", subjectId)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Pkey        string
+		ProjectName string
+		Record      *DataRecord
+	}{
+		User:        useremail,
+		LoggedIn:    useremail != "",
+		Pkey:        pkey,
+		ProjectName: proj.Name,
+		Record:      rec,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "reinstate_subject.html", tvals); err != nil {
+		log.Printf("reinstateSubject failed to execute template: %v", err)
+	}
+}
+
+// ReinstateSubjectCompleted returns a removed subject to the study.
+func ReinstateSubjectCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	subjectId := r.FormValue("subject_id")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionReinstate, r) {
+		msg := "Only the project owner can reinstate removed subjects."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("ReinstateSubjectCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	rec := proj.findSubject(subjectId)
+	if rec == nil {
+		msg := fmt.Sprintf("There is no subject with id '%s' in the project.", subjectId)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	category, retained := rec.RemovalCategory, rec.BalanceRetained
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	now := time.Now()
+	if err := proj.reinstateSubject(rec, useremail, reason, now); err != nil {
+		msg := fmt.Sprintf("Subject '%s' was not reinstated: %v.", subjectId, err)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	change := fmt.Sprintf("Subject '%s' reinstated in group '%s', reversing the removal (%s).", subjectId, rec.CurrentGroup, category)
+	if !retained {
+		change += " The subject again counts toward the balance of new assignments."
+	}
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  now,
+		Comment:   []string{change, reason},
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditReinstate, subjectId, map[string]interface{}{
+		"Category": category, "BalanceRetained": retained,
+	}, map[string]interface{}{
+		"Group": rec.CurrentGroup, "Reason": reason,
+	})
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("ReinstateSubjectCompleted [2]: %v", err)
+		msg := "Database error, the subject was not reinstated."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("Subject '%s' has been reinstated.", subjectId)
+	rmsg := "Return to project dashboard"
+	messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
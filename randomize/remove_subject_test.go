@@ -0,0 +1,97 @@
+package randomize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemoveReinstate(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+	}, 1, 10, "", [][]string{{"F"}, {"M"}})
+	cells := cellCopy(proj)
+	now := time.Now()
+
+	rec := proj.findSubject("3")
+	if err := proj.removeSubject(rec, "Other", "", false, "user", now); err == nil {
+		t.Errorf("a removal without a description should fail")
+	}
+	if err := proj.removeSubject(rec, "Bored", "no reason", false, "user", now); err == nil {
+		t.Errorf("a removal with an unknown category should fail")
+	}
+
+	// Removed without retaining balance, then reinstated
+	if err := proj.removeSubject(rec, "Withdrew consent", "moved away", false, "user", now); err != nil {
+		t.Fatal(err)
+	}
+	if proj.NumAssignments() != 9 || rec.CurrentStatus() != StatusWithdrawn {
+		t.Errorf("subject 3 was not removed")
+	}
+	if err := proj.reinstateSubject(rec, "owner", "entered in error", now); err != nil {
+		t.Fatal(err)
+	}
+	if proj.NumAssignments() != 10 || rec.CurrentStatus() != StatusRandomized || len(proj.RemovedSubjects) != 0 {
+		t.Errorf("subject 3 was not reinstated")
+	}
+	checkCells(t, proj, cells)
+
+	// Removed retaining balance, then reinstated
+	if err := proj.removeSubject(rec, "Adverse event", "rash", true, "user", now); err != nil {
+		t.Fatal(err)
+	}
+	if proj.NumAssignments() != 10 {
+		t.Errorf("subject 3 should still count toward balance")
+	}
+	if err := proj.reinstateSubject(rec, "owner", "resolved", now); err != nil {
+		t.Fatal(err)
+	}
+	if proj.NumAssignments() != 10 {
+		t.Errorf("subject 3 was counted twice")
+	}
+	checkCells(t, proj, cells)
+
+	if err := proj.reinstateSubject(rec, "owner", "again", now); err == nil {
+		t.Errorf("an included subject should not be reinstated")
+	}
+}
+
+func TestReinstateTargets(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+		TargetTotal: 4,
+	}, 1, 4, "", [][]string{{"F"}, {"M"}})
+	now := time.Now()
+
+	rec := proj.findSubject("1")
+	if err := proj.removeSubject(rec, "Withdrew consent", "moved away", false, "user", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proj.doAssignment(map[string]string{"Sex": "F"}, "5", "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The place of subject 1 has been taken
+	if err := proj.reinstateSubject(rec, "owner", "entered in error", now); err == nil {
+		t.Errorf("the reinstatement exceeds the target sample size")
+	}
+	if proj.NumAssignments() != 4 || rec.Included {
+		t.Errorf("a refused reinstatement changed the project")
+	}
+
+	// A subject removed with the balance retained has kept its place
+	rec = proj.findSubject("2")
+	if err := proj.removeSubject(rec, "Adverse event", "rash", true, "user", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.reinstateSubject(rec, "owner", "resolved", now); err != nil {
+		t.Errorf("subject 2 should be reinstated: %v", err)
+	}
+}
@@ -0,0 +1,427 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTimeZone is used for enrollment windows that do not
+	// specify a time zone
+	defaultTimeZone = "America/New_York"
+)
+
+// EnrollmentWindow restricts the times at which a project accepts
+// randomizations.  A zero value places no restriction.
+type EnrollmentWindow struct {
+
+	// Start is the time at which enrollment opens, no restriction if zero
+	Start time.Time
+
+	// End is the time at which enrollment closes, no restriction if zero
+	End time.Time
+
+	// Days contains the days of the week (0 is Sunday) on which
+	// enrollment is possible, every day if empty
+	Days []int
+
+	// OpenMinute and CloseMinute give the daily enrollment hours, as
+	// minutes after midnight.  Enrollment is possible all day if both
+	// are zero.
+	OpenMinute  int
+	CloseMinute int
+
+	// TimeZone is the time zone of the daily hours
+	TimeZone string
+}
+
+// location returns the time zone of the window.
+func (win *EnrollmentWindow) location() *time.Location {
+
+	tz := win.TimeZone
+	if tz == "" {
+		tz = defaultTimeZone
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Printf("Unknown time zone %s: %v", tz, err)
+		return time.UTC
+	}
+
+	return loc
+}
+
+// hasHours returns true if enrollment is limited to certain hours of
+// the day.
+func (win *EnrollmentWindow) hasHours() bool {
+	return win.OpenMinute != 0 || win.CloseMinute != 0
+}
+
+// IsOpen returns true if enrollment is possible at the given time.
+func (win *EnrollmentWindow) IsOpen(t time.Time) bool {
+
+	if !win.Start.IsZero() && t.Before(win.Start) {
+		return false
+	}
+	if !win.End.IsZero() && !t.Before(win.End) {
+		return false
+	}
+
+	lt := t.In(win.location())
+
+	if len(win.Days) > 0 {
+		ok := false
+		for _, d := range win.Days {
+			if int(lt.Weekday()) == d {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if win.hasHours() {
+		m := 60*lt.Hour() + lt.Minute()
+		if m < win.OpenMinute || m >= win.CloseMinute {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NextChange returns the next time after t at which enrollment opens
+// or closes.  The second return value is false if there is no such
+// time.
+func (win *EnrollmentWindow) NextChange(t time.Time) (time.Time, bool) {
+
+	var cand []time.Time
+	if !win.Start.IsZero() {
+		cand = append(cand, win.Start)
+	}
+	if !win.End.IsZero() {
+		cand = append(cand, win.End)
+	}
+
+	// Daily changes within two weeks of the later of t and the start
+	// of the window.
+	loc := win.location()
+	base := t
+	if win.Start.After(base) {
+		base = win.Start
+	}
+	base = base.In(loc)
+	day := time.Date(base.Year(), base.Month(), base.Day(), 0, 0, 0, 0, loc)
+	for i := 0; i < 15; i++ {
+		d := day.AddDate(0, 0, i)
+		cand = append(cand, d)
+		if win.hasHours() {
+			cand = append(cand, d.Add(time.Duration(win.OpenMinute)*time.Minute))
+			cand = append(cand, d.Add(time.Duration(win.CloseMinute)*time.Minute))
+		}
+	}
+
+	sort.Slice(cand, func(i, j int) bool { return cand[i].Before(cand[j]) })
+
+	now := win.IsOpen(t)
+	for _, c := range cand {
+		if c.After(t) && win.IsOpen(c) != now {
+			return c, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Describe returns a printable description of the window, or an empty
+// string if there is no restriction.
+func (win *EnrollmentWindow) Describe() string {
+
+	loc := win.location()
+	var parts []string
+	if !win.Start.IsZero() {
+		parts = append(parts, "from "+win.Start.In(loc).Format("2006-01-02 15:04"))
+	}
+	if !win.End.IsZero() {
+		parts = append(parts, "until "+win.End.In(loc).Format("2006-01-02 15:04"))
+	}
+	if len(win.Days) > 0 {
+		var days []string
+		for _, d := range win.Days {
+			days = append(days, time.Weekday(d).String()[0:3])
+		}
+		parts = append(parts, "on "+strings.Join(days, ", "))
+	}
+	if win.hasHours() {
+		parts = append(parts, fmt.Sprintf("between %s and %s", formatMinute(win.OpenMinute), formatMinute(win.CloseMinute)))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+
+	return strings.Join(parts, ", ") + " (" + loc.String() + ")"
+}
+
+// formatMinute formats minutes after midnight as HH:MM.
+func formatMinute(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+// parseMinute parses a time of day of the form HH:MM into minutes
+// after midnight.
+func parseMinute(s string) (int, error) {
+
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a time of the form HH:MM", s)
+	}
+
+	return 60*t.Hour() + t.Minute(), nil
+}
+
+// windowStatus returns a sentence describing whether enrollment is
+// currently possible and when this next changes, or an empty string if
+// the project has no enrollment window.
+func (proj *Project) windowStatus(now time.Time) string {
+
+	win := &proj.Window
+	if win.Describe() == "" {
+		return ""
+	}
+
+	var msg string
+	if win.IsOpen(now) {
+		msg = "The enrollment window is open"
+	} else {
+		msg = "The enrollment window is closed"
+	}
+
+	next, ok := win.NextChange(now)
+	if !ok {
+		return msg + "."
+	}
+	if win.IsOpen(now) {
+		msg += ", it closes at "
+	} else {
+		msg += ", it opens at "
+	}
+
+	return msg + next.In(win.location()).Format("2006-01-02 15:04 MST") + "."
+}
+
+// EditWindow displays a form for setting the enrollment window.
+func EditWindow(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionOpenClose, r) {
+		msg := "You don't have permission to change the enrollment window of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EditWindow [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	win := &proj.Window
+	loc := win.location()
+
+	type dayView struct {
+		Index   int
+		Name    string
+		Checked bool
+	}
+	var days []dayView
+	for d := 0; d < 7; d++ {
+		dv := dayView{Index: d, Name: time.Weekday(d).String()}
+		for _, x := range win.Days {
+			if x == d {
+				dv.Checked = true
+			}
+		}
+		days = append(days, dv)
+	}
+
+	tvals := struct {
+		User      string
+		LoggedIn  bool
+		Pkey      string
+		Project   *Project
+		Start     string
+		End       string
+		Days      []dayView
+		OpenTime  string
+		CloseTime string
+		TimeZone  string
+		Status    string
+	}{
+		User:     useremail,
+		LoggedIn: useremail != "",
+		Pkey:     pkey,
+		Project:  proj,
+		Days:     days,
+		TimeZone: loc.String(),
+		Status:   proj.windowStatus(time.Now()),
+	}
+	if !win.Start.IsZero() {
+		tvals.Start = win.Start.In(loc).Format("2006-01-02T15:04")
+	}
+	if !win.End.IsZero() {
+		tvals.End = win.End.In(loc).Format("2006-01-02T15:04")
+	}
+	if win.hasHours() {
+		tvals.OpenTime = formatMinute(win.OpenMinute)
+		tvals.CloseTime = formatMinute(win.CloseMinute)
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "edit_window.html", tvals); err != nil {
+		log.Printf("editWindow failed to execute template: %v", err)
+	}
+}
+
+// EditWindowCompleted stores the enrollment window.
+func EditWindowCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionOpenClose, r) {
+		msg := "You don't have permission to change the enrollment window of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EditWindowCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	win, err := parseWindow(r)
+	if err != nil {
+		msg := fmt.Sprintf("The enrollment window was not changed: %v.", err)
+		rmsg := "Return to enrollment window"
+		messagePage(w, r, msg, rmsg, "/edit_window?pkey="+pkey)
+		return
+	}
+	before := proj.Window.Describe()
+	proj.Window = *win
+
+	desc := win.Describe()
+	if desc == "" {
+		desc = "no restriction"
+	}
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  time.Now(),
+		Comment:   []string{"Enrollment window set: " + desc + "."},
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditSettings, "enrollment window", before, desc)
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("EditWindowCompleted [2]: %v", err)
+		msg := "Database error, the enrollment window was not saved."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := "The enrollment window has been updated."
+	rmsg := "Return to project dashboard"
+	messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
+
+// parseWindow reads an enrollment window from the submitted form.
+func parseWindow(r *http.Request) (*EnrollmentWindow, error) {
+
+	win := &EnrollmentWindow{
+		TimeZone: strings.TrimSpace(r.FormValue("time_zone")),
+	}
+	if win.TimeZone == "" {
+		win.TimeZone = defaultTimeZone
+	}
+	loc, err := time.LoadLocation(win.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a known time zone", win.TimeZone)
+	}
+
+	if x := strings.TrimSpace(r.FormValue("start")); x != "" {
+		win.Start, err = time.ParseInLocation("2006-01-02T15:04", x, loc)
+		if err != nil {
+			return nil, fmt.Errorf("the start must be a date and time")
+		}
+	}
+	if x := strings.TrimSpace(r.FormValue("end")); x != "" {
+		win.End, err = time.ParseInLocation("2006-01-02T15:04", x, loc)
+		if err != nil {
+			return nil, fmt.Errorf("the end must be a date and time")
+		}
+	}
+	if !win.Start.IsZero() && !win.End.IsZero() && !win.End.After(win.Start) {
+		return nil, fmt.Errorf("the end must be after the start")
+	}
+
+	for _, x := range r.Form["days"] {
+		d, err := strconv.Atoi(x)
+		if err != nil || d < 0 || d > 6 {
+			return nil, fmt.Errorf("invalid day of the week")
+		}
+		win.Days = append(win.Days, d)
+	}
+
+	openTime := strings.TrimSpace(r.FormValue("open_time"))
+	closeTime := strings.TrimSpace(r.FormValue("close_time"))
+	if openTime != "" || closeTime != "" {
+		if win.OpenMinute, err = parseMinute(openTime); err != nil {
+			return nil, err
+		}
+		if win.CloseMinute, err = parseMinute(closeTime); err != nil {
+			return nil, err
+		}
+		if win.CloseMinute <= win.OpenMinute {
+			return nil, fmt.Errorf("the daily closing time must be after the opening time")
+		}
+	}
+
+	return win, nil
+}
@@ -0,0 +1,72 @@
+package randomize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnrollmentWindow(t *testing.T) {
+
+	loc, _ := time.LoadLocation(defaultTimeZone)
+	at := func(s string) time.Time {
+		x, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return x
+	}
+
+	var none EnrollmentWindow
+	if !none.IsOpen(at("2024-01-01 03:00")) || none.Describe() != "" {
+		t.Errorf("an empty window places no restriction")
+	}
+	if _, ok := none.NextChange(at("2024-01-01 03:00")); ok {
+		t.Errorf("an empty window never changes")
+	}
+
+	// Weekdays 9:00-17:00 during March 2024
+	win := EnrollmentWindow{
+		Start:       at("2024-03-01 00:00"),
+		End:         at("2024-04-01 00:00"),
+		Days:        []int{1, 2, 3, 4, 5},
+		OpenMinute:  9 * 60,
+		CloseMinute: 17 * 60,
+	}
+
+	checks := []struct {
+		t    string
+		open bool
+		next string
+	}{
+		{"2024-02-20 10:00", false, "2024-03-01 09:00"}, // before the start, March 1 is a Friday
+		{"2024-03-01 10:00", true, "2024-03-01 17:00"},
+		{"2024-03-01 17:00", false, "2024-03-04 09:00"}, // closing time, next is Monday
+		{"2024-03-02 12:00", false, "2024-03-04 09:00"}, // Saturday
+		{"2024-03-29 16:00", true, "2024-03-29 17:00"},
+		{"2024-03-29 18:00", false, ""}, // never opens again
+	}
+
+	for _, c := range checks {
+		x := at(c.t)
+		if win.IsOpen(x) != c.open {
+			t.Errorf("%s: expected open=%v", c.t, c.open)
+		}
+		next, ok := win.NextChange(x)
+		if c.next == "" {
+			if ok {
+				t.Errorf("%s: expected no further change, got %v", c.t, next)
+			}
+		} else if !ok || !next.Equal(at(c.next)) {
+			t.Errorf("%s: expected next change at %s, got %v", c.t, c.next, next)
+		}
+	}
+
+	if win.Describe() == "" {
+		t.Errorf("expected a description")
+	}
+
+	m, err := parseMinute("08:30")
+	if err != nil || m != 510 || formatMinute(m) != "08:30" {
+		t.Errorf("parseMinute: %d %v", m, err)
+	}
+}
@@ -0,0 +1,198 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+)
+
+// migration upgrades a project from the previous schema version.
+// Fields that were added to the Project struct decode as zero values
+// from older documents, so migrations are given the names of the
+// fields present in the stored document to tell a missing field from
+// one that is false or empty.
+type migration struct {
+
+	// Description describes the change in the stored shape
+	Description string
+
+	// Apply upgrades the project, it may be nil if the project only
+	// needs to be stored again
+	Apply func(proj *Project, fields map[string]bool)
+}
+
+// migrations contains the upgrades of the stored project shape, in
+// order.  A project with schema version v has had the first v
+// migrations applied.  New migrations are added at the end.
+var migrations = []migration{
+	{
+		Description: "Record removed subjects",
+		Apply: func(proj *Project, fields map[string]bool) {
+			if fields["RemovedSubjects"] {
+				return
+			}
+			// Subjects could not be removed, or moved to another
+			// group, before removals were recorded
+			for _, rec := range proj.RawData {
+				rec.Included = true
+				if rec.CurrentGroup == "" {
+					rec.CurrentGroup = rec.AssignedGroup
+				}
+			}
+			proj.RemovedSubjects = []string{}
+		},
+	},
+	{
+		Description: "Open and close enrollment",
+		Apply: func(proj *Project, fields map[string]bool) {
+			// Projects were always open before they could be closed
+			if !fields["Open"] {
+				proj.Open = true
+			}
+		},
+	},
+	{
+		Description: "Sampling rates for each treatment group",
+		Apply: func(proj *Project, fields map[string]bool) {
+			for len(proj.SamplingRates) < len(proj.GroupNames) {
+				proj.SamplingRates = append(proj.SamplingRates, 1)
+			}
+		},
+	},
+	{
+		// The subjects are moved by storeProject, see storage.go
+		Description: "Store subjects, comments and events as separate documents",
+	},
+}
+
+// currentSchemaVersion is the schema version of projects stored by
+// this version of the application.
+var currentSchemaVersion = len(migrations)
+
+// migrate applies the migrations that have not yet been applied to a
+// project, and returns their descriptions.  fields contains the names
+// of the fields of the stored project document.
+func (proj *Project) migrate(fields map[string]bool) []string {
+
+	var applied []string
+	for v := proj.SchemaVersion; v < len(migrations); v++ {
+		m := migrations[v]
+		if m.Apply != nil {
+			m.Apply(proj, fields)
+		}
+		applied = append(applied, m.Description)
+	}
+	if proj.SchemaVersion < currentSchemaVersion {
+		proj.SchemaVersion = currentSchemaVersion
+	}
+
+	return applied
+}
+
+// upgrade applies the outstanding migrations to a project read from
+// a stored document.
+func (proj *Project) upgrade(ds *firestore.DocumentSnapshot) {
+	if proj.SchemaVersion >= currentSchemaVersion {
+		return
+	}
+	applied := proj.migrate(documentFields(ds))
+	log.Printf("Upgraded project %s: %v", proj.Key, applied)
+}
+
+// documentFields returns the names of the fields of a stored document.
+func documentFields(ds *firestore.DocumentSnapshot) map[string]bool {
+	fields := make(map[string]bool)
+	for f := range ds.Data() {
+		fields[f] = true
+	}
+	return fields
+}
+
+// storedSchemaVersion returns the schema version of a stored project
+// document.
+func storedSchemaVersion(ds *firestore.DocumentSnapshot) int {
+	v, err := ds.DataAt("SchemaVersion")
+	if err != nil {
+		return 0
+	}
+	n, _ := v.(int64)
+	return int(n)
+}
+
+// upgradeProject reads a project, applies any outstanding migrations
+// and stores it again.  It returns false if the project was already
+// current.
+func upgradeProject(ctx context.Context, client *firestore.Client, pkey string) (bool, error) {
+
+	ds, err := client.Doc("Project/" + pkey).Get(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !hasEmbedded(ds) && storedSchemaVersion(ds) >= currentSchemaVersion {
+		return false, nil
+	}
+
+	// Migrations are applied by loadProject
+	proj, err := loadProject(ctx, client, ds, true)
+	if err != nil {
+		return false, err
+	}
+
+	if err := saveProject(ctx, client, pkey, proj, false, nil); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// MigrateProjects upgrades all projects owned by the current user to
+// the current schema version.  Projects are otherwise upgraded when
+// they are read, and stored in the current shape when they are next
+// changed.
+func MigrateProjects(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	ctx := r.Context()
+
+	projects, err := getProjects(ctx, useremail, false)
+	if err != nil {
+		log.Printf("MigrateProjects [1]: %v", err)
+		msg := "Datastore error: unable to retrieve your projects."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	}
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+	defer client.Close()
+
+	var upgraded, failed int
+	for _, proj := range projects {
+		ok, err := upgradeProject(ctx, client, proj.Key)
+		if err != nil {
+			log.Printf("MigrateProjects [2]: %s: %v", proj.Key, err)
+			failed++
+		} else if ok {
+			upgraded++
+		}
+	}
+
+	msg := fmt.Sprintf("%d of your %d projects were upgraded to the current storage format.", upgraded, len(projects))
+	if failed > 0 {
+		msg += fmt.Sprintf(" %d projects could not be upgraded and will be upgraded when they are next changed.", failed)
+	}
+	rmsg := "Return to dashboard"
+	messagePage(w, r, msg, rmsg, "/dashboard")
+}
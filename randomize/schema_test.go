@@ -0,0 +1,164 @@
+package randomize
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Stored projects in each of their historical shapes
+var schemaFixtures = map[string]string{
+
+	// Before subjects could be removed
+	"original": `{
+		"Owner": "owner@example.com", "Name": "original",
+		"Created": "2015-03-01T10:00:00Z", "Modified": "2015-03-02T10:00:00Z",
+		"GroupNames": ["A", "B"],
+		"Variables": [{"Name": "Sex", "Levels": ["F", "M"], "Weight": 1}],
+		"Assignments": [1, 1], "CellTotals": [1, 0, 1, 0], "Bias": 1,
+		"StoreRawData": true,
+		"RawData": [
+			{"SubjectId": "1", "AssignedTime": "2015-03-02T09:00:00Z", "AssignedGroup": "A", "Data": ["F"], "Assigner": "owner@example.com"},
+			{"SubjectId": "2", "AssignedTime": "2015-03-02T10:00:00Z", "AssignedGroup": "B", "Data": ["F"], "Assigner": "owner@example.com"}
+		]
+	}`,
+
+	// Before enrollment could be closed
+	"removed": `{
+		"Owner": "owner@example.com", "Name": "removed",
+		"Created": "2016-03-01T10:00:00Z", "Modified": "2016-03-02T10:00:00Z",
+		"GroupNames": ["A", "B"],
+		"Variables": [{"Name": "Sex", "Levels": ["F", "M"], "Weight": 1}],
+		"Assignments": [1, 0], "CellTotals": [1, 0, 0, 0], "Bias": 1,
+		"StoreRawData": true,
+		"RawData": [
+			{"SubjectId": "1", "AssignedTime": "2016-03-02T09:00:00Z", "AssignedGroup": "A", "CurrentGroup": "A", "Included": true, "Data": ["F"]},
+			{"SubjectId": "2", "AssignedTime": "2016-03-02T10:00:00Z", "AssignedGroup": "B", "CurrentGroup": "B", "Included": false, "Data": ["F"]}
+		],
+		"RemovedSubjects": ["2"]
+	}`,
+
+	// Before sampling rates
+	"closed": `{
+		"Owner": "owner@example.com", "Name": "closed",
+		"Created": "2017-03-01T10:00:00Z",
+		"GroupNames": ["A", "B", "C"],
+		"Variables": [{"Name": "Sex", "Levels": ["F", "M"], "Weight": 1}],
+		"Assignments": [0, 0, 0], "CellTotals": [0, 0, 0, 0, 0, 0], "Bias": 1,
+		"RemovedSubjects": [],
+		"Open": false
+	}`,
+
+	// Unversioned, with all fields
+	"unversioned": `{
+		"Owner": "owner@example.com", "Name": "unversioned",
+		"Created": "2018-03-01T10:00:00Z",
+		"GroupNames": ["A", "B"],
+		"Variables": [{"Name": "Sex", "Levels": ["F", "M"], "Weight": 1}],
+		"Assignments": [0, 0], "CellTotals": [0, 0, 0, 0], "Bias": 1,
+		"RemovedSubjects": [], "Open": true, "SamplingRates": [2, 1]
+	}`,
+}
+
+// loadFixture decodes a fixture, returning the project and the names
+// of its stored fields.
+func loadFixture(t *testing.T, name string) (*Project, map[string]bool) {
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(schemaFixtures[name]), &raw); err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]bool)
+	for f := range raw {
+		fields[f] = true
+	}
+
+	proj := new(Project)
+	if err := json.Unmarshal([]byte(schemaFixtures[name]), proj); err != nil {
+		t.Fatal(err)
+	}
+
+	return proj, fields
+}
+
+func TestMigrateOriginal(t *testing.T) {
+
+	proj, fields := loadFixture(t, "original")
+	applied := proj.migrate(fields)
+	if len(applied) != len(migrations) || proj.SchemaVersion != currentSchemaVersion {
+		t.Fatalf("got version %d after %v", proj.SchemaVersion, applied)
+	}
+
+	for _, rec := range proj.RawData {
+		if !rec.Included || rec.CurrentGroup != rec.AssignedGroup {
+			t.Errorf("subject %s: included=%v, current group '%s'", rec.SubjectId, rec.Included, rec.CurrentGroup)
+		}
+	}
+	if proj.RemovedSubjects == nil || len(proj.RemovedSubjects) != 0 {
+		t.Errorf("got removed subjects %v", proj.RemovedSubjects)
+	}
+	if !proj.Open {
+		t.Errorf("project is not open")
+	}
+	if !reflect.DeepEqual(proj.SamplingRates, []float64{1, 1}) {
+		t.Errorf("got sampling rates %v", proj.SamplingRates)
+	}
+
+	// The upgraded project can be used
+	if _, err := proj.doAssignment(map[string]string{"Sex": "M"}, "3", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if proj.NumAssignments() != 3 {
+		t.Errorf("got %d assignments, want 3", proj.NumAssignments())
+	}
+}
+
+func TestMigrateRemoved(t *testing.T) {
+
+	proj, fields := loadFixture(t, "removed")
+	proj.migrate(fields)
+
+	// The removed subject stays removed
+	if rec := proj.findSubject("2"); rec.Included {
+		t.Errorf("removed subject was included")
+	}
+	if !reflect.DeepEqual(proj.RemovedSubjects, []string{"2"}) {
+		t.Errorf("got removed subjects %v", proj.RemovedSubjects)
+	}
+	if !proj.Open || len(proj.SamplingRates) != 2 {
+		t.Errorf("got open=%v, sampling rates %v", proj.Open, proj.SamplingRates)
+	}
+}
+
+func TestMigrateClosed(t *testing.T) {
+
+	proj, fields := loadFixture(t, "closed")
+	proj.migrate(fields)
+
+	// A closed project stays closed
+	if proj.Open {
+		t.Errorf("closed project was opened")
+	}
+	if !reflect.DeepEqual(proj.SamplingRates, []float64{1, 1, 1}) {
+		t.Errorf("got sampling rates %v", proj.SamplingRates)
+	}
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+
+	proj, fields := loadFixture(t, "unversioned")
+	proj.migrate(fields)
+
+	// Nothing changes for a project with all of the fields
+	if !proj.Open || !reflect.DeepEqual(proj.SamplingRates, []float64{2, 1}) {
+		t.Errorf("got open=%v, sampling rates %v", proj.Open, proj.SamplingRates)
+	}
+	if proj.SchemaVersion != currentSchemaVersion {
+		t.Errorf("got version %d", proj.SchemaVersion)
+	}
+
+	// A current project is not migrated again
+	if applied := proj.migrate(nil); applied != nil {
+		t.Errorf("current project migrated again: %v", applied)
+	}
+}
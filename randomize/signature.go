@@ -0,0 +1,418 @@
+package randomize
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// The meanings that can be given to an electronic signature
+	MeaningApproved    = "approved"
+	MeaningReviewed    = "reviewed"
+	MeaningResponsible = "responsible"
+)
+
+var signatureMeanings = []string{MeaningApproved, MeaningReviewed, MeaningResponsible}
+
+// signingCollection is the Firestore collection containing the
+// signing credentials, with one document per user
+const signingCollection = "SigningCredential"
+
+// minPINLength is the minimum length of a signing PIN
+const minPINLength = 8
+
+// pinRounds is the number of PBKDF2 iterations used to hash a signing
+// PIN
+const pinRounds = 20000
+
+// Signature is an electronic signature applied to a critical action.
+type Signature struct {
+
+	// Signer is the Google id of the person who signed
+	Signer string
+
+	// PrintedName is the signer's name, as registered with their
+	// signing credential
+	PrintedName string
+
+	// Meaning is the meaning of the signature, e.g. "approved"
+	Meaning string
+
+	// Time is the time of signing
+	Time time.Time
+}
+
+// String returns the printed form of the signature, as it appears in
+// comments and the audit log.
+func (sig *Signature) String() string {
+	return fmt.Sprintf("Signed by %s (%s), %s, %s", sig.PrintedName, sig.Signer, sig.Meaning,
+		sig.Time.UTC().Format("2006-01-02 15:04:05 UTC"))
+}
+
+// SigningCredential is the information used to re-authenticate a
+// user when they sign.  Only a salted hash of the PIN is stored.
+type SigningCredential struct {
+
+	// PrintedName is the name that appears in the user's signatures
+	PrintedName string
+
+	// Salt is the hex encoded salt for the PIN hash
+	Salt string
+
+	// Hash is the hex encoded hash of the PIN
+	Hash string
+
+	// Updated is the time at which the credential was last set
+	Updated time.Time
+}
+
+// hashPIN returns the hex encoded PBKDF2-HMAC-SHA256 hash of a PIN.
+func hashPIN(pin string, salt []byte) string {
+
+	// A single block suffices since the key has the size of the hash
+	mac := hmac.New(sha256.New, []byte(pin))
+	mac.Write(salt)
+	_ = binary.Write(mac, binary.BigEndian, uint32(1))
+	u := mac.Sum(nil)
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < pinRounds; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return hex.EncodeToString(key)
+}
+
+// newCredential returns a signing credential for the given printed
+// name and PIN.
+func newCredential(name, pin string, now time.Time) (*SigningCredential, error) {
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("a printed name must be provided")
+	}
+	if len(pin) < minPINLength {
+		return nil, fmt.Errorf("the PIN must have at least %d characters", minPINLength)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &SigningCredential{
+		PrintedName: name,
+		Salt:        hex.EncodeToString(salt),
+		Hash:        hashPIN(pin, salt),
+		Updated:     now,
+	}, nil
+}
+
+// checkPIN returns true if the PIN matches the credential.
+func (cred *SigningCredential) checkPIN(pin string) bool {
+
+	salt, err := hex.DecodeString(cred.Salt)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(hashPIN(pin, salt)), []byte(cred.Hash))
+}
+
+// sign returns a signature by user, after checking the printed name,
+// meaning and PIN given when signing.
+func (cred *SigningCredential) sign(user, name, meaning, pin string, now time.Time) (*Signature, error) {
+
+	if getIndex(signatureMeanings, meaning) == -1 {
+		return nil, fmt.Errorf("the meaning of the signature must be selected")
+	}
+	if !strings.EqualFold(strings.TrimSpace(name), cred.PrintedName) {
+		return nil, fmt.Errorf("the printed name does not match the name registered for signing")
+	}
+	if !cred.checkPIN(pin) {
+		return nil, fmt.Errorf("the signing PIN is incorrect")
+	}
+
+	return &Signature{
+		Signer:      user,
+		PrintedName: cred.PrintedName,
+		Meaning:     meaning,
+		Time:        now,
+	}, nil
+}
+
+// getCredential returns the signing credential of a user, or nil if
+// they have not set one up.
+func getCredential(ctx context.Context, client *firestore.Client, user string) (*SigningCredential, error) {
+
+	doc, err := client.Collection(signingCollection).Doc(user).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cred := new(SigningCredential)
+	if err := doc.DataTo(cred); err != nil {
+		return nil, err
+	}
+
+	return cred, nil
+}
+
+// signAction re-authenticates the current user using the signature
+// fields of a form, and returns their signature.  The returned error
+// is suitable for showing to the user.
+func signAction(ctx context.Context, r *http.Request) (*Signature, error) {
+
+	user := userEmail(r)
+	if user == "" {
+		return nil, fmt.Errorf("you must be logged in to sign")
+	}
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	cred, err := getCredential(ctx, client, user)
+	if err != nil {
+		log.Printf("signAction: %v", err)
+		return nil, fmt.Errorf("unable to retrieve your signing credential")
+	}
+	if cred == nil {
+		return nil, fmt.Errorf("you have not set up an electronic signature")
+	}
+
+	sig, err := cred.sign(user, r.FormValue("sig_name"), r.FormValue("sig_meaning"), r.FormValue("sig_pin"), time.Now())
+	if err != nil {
+		log.Printf("signAction: failed signature by %s: %v", user, err)
+		return nil, err
+	}
+
+	return sig, nil
+}
+
+// SignatureForm contains the information needed to show the
+// signature fields of a form.
+type SignatureForm struct {
+	Meanings []string
+	Default  string
+}
+
+// signatureForm returns the signature fields for a form, or nil if
+// the project does not require signatures.
+func (proj *Project) signatureForm(meaning string) *SignatureForm {
+
+	if !proj.RequireSignatures {
+		return nil
+	}
+
+	return &SignatureForm{
+		Meanings: signatureMeanings,
+		Default:  meaning,
+	}
+}
+
+// requireSignature returns the signature for a critical action on a
+// project that requires signatures, or nil if signatures are not
+// required.  If the signature is not valid, a message is shown and
+// false is returned.
+func requireSignature(ctx context.Context, proj *Project, w http.ResponseWriter, r *http.Request, retry string) (*Signature, bool) {
+
+	if !proj.RequireSignatures {
+		return nil, true
+	}
+
+	sig, err := signAction(ctx, r)
+	if err != nil {
+		msg := fmt.Sprintf("The signature was not accepted: %v.", err)
+		rmsg := "Return"
+		messagePage(w, r, msg, rmsg, retry)
+		return nil, false
+	}
+
+	return sig, true
+}
+
+// signedComment appends the signature, if any, to the lines of a comment.
+func signedComment(lines []string, sig *Signature) []string {
+	if sig != nil {
+		lines = append(lines, sig.String())
+	}
+	return lines
+}
+
+// signActionPage displays a signature form for an action that is carried
+// out by a GET request, such as viewing unblinded data, when the
+// project requires signatures.  The form posts back to the same page,
+// keeping the query parameters.
+func signActionPage(w http.ResponseWriter, r *http.Request, proj *Project, description string) {
+
+	useremail := userEmail(r)
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Pkey        string
+		ProjectName string
+		Action      string
+		Description string
+		Signature   *SignatureForm
+	}{
+		User:        useremail,
+		LoggedIn:    useremail != "",
+		Pkey:        proj.Key,
+		ProjectName: proj.Name,
+		Action:      r.URL.RequestURI(),
+		Description: description,
+		Signature:   proj.signatureForm(MeaningReviewed),
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "sign_action.html", tvals); err != nil {
+		log.Printf("signActionPage failed to execute template: %v", err)
+	}
+}
+
+// SigningSetup displays a form for setting up or changing the
+// current user's electronic signature.
+func SigningSetup(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	ctx := r.Context()
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+	defer client.Close()
+
+	cred, err := getCredential(ctx, client, useremail)
+	if err != nil {
+		log.Printf("SigningSetup [1]: %v", err)
+		msg := "Datastore error: unable to retrieve your signing credential."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Registered  bool
+		PrintedName string
+		Updated     string
+		MinLength   int
+	}{
+		User:      useremail,
+		LoggedIn:  useremail != "",
+		MinLength: minPINLength,
+	}
+	if cred != nil {
+		loc, _ := time.LoadLocation("America/New_York")
+		tvals.Registered = true
+		tvals.PrintedName = cred.PrintedName
+		tvals.Updated = cred.Updated.In(loc).Format("2006-01-02 3:04 PM")
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "signing_setup.html", tvals); err != nil {
+		log.Printf("signingSetup failed to execute template: %v", err)
+	}
+}
+
+// SigningSetupCompleted stores the current user's signing credential.
+// Changing an existing credential requires the current PIN.
+func SigningSetupCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	ctx := r.Context()
+
+	if useremail == "" {
+		msg := "You must be logged in to set up an electronic signature."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	}
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+	defer client.Close()
+
+	old, err := getCredential(ctx, client, useremail)
+	if err != nil {
+		log.Printf("SigningSetupCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve your signing credential."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if old != nil && !old.checkPIN(r.FormValue("current_pin")) {
+		log.Printf("SigningSetupCompleted: incorrect current PIN for %s", useremail)
+		msg := "The current PIN is incorrect, your signature was not changed."
+		rmsg := "Return to signature setup"
+		messagePage(w, r, msg, rmsg, "/signing_setup")
+		return
+	}
+
+	pin := r.FormValue("pin")
+	if pin != r.FormValue("pin2") {
+		msg := "The two PINs do not match, your signature was not changed."
+		rmsg := "Return to signature setup"
+		messagePage(w, r, msg, rmsg, "/signing_setup")
+		return
+	}
+
+	cred, err := newCredential(r.FormValue("printed_name"), pin, time.Now())
+	if err != nil {
+		msg := fmt.Sprintf("Your signature was not changed: %v.", err)
+		rmsg := "Return to signature setup"
+		messagePage(w, r, msg, rmsg, "/signing_setup")
+		return
+	}
+
+	if _, err := client.Collection(signingCollection).Doc(useremail).Set(ctx, cred); err != nil {
+		log.Printf("SigningSetupCompleted [2]: %v", err)
+		msg := "Database error, your signature was not changed."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, "/dashboard")
+		return
+	}
+
+	msg := fmt.Sprintf("Your electronic signature has been set up with the printed name \"%s\".", cred.PrintedName)
+	rmsg := "Return to dashboard"
+	messagePage(w, r, msg, rmsg, "/dashboard")
+}
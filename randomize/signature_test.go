@@ -0,0 +1,88 @@
+package randomize
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigningCredential(t *testing.T) {
+
+	now := time.Date(2021, 5, 3, 14, 0, 0, 0, time.UTC)
+
+	if _, err := newCredential(" ", "longenough", now); err == nil {
+		t.Errorf("blank printed name was accepted")
+	}
+	if _, err := newCredential("Jane Doe", "short", now); err == nil {
+		t.Errorf("short PIN was accepted")
+	}
+
+	cred, err := newCredential(" Jane Doe ", "correct horse", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.PrintedName != "Jane Doe" {
+		t.Errorf("printed name was not trimmed: %q", cred.PrintedName)
+	}
+	if strings.Contains(cred.Hash, "correct horse") || !cred.checkPIN("correct horse") {
+		t.Errorf("PIN hash is not valid")
+	}
+
+	// The same PIN has a different hash with a different salt
+	other, _ := newCredential("Jane Doe", "correct horse", now)
+	if other.Hash == cred.Hash {
+		t.Errorf("PIN hashes are not salted")
+	}
+
+	for _, tc := range []struct{ name, meaning, pin string }{
+		{"Jane Doe", "", "correct horse"},
+		{"Jane Doe", "agreed", "correct horse"},
+		{"John Doe", MeaningApproved, "correct horse"},
+		{"Jane Doe", MeaningApproved, "correct horsE"},
+	} {
+		if _, err := cred.sign("jane@example.com", tc.name, tc.meaning, tc.pin, now); err == nil {
+			t.Errorf("invalid signature %v was accepted", tc)
+		}
+	}
+
+	sig, err := cred.sign("jane@example.com", "jane doe", MeaningApproved, "correct horse", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.PrintedName != "Jane Doe" || sig.Meaning != MeaningApproved || sig.Signer != "jane@example.com" {
+		t.Errorf("unexpected signature %+v", sig)
+	}
+	if s := sig.String(); s != "Signed by Jane Doe (jane@example.com), approved, 2021-05-03 14:00:00 UTC" {
+		t.Errorf("unexpected printed signature %q", s)
+	}
+
+	if lines := signedComment([]string{"x"}, nil); len(lines) != 1 {
+		t.Errorf("unsigned comment has %d lines", len(lines))
+	}
+	if lines := signedComment([]string{"x"}, sig); len(lines) != 2 || lines[1] != sig.String() {
+		t.Errorf("signature was not added to comment")
+	}
+}
+
+func TestSignedAuditEntry(t *testing.T) {
+
+	e := &AuditEntry{
+		Time:   time.Date(2021, 5, 3, 14, 0, 0, 0, time.UTC),
+		Actor:  "jane@example.com",
+		Action: AuditEdit,
+		Target: "s1",
+	}
+	e.chain(nil)
+	unsigned := e.Hash
+
+	e.Signature = "Signed by Jane Doe (jane@example.com), approved, 2021-05-03 14:00:00 UTC"
+	e.chain(nil)
+	if e.Hash == unsigned {
+		t.Errorf("signature is not bound to the audit entry")
+	}
+
+	e.Signature = strings.Replace(e.Signature, "approved", "reviewed", 1)
+	if verifyAudit([]*AuditEntry{e}, &auditHead{Count: 1, Hash: e.Hash}) == nil {
+		t.Errorf("altered signature was not detected")
+	}
+}
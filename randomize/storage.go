@@ -0,0 +1,814 @@
+package randomize
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+// The subjects, comments and events of a project are stored as
+// documents in child collections of the project document, so that the
+// project document stays small and each change only writes the records
+// that changed.  New records are stored under random document ids, so
+// that records appended at the same time by different requests do not
+// overwrite each other.
+const (
+	subjectCollection = "Subjects"
+	commentCollection = "Comments"
+	eventCollection   = "Events"
+	memberCollection  = "Members"
+)
+
+// subjectPageSize is the number of subjects read at a time when the
+// subjects are read in pages
+const subjectPageSize = 500
+
+// maxBatchWrites is the maximum number of writes in a Firestore batch
+const maxBatchWrites = 500
+
+// childState records the child records of a project as they were
+// read or written, so that only new or changed records are written
+// back.
+type childState struct {
+
+	// loaded is true if all of the child records were read
+	loaded bool
+
+	// embedded is true if the records were found in the project
+	// document, as stored before the child collections were used
+	embedded bool
+
+	// docs contains the stored document of each child record (a
+	// *DataRecord, *Comment, *Event or *ClusterMember) that was read
+	// or written.
+	// Records that are not in docs are new.
+	docs map[interface{}]childDoc
+
+	// fetch reads the stored child record of the given collection
+	// whose field has the given value, for projects whose child
+	// records were not read, it returns nil if there is no such record
+	fetch func(collection, field, value string) (*firestore.DocumentSnapshot, error)
+}
+
+// childDoc describes the stored document of a child record.
+type childDoc struct {
+
+	// id is the document id of the record
+	id string
+
+	// stored is false for records that were read from the project
+	// document and have not yet been written to a child collection
+	stored bool
+
+	// hash is the hash of a subject record as it was stored
+	hash string
+}
+
+// embeddedChildren contains the records of a project that were stored
+// in the project document itself.
+type embeddedChildren struct {
+	RawData  []*DataRecord
+	Comments []*Comment
+	Events   []*Event
+	Members  []*ClusterMember
+}
+
+// childDocID returns the document id of the child record at position
+// i of a project that was stored in a single document.  Writing these
+// records again, if moving them to the child collections fails part
+// way, replaces the documents that were already written.
+func childDocID(i int) string {
+	return fmt.Sprintf("%08d", i)
+}
+
+// newChildDocID returns a random document id for a new child record.
+func newChildDocID() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// recordHash returns a hash of the contents of a subject record.
+func recordHash(rec *DataRecord) string {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// readDoc records that a child record was read from the given document.
+func (st *childState) readDoc(x interface{}, id string) {
+	if st.docs == nil {
+		st.docs = make(map[interface{}]childDoc)
+	}
+	d := childDoc{id: id, stored: true}
+	if rec, ok := x.(*DataRecord); ok {
+		d.hash = recordHash(rec)
+	}
+	st.docs[x] = d
+}
+
+// hasEmbedded returns true if the project document still contains
+// its subjects, comments, events or cluster members.
+func hasEmbedded(ds *firestore.DocumentSnapshot) bool {
+	return hasFields(ds, "RawData", "Comments", "Events", "Members")
+}
+
+// hasFields returns true if the document contains any of the fields.
+func hasFields(ds *firestore.DocumentSnapshot, fields ...string) bool {
+	data := ds.Data()
+	for _, f := range fields {
+		if _, ok := data[f]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readChildren reads all documents of a child collection of a
+// project in the order of the given field, decoding each one with
+// decode.
+func readChildren(ctx context.Context, client *firestore.Client, pkey, collection, order string, decode func(*firestore.DocumentSnapshot) error) error {
+
+	q := client.Doc("Project/"+pkey).Collection(collection).OrderBy(order, firestore.Asc)
+	iter := q.OrderBy(firestore.DocumentID, firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := decode(doc); err != nil {
+			return err
+		}
+	}
+}
+
+// loadProject decodes a project document and applies any outstanding
+// migrations.  If children is true the subjects, comments and events
+// are also read, from the project document if they have not yet been
+// moved to the child collections.
+func loadProject(ctx context.Context, client *firestore.Client, ds *firestore.DocumentSnapshot, children bool) (*Project, error) {
+
+	var proj Project
+	if err := ds.DataTo(&proj); err != nil {
+		return nil, err
+	}
+	proj.Key = ds.Ref.ID
+	proj.stored = &childState{}
+	st := proj.stored
+
+	// Embedded records are read even if they were not asked for,
+	// since they are in the same document, so that they are
+	// migrated and moved to the child collections by the next store.
+	// Cluster members were kept in the project document after the
+	// other records were moved.
+	if hasEmbedded(ds) {
+		var emb embeddedChildren
+		if err := ds.DataTo(&emb); err != nil {
+			return nil, err
+		}
+		st.embedded = true
+		st.docs = make(map[interface{}]childDoc)
+		proj.Members = emb.Members
+		for i, m := range proj.Members {
+			st.docs[m] = childDoc{id: childDocID(i)}
+		}
+	}
+	if hasFields(ds, "RawData", "Comments", "Events") {
+		var emb embeddedChildren
+		if err := ds.DataTo(&emb); err != nil {
+			return nil, err
+		}
+		proj.RawData = emb.RawData
+		proj.Comments = emb.Comments
+		proj.Events = emb.Events
+		st.loaded = true
+		for i, rec := range proj.RawData {
+			if len(rec.Corrections) > 0 {
+				proj.Corrected = true
+			}
+			st.docs[rec] = childDoc{id: childDocID(i)}
+		}
+		for i, c := range proj.Comments {
+			st.docs[c] = childDoc{id: childDocID(i)}
+		}
+		for i, e := range proj.Events {
+			st.docs[e] = childDoc{id: childDocID(i)}
+		}
+		proj.upgrade(ds)
+		return &proj, nil
+	}
+
+	proj.upgrade(ds)
+
+	// New events continue the stored event log.  Projects that have
+	// subjects but no event log are read in full, since the log is
+	// reconstructed from the subjects when the next event is logged.
+	if !children && proj.StoreRawData {
+		seq, err := lastEventSeq(ctx, client, proj.Key)
+		if err != nil {
+			return nil, err
+		}
+		if seq == 0 {
+			docs, err := client.Doc("Project/" + proj.Key).Collection(subjectCollection).Limit(1).Documents(ctx).GetAll()
+			if err != nil {
+				return nil, err
+			}
+			children = len(docs) > 0
+		}
+		proj.eventSeq = seq
+	}
+	if !children {
+		return &proj, nil
+	}
+	proj.eventSeq = 0
+
+	err := readChildren(ctx, client, proj.Key, subjectCollection, "AssignedTime", func(doc *firestore.DocumentSnapshot) error {
+		rec := new(DataRecord)
+		if err := doc.DataTo(rec); err != nil {
+			return err
+		}
+		proj.RawData = append(proj.RawData, rec)
+		st.readDoc(rec, doc.Ref.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = readChildren(ctx, client, proj.Key, commentCollection, "DateTime", func(doc *firestore.DocumentSnapshot) error {
+		c := new(Comment)
+		if err := doc.DataTo(c); err != nil {
+			return err
+		}
+		proj.Comments = append(proj.Comments, c)
+		st.readDoc(c, doc.Ref.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = readChildren(ctx, client, proj.Key, eventCollection, "Seq", func(doc *firestore.DocumentSnapshot) error {
+		e := new(Event)
+		if err := doc.DataTo(e); err != nil {
+			return err
+		}
+		proj.Events = append(proj.Events, e)
+		st.readDoc(e, doc.Ref.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if proj.IsCluster() {
+		err = readChildren(ctx, client, proj.Key, memberCollection, "Enrolled", func(doc *firestore.DocumentSnapshot) error {
+			m := new(ClusterMember)
+			if err := doc.DataTo(m); err != nil {
+				return err
+			}
+			proj.Members = append(proj.Members, m)
+			st.readDoc(m, doc.Ref.ID)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	st.loaded = true
+	return &proj, nil
+}
+
+// lastEventSeq returns the sequence number of the last stored event of
+// a project, or 0 if it has no stored events.
+func lastEventSeq(ctx context.Context, client *firestore.Client, pkey string) (int, error) {
+
+	docs, err := client.Doc("Project/"+pkey).Collection(eventCollection).OrderBy("Seq", firestore.Desc).Limit(1).Documents(ctx).GetAll()
+	if err != nil || len(docs) == 0 {
+		return 0, err
+	}
+
+	var e Event
+	if err := docs[0].DataTo(&e); err != nil {
+		return 0, err
+	}
+
+	return e.Seq, nil
+}
+
+// getProjectHeader returns a project without its subjects, comments
+// and events, unless they are still stored in the project document.
+// Subjects are read when they are looked up with findSubject, and
+// storing the project writes the project document and any records
+// that were read and changed or added.
+func getProjectHeader(ctx context.Context, pkey string) (*Project, error) {
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ds, err := client.Doc("Project/" + pkey).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	proj, err := loadProject(ctx, client, ds, false)
+	if err != nil {
+		return nil, err
+	}
+
+	proj.stored.fetch = func(collection, field, value string) (*firestore.DocumentSnapshot, error) {
+		client, err := firestore.NewClient(ctx, projectID)
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+		return storedChildDoc(ctx, client, pkey, collection, field, value)
+	}
+
+	return proj, nil
+}
+
+// loadSubject returns the record of a subject, reading it into the
+// project if the subjects of the project were not read.  It returns
+// nil if there is no such subject.
+func (proj *Project) loadSubject(subjectId string) (*DataRecord, error) {
+
+	if rec := proj.indexedSubject(subjectId); rec != nil {
+		return rec, nil
+	}
+
+	rec := new(DataRecord)
+	found, err := proj.stored.fetchChild(subjectCollection, "SubjectId", subjectId, rec)
+	if !found || err != nil {
+		return nil, err
+	}
+	proj.RawData = append(proj.RawData, rec)
+
+	return rec, nil
+}
+
+// loadMember returns an individual enrolled into a cluster, reading it
+// into the project if the members of the project were not read.  It
+// returns nil if there is no such individual.
+func (proj *Project) loadMember(memberId string) (*ClusterMember, error) {
+
+	if m := proj.indexedMember(memberId); m != nil {
+		return m, nil
+	}
+
+	m := new(ClusterMember)
+	found, err := proj.stored.fetchChild(memberCollection, "MemberId", memberId, m)
+	if !found || err != nil {
+		return nil, err
+	}
+	proj.Members = append(proj.Members, m)
+
+	return m, nil
+}
+
+// fetchChild reads the stored child record of the given collection
+// whose field has the given value into x, for projects whose child
+// records were not read.  It returns false if there is no such record,
+// or if all records were read.
+func (st *childState) fetchChild(collection, field, value string, x interface{}) (bool, error) {
+
+	if st == nil || st.loaded || st.fetch == nil {
+		return false, nil
+	}
+
+	doc, err := st.fetch(collection, field, value)
+	if err != nil || doc == nil {
+		return false, err
+	}
+	if err := doc.DataTo(x); err != nil {
+		return false, err
+	}
+	st.readDoc(x, doc.Ref.ID)
+
+	return true, nil
+}
+
+// fetchSubject is loadSubject for callers that cannot report errors,
+// a subject that cannot be read is treated as not found.
+func (proj *Project) fetchSubject(subjectId string) *DataRecord {
+	rec, err := proj.loadSubject(subjectId)
+	if err != nil {
+		log.Printf("fetchSubject: %s: %v", subjectId, err)
+	}
+	return rec
+}
+
+// changedRecords returns the positions of the subjects, comments,
+// events and cluster members that need to be written: those that have
+// not been stored, and subjects that have changed since they were
+// read.  If all is true, or the project was not read from the
+// database, every record is included.
+func (proj *Project) changedRecords(all bool) (subjects, comments, events, members []int) {
+
+	st := proj.stored
+	if st == nil {
+		all = true
+	}
+	changed := func(x interface{}) bool {
+		if all {
+			return true
+		}
+		d, ok := st.docs[x]
+		if !ok || !d.stored {
+			return true
+		}
+		rec, isSubject := x.(*DataRecord)
+		return isSubject && d.hash != recordHash(rec)
+	}
+
+	for i, rec := range proj.RawData {
+		if changed(rec) {
+			subjects = append(subjects, i)
+		}
+	}
+	for i, c := range proj.Comments {
+		if changed(c) {
+			comments = append(comments, i)
+		}
+	}
+	for i, e := range proj.Events {
+		if changed(e) {
+			events = append(events, i)
+		}
+	}
+	for i, m := range proj.Members {
+		if changed(m) {
+			members = append(members, i)
+		}
+	}
+
+	return subjects, comments, events, members
+}
+
+// childWrite is a pending write of one child record.
+type childWrite struct {
+	collection string
+	id         string
+	record     interface{}
+}
+
+// pendingWrites returns the writes needed to store the changed child
+// records of a project.  Records keep the document id that they were
+// read from, new records are given random ids.
+func (proj *Project) pendingWrites(all bool) []childWrite {
+
+	subjects, comments, events, members := proj.changedRecords(all)
+
+	var writes []childWrite
+	add := func(collection string, x interface{}) {
+		id := ""
+		if proj.stored != nil {
+			id = proj.stored.docs[x].id
+		}
+		if id == "" {
+			id = newChildDocID()
+		}
+		writes = append(writes, childWrite{collection, id, x})
+	}
+	for _, i := range subjects {
+		add(subjectCollection, proj.RawData[i])
+	}
+	for _, i := range comments {
+		add(commentCollection, proj.Comments[i])
+	}
+	for _, i := range events {
+		add(eventCollection, proj.Events[i])
+	}
+	for _, i := range members {
+		add(memberCollection, proj.Members[i])
+	}
+
+	return writes
+}
+
+// markWritten records that the given child records were stored.
+func (proj *Project) markWritten(writes []childWrite) {
+
+	if proj.stored == nil {
+		// A project that was not read holds all of its records
+		proj.stored = &childState{loaded: true}
+	}
+	st := proj.stored
+	for _, cw := range writes {
+		st.readDoc(cw.record, cw.id)
+	}
+	st.embedded = false
+}
+
+// errConflict is returned by saveProject when the stored project was
+// changed by another request after the project was read.
+var errConflict = errors.New("the project was changed by another request")
+
+// saveAttempts is the number of times that a change which conflicts
+// with another request is made, before the conflict is reported.
+const saveAttempts = 3
+
+// storedRevision returns the revision of a stored project document.
+func storedRevision(ds *firestore.DocumentSnapshot) int {
+	v, err := ds.DataAt("Revision")
+	if err != nil {
+		return 0
+	}
+	n, _ := v.(int64)
+	return int(n)
+}
+
+// checkRevision returns errConflict if the stored project, which has
+// the given revision, has been stored again since proj was read.
+func (proj *Project) checkRevision(stored int) error {
+	if stored != proj.Revision {
+		return errConflict
+	}
+	return nil
+}
+
+// claimRevision checks that the stored project, which has the given
+// revision, is the one that proj was read from, and gives proj the
+// next revision, under which it replaces the stored project.
+func (proj *Project) claimRevision(stored int) error {
+	if err := proj.checkRevision(stored); err != nil {
+		return err
+	}
+	proj.Revision = stored + 1
+	return nil
+}
+
+// saveProject writes the project document and its new or changed
+// child records.  If create is true the project document must not
+// already exist, and all child records are written.  Otherwise the
+// project must not have been stored since it was read, errConflict is
+// returned if it was, so that concurrent changes are not lost; the
+// change can be made again on the project as it is now.
+//
+// The project document is written in a transaction, together with the
+// child records that fit, any writes added by extra and the pending
+// audit log entries, so that none of them is stored without the
+// others.  Child records that do not fit are written first, in
+// batches, so that the stored project document is unchanged if any
+// batch fails.
+func saveProject(ctx context.Context, client *firestore.Client, pkey string, proj *Project, create bool, extra func(*firestore.Transaction) error) error {
+
+	proj.SchemaVersion = currentSchemaVersion
+	writes := proj.pendingWrites(create)
+	doc := client.Doc("Project/" + pkey)
+
+	// The transaction also holds the project document, the few extra
+	// writes and the audit log
+	reserved := 10 + len(proj.pendingAudit)
+
+	last := writes
+	if n := len(writes) - (maxBatchWrites - reserved); n > 0 {
+		if !create {
+			ds, err := doc.Get(ctx)
+			if err != nil {
+				return err
+			}
+			if err := proj.checkRevision(storedRevision(ds)); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < n; i += maxBatchWrites {
+			j := i + maxBatchWrites
+			if j > n {
+				j = n
+			}
+			batch := client.Batch()
+			for _, cw := range writes[i:j] {
+				batch.Set(doc.Collection(cw.collection).Doc(cw.id), cw.record)
+			}
+			if _, err := batch.Commit(ctx); err != nil {
+				return err
+			}
+		}
+		last = writes[n:]
+	}
+
+	revision := proj.Revision
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+
+		// All reads come before the writes
+		if !create {
+			ds, err := tx.Get(doc)
+			if err != nil {
+				return err
+			}
+			proj.Revision = revision
+			if err := proj.claimRevision(storedRevision(ds)); err != nil {
+				return err
+			}
+		} else {
+			proj.Revision = 1
+		}
+		var head *auditHead
+		if len(proj.pendingAudit) > 0 {
+			h, err := readAuditHead(ctx, client, tx, pkey)
+			if err != nil {
+				return err
+			}
+			head = chainAudit(h, proj.pendingAudit)
+		}
+
+		for _, cw := range last {
+			if err := tx.Set(doc.Collection(cw.collection).Doc(cw.id), cw.record); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if create {
+			err = tx.Create(doc, proj)
+		} else {
+			// Set replaces the whole document, removing any
+			// embedded child records
+			err = tx.Set(doc, proj)
+		}
+		if err != nil {
+			return err
+		}
+		if extra != nil {
+			if err := extra(tx); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range proj.pendingAudit {
+			if err := tx.Create(auditEntryDoc(client, pkey, e.Seq), e); err != nil {
+				return err
+			}
+		}
+		if head != nil {
+			return tx.Set(auditDoc(client, pkey), head)
+		}
+		return nil
+	})
+	if err != nil {
+		proj.Revision = revision
+		return err
+	}
+
+	proj.markWritten(writes)
+	proj.pendingAudit = nil
+
+	return nil
+}
+
+// deleteChildren deletes the child records of a project.
+func deleteChildren(ctx context.Context, client *firestore.Client, pkey string) error {
+
+	for _, collection := range []string{subjectCollection, commentCollection, eventCollection, memberCollection} {
+		col := client.Doc("Project/" + pkey).Collection(collection)
+		for {
+			docs, err := col.Limit(maxBatchWrites).Documents(ctx).GetAll()
+			if err != nil {
+				return err
+			}
+			if len(docs) == 0 {
+				break
+			}
+			batch := client.Batch()
+			for _, doc := range docs {
+				batch.Delete(doc.Ref)
+			}
+			if _, err := batch.Commit(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// subjectPages calls fn with the subjects of a project, in order of
+// assignment, reading subjectPageSize subjects at a time.
+func subjectPages(ctx context.Context, client *firestore.Client, pkey string, fn func([]*DataRecord) error) error {
+
+	col := client.Doc("Project/" + pkey).Collection(subjectCollection)
+	var last *firestore.DocumentSnapshot
+	for {
+		q := col.OrderBy("AssignedTime", firestore.Asc).OrderBy(firestore.DocumentID, firestore.Asc).Limit(subjectPageSize)
+		if last != nil {
+			q = q.StartAfter(last)
+		}
+		docs, err := q.Documents(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+
+		page := make([]*DataRecord, len(docs))
+		for i, doc := range docs {
+			page[i] = new(DataRecord)
+			if err := doc.DataTo(page[i]); err != nil {
+				return err
+			}
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+
+		if len(docs) < subjectPageSize {
+			return nil
+		}
+		last = docs[len(docs)-1]
+	}
+}
+
+// storedChildDoc returns the stored child record of the given
+// collection whose field has the given value, using the index on the
+// field, or nil if there is no such record.
+func storedChildDoc(ctx context.Context, client *firestore.Client, pkey, collection, field, value string) (*firestore.DocumentSnapshot, error) {
+
+	docs, err := client.Doc("Project/"+pkey).Collection(collection).Where(field, "==", value).Limit(1).Documents(ctx).GetAll()
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+
+	return docs[0], nil
+}
+
+// findStoredSubject returns the stored record of the subject with the
+// given id, or nil if there is no such subject.
+func findStoredSubject(ctx context.Context, client *firestore.Client, pkey, subjectId string) (*DataRecord, error) {
+
+	doc, err := storedChildDoc(ctx, client, pkey, subjectCollection, "SubjectId", subjectId)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	rec := new(DataRecord)
+	if err := doc.DataTo(rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// storedSubjectIds returns the ids of at most limit stored subjects
+// whose ids begin with prefix, in order.
+func storedSubjectIds(ctx context.Context, client *firestore.Client, pkey, prefix string, limit int) ([]string, error) {
+
+	col := client.Doc("Project/" + pkey).Collection(subjectCollection)
+	q := col.Where("SubjectId", ">=", prefix).Where("SubjectId", "<", prefix+"\uf8ff")
+	docs, err := q.OrderBy("SubjectId", firestore.Asc).Select("SubjectId").Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, doc := range docs {
+		var rec DataRecord
+		if err := doc.DataTo(&rec); err != nil {
+			return nil, err
+		}
+		ids = append(ids, rec.SubjectId)
+	}
+
+	return ids, nil
+}
+
+// storedSubjectEvents returns the stored events of one subject, in
+// the order of the event log.
+func storedSubjectEvents(ctx context.Context, client *firestore.Client, pkey, subjectId string) ([]*Event, error) {
+
+	docs, err := client.Doc("Project/"+pkey).Collection(eventCollection).Where("SubjectId", "==", subjectId).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*Event
+	for _, doc := range docs {
+		e := new(Event)
+		if err := doc.DataTo(e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+
+	return events, nil
+}
@@ -0,0 +1,208 @@
+package randomize
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestChildDocID(t *testing.T) {
+
+	// Document ids must sort in the order of the records
+	var ids []string
+	for _, i := range []int{0, 9, 10, 99, 100, 12345} {
+		ids = append(ids, childDocID(i))
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Errorf("document ids are not ordered: %v", ids)
+	}
+}
+
+func TestChangedRecords(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+	}, 1, 4, "", [][]string{{"F"}})
+	proj.Comments = append(proj.Comments, &Comment{Commenter: "user", Comment: []string{"first"}})
+
+	// A new project writes everything
+	subjects, comments, events, _ := proj.changedRecords(false)
+	if len(subjects) != 4 || len(comments) != 1 || len(events) != len(proj.Events) {
+		t.Fatalf("new project: got %v %v %v", subjects, comments, events)
+	}
+
+	// Nothing has changed after storing
+	proj.markWritten(proj.pendingWrites(false))
+	subjects, comments, events, _ = proj.changedRecords(false)
+	if subjects != nil || comments != nil || events != nil {
+		t.Fatalf("stored project: got %v %v %v", subjects, comments, events)
+	}
+
+	// A changed subject, a new subject and a new comment
+	proj.RawData[1].CurrentGroup = "changed"
+	if _, err := proj.doAssignment(map[string]string{"Sex": "M"}, "4", "user"); err != nil {
+		t.Fatal(err)
+	}
+	proj.Comments = append(proj.Comments, &Comment{Commenter: "user", Comment: []string{"second"}})
+	subjects, comments, _, _ = proj.changedRecords(false)
+	if !reflect.DeepEqual(subjects, []int{1, 4}) {
+		t.Errorf("got changed subjects %v, want [1 4]", subjects)
+	}
+	if !reflect.DeepEqual(comments, []int{1}) {
+		t.Errorf("got new comments %v, want [1]", comments)
+	}
+
+	// Everything is written for a copy
+	subjects, _, _, _ = proj.changedRecords(true)
+	if len(subjects) != 5 {
+		t.Errorf("got %d subjects for a copy, want 5", len(subjects))
+	}
+}
+
+func TestPendingWrites(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+	}, 1, 4, "", [][]string{{"F"}})
+	proj.Comments = append(proj.Comments, &Comment{Commenter: "user", Comment: []string{"first"}})
+	writes := proj.pendingWrites(false)
+	proj.markWritten(writes)
+
+	ids := make(map[string]bool)
+	for _, cw := range writes {
+		if ids[cw.id] {
+			t.Errorf("document id %s is used twice", cw.id)
+		}
+		ids[cw.id] = true
+	}
+
+	// A changed record keeps its document, a new one gets a new id
+	first := proj.stored.docs[proj.RawData[0]].id
+	proj.RawData[0].CurrentGroup = "changed"
+	if _, err := proj.doAssignment(map[string]string{"Sex": "M"}, "4", "user"); err != nil {
+		t.Fatal(err)
+	}
+	writes = proj.pendingWrites(false)
+	var got []string
+	for _, cw := range writes {
+		if cw.collection == subjectCollection {
+			got = append(got, cw.id)
+		}
+	}
+	if len(got) != 2 || got[0] != first || ids[got[1]] {
+		t.Errorf("got subject document ids %v, want %s and a new id", got, first)
+	}
+
+	// Records read from the project document are written in full,
+	// under ids given by their position
+	proj.stored = &childState{loaded: true, embedded: true, docs: make(map[interface{}]childDoc)}
+	for i, rec := range proj.RawData {
+		proj.stored.docs[rec] = childDoc{id: childDocID(i)}
+	}
+	writes = proj.pendingWrites(false)
+	n := 0
+	for _, cw := range writes {
+		if cw.collection == subjectCollection {
+			if cw.id != childDocID(n) {
+				t.Errorf("got document id %s for embedded subject %d", cw.id, n)
+			}
+			n++
+		}
+	}
+	if n != 5 {
+		t.Errorf("got %d subjects for an embedded project, want 5", n)
+	}
+}
+
+func TestHeaderOnly(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+	}, 1, 4, "", [][]string{{"F"}})
+	stored := proj.RawData[2]
+	last := proj.Events[len(proj.Events)-1].Seq
+
+	// A project read without its subjects, comments and events
+	header := &Project{
+		GroupNames:    proj.GroupNames,
+		Variables:     proj.Variables,
+		CellTotals:    proj.CellTotals,
+		Assignments:   proj.Assignments,
+		SamplingRates: proj.SamplingRates,
+		Bias:          proj.Bias,
+		Open:          true,
+		StoreRawData:  true,
+		eventSeq:      last,
+	}
+	fetched := 0
+	header.stored = &childState{
+		fetch: func(collection, field, value string) (*firestore.DocumentSnapshot, error) {
+			fetched++
+			return nil, nil
+		},
+	}
+
+	// Subjects that are not in memory are looked up
+	if rec := header.findSubject(stored.SubjectId); rec != nil || fetched != 1 {
+		t.Errorf("got %v after %d lookups", rec, fetched)
+	}
+
+	// New records are written, and the event log continues
+	if _, err := header.doAssignment(map[string]string{"Sex": "M"}, "4", "user"); err != nil {
+		t.Fatal(err)
+	}
+	header.Comments = append(header.Comments, &Comment{Commenter: "user", Comment: []string{"new"}})
+	subjects, comments, events, _ := header.changedRecords(false)
+	if len(subjects) != 1 || len(comments) != 1 || len(events) != len(header.Events) || len(events) == 0 {
+		t.Errorf("header only: got %v %v %v", subjects, comments, events)
+	}
+	if header.Events[0].Seq != last+1 {
+		t.Errorf("got event sequence %d, want %d", header.Events[0].Seq, last+1)
+	}
+}
+
+func TestConcurrentStores(t *testing.T) {
+
+	// Two requests read the project at revision 4, and each assigns
+	// a subject
+	var projs []*Project
+	for range []int{0, 1} {
+		proj := testProject(t, &Project{
+			GroupNames: []string{"A", "B"},
+			Variables: []Variable{
+				{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+			},
+		}, 1, 6, "", [][]string{{"F"}, {"M"}})
+		proj.Revision = 4
+		if _, err := proj.doAssignment(map[string]string{"Sex": "F"}, "new", "user"); err != nil {
+			t.Fatal(err)
+		}
+		projs = append(projs, proj)
+	}
+	a, b := projs[0], projs[1]
+
+	// The first store replaces revision 4, the second was read before
+	// it and is refused, rather than losing the first assignment
+	revision := 4
+	if err := a.claimRevision(revision); err != nil {
+		t.Fatal(err)
+	}
+	revision = a.Revision
+	if err := b.claimRevision(revision); err != errConflict {
+		t.Fatalf("interleaved stores both succeeded, got %v", err)
+	}
+	if revision != 5 || b.Revision != 4 {
+		t.Errorf("got revisions %d and %d, want 5 and 4", revision, b.Revision)
+	}
+}
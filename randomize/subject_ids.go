@@ -0,0 +1,495 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The check digit schemes for subject ids
+	CheckNone  = ""
+	CheckLuhn  = "luhn"
+	CheckMod11 = "mod11"
+)
+
+// SubjectIDRule restricts the subject ids that can be randomized, so
+// that transcription errors are caught before a subject is assigned
+// to a group.  A zero value accepts any id.
+type SubjectIDRule struct {
+
+	// Pattern is a regular expression that the whole id must match,
+	// no restriction if blank
+	Pattern string
+
+	// Prefixes contains the site prefixes, ids must begin with one of
+	// them if there are any
+	Prefixes []string
+
+	// CheckDigit is one of the Check constants.  The part of the id
+	// following the site prefix must then be digits ending in a check
+	// digit.
+	CheckDigit string
+
+	// AutoGenerate is true if ids are assigned sequentially, for each
+	// site prefix, rather than entered
+	AutoGenerate bool
+
+	// Digits is the number of digits of the sequential number of
+	// generated ids
+	Digits int
+
+	// Issued contains the last sequential number issued for each site
+	// prefix
+	Issued []*IssuedNumber
+}
+
+// IssuedNumber is the last sequential number issued for a site.
+type IssuedNumber struct {
+	Prefix string
+	Last   int
+}
+
+// lastIssued returns the last sequential number issued for a site.
+func (rule *SubjectIDRule) lastIssued(prefix string) int {
+	for _, x := range rule.Issued {
+		if x.Prefix == prefix {
+			return x.Last
+		}
+	}
+	return 0
+}
+
+// IsZero returns true if the rule accepts any id.
+func (rule *SubjectIDRule) IsZero() bool {
+	return rule.Pattern == "" && len(rule.Prefixes) == 0 && rule.CheckDigit == CheckNone && !rule.AutoGenerate
+}
+
+// Describe returns a printable description of the rule, or an empty
+// string if any id is accepted.
+func (rule *SubjectIDRule) Describe() string {
+
+	var parts []string
+	if len(rule.Prefixes) > 0 {
+		parts = append(parts, "begin with "+strings.Join(rule.Prefixes, " or "))
+	}
+	if rule.Pattern != "" {
+		parts = append(parts, "match "+rule.Pattern)
+	}
+	switch rule.CheckDigit {
+	case CheckLuhn:
+		parts = append(parts, "end in a Luhn check digit")
+	case CheckMod11:
+		parts = append(parts, "end in a mod-11 check digit")
+	}
+
+	if rule.AutoGenerate {
+		parts = append(parts, fmt.Sprintf("assigned automatically with %d digit numbers", rule.Digits))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// luhnDigit returns the Luhn check digit for a string of digits.
+func luhnDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// mod11Digit returns the mod-11 check digit for a string of digits.
+// The digits are weighted 2, 3, 4, ... from the right, and the check
+// digit makes the weighted sum a multiple of 11, with X standing for
+// 10.
+func mod11Digit(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		sum += (i + 2) * int(digits[len(digits)-1-i]-'0')
+	}
+	c := (11 - sum%11) % 11
+	if c == 10 {
+		return 'X'
+	}
+	return byte('0' + c)
+}
+
+// checkDigit returns the check digit of the given scheme for a string
+// of digits.
+func checkDigit(scheme, digits string) byte {
+	if scheme == CheckMod11 {
+		return mod11Digit(digits)
+	}
+	return luhnDigit(digits)
+}
+
+// allDigits returns true if s is non-empty and contains only digits.
+func allDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// prefix returns the site prefix that the id begins with, the longest
+// if there are several.  The second return value is false if the rule
+// has site prefixes and the id begins with none of them.
+func (rule *SubjectIDRule) prefix(id string) (string, bool) {
+	if len(rule.Prefixes) == 0 {
+		return "", true
+	}
+	best, found := "", false
+	for _, p := range rule.Prefixes {
+		if strings.HasPrefix(id, p) && len(p) >= len(best) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+// check returns an error describing why the id does not satisfy the
+// rule, or nil if it does.
+func (rule *SubjectIDRule) check(id string) error {
+
+	if rule.IsZero() {
+		return nil
+	}
+	if id == "" {
+		return fmt.Errorf("the subject id may not be blank")
+	}
+
+	prefix, ok := rule.prefix(id)
+	if !ok {
+		return fmt.Errorf("the id must begin with %s", strings.Join(rule.Prefixes, " or "))
+	}
+
+	if rule.Pattern != "" {
+		re, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("the id pattern of the project is not valid")
+		}
+		if !re.MatchString(id) {
+			return fmt.Errorf("the id does not match the pattern %s", rule.Pattern)
+		}
+	}
+
+	if rule.CheckDigit != CheckNone {
+		body := id[len(prefix):]
+		if len(body) < 2 || !allDigits(body[0:len(body)-1]) {
+			return fmt.Errorf("the id must end in digits followed by a check digit")
+		}
+		n := len(body) - 1
+		c := body[n]
+		if c == 'x' {
+			c = 'X'
+		}
+		if checkDigit(rule.CheckDigit, body[0:n]) != c {
+			return fmt.Errorf("the check digit is wrong, the id may have been mistyped")
+		}
+	}
+
+	return nil
+}
+
+// generate returns the id with the given sequential number and site
+// prefix.
+func (rule *SubjectIDRule) generate(prefix string, n int) string {
+	num := fmt.Sprintf("%0*d", rule.Digits, n)
+	if rule.CheckDigit != CheckNone {
+		num += string(checkDigit(rule.CheckDigit, num))
+	}
+	return prefix + num
+}
+
+// nextSubjectId returns the next unused generated id for a site. It
+// does not mark the id as issued, see issueSubjectId.
+func (proj *Project) nextSubjectId(prefix string) string {
+
+	rule := &proj.SubjectIDs
+	for n := rule.lastIssued(prefix) + 1; ; n++ {
+		id := rule.generate(prefix, n)
+		if proj.findSubject(id) == nil && proj.findScreening(id) == nil {
+			return id
+		}
+	}
+}
+
+// siteSubjectId returns the next generated id for the site chosen in
+// the submitted form.
+func (proj *Project) siteSubjectId(site string) (string, error) {
+
+	rule := &proj.SubjectIDs
+	switch {
+	case len(rule.Prefixes) == 0:
+		site = ""
+	case len(rule.Prefixes) == 1:
+		site = rule.Prefixes[0]
+	case getIndex(rule.Prefixes, site) == -1:
+		return "", fmt.Errorf("a site must be selected")
+	}
+
+	return proj.nextSubjectId(site), nil
+}
+
+// number returns the site prefix and sequential number of a
+// generated id.  The last return value is false if the id does not
+// have the form of a generated id.
+func (rule *SubjectIDRule) number(id string) (string, int, bool) {
+	prefix, ok := rule.prefix(id)
+	if !ok {
+		return "", 0, false
+	}
+	num := id[len(prefix):]
+	if rule.CheckDigit != CheckNone && len(num) > 0 {
+		num = num[0 : len(num)-1]
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return "", 0, false
+	}
+	return prefix, n, true
+}
+
+// issued returns true if the id is a generated id that has already
+// been issued.  This is known even if the subjects are not stored.
+func (rule *SubjectIDRule) issued(id string) bool {
+	if !rule.AutoGenerate {
+		return false
+	}
+	prefix, n, ok := rule.number(id)
+	return ok && n <= rule.lastIssued(prefix)
+}
+
+// issueSubjectId records that a generated id has been used, so that it
+// is not generated again.
+func (proj *Project) issueSubjectId(id string) {
+
+	rule := &proj.SubjectIDs
+	if !rule.AutoGenerate {
+		return
+	}
+	prefix, n, ok := rule.number(id)
+	if !ok {
+		return
+	}
+	for _, x := range rule.Issued {
+		if x.Prefix == prefix {
+			if n > x.Last {
+				x.Last = n
+			}
+			return
+		}
+	}
+	rule.Issued = append(rule.Issued, &IssuedNumber{Prefix: prefix, Last: n})
+}
+
+// parseSubjectIDRule reads a subject id rule from the submitted form.
+func parseSubjectIDRule(r *http.Request) (*SubjectIDRule, error) {
+
+	rule := &SubjectIDRule{
+		Pattern:      strings.TrimSpace(r.FormValue("pattern")),
+		Prefixes:     cleanSplit(r.FormValue("prefixes"), ","),
+		CheckDigit:   r.FormValue("check_digit"),
+		AutoGenerate: r.FormValue("auto_generate") == "yes",
+	}
+
+	var prefixes []string
+	for _, p := range rule.Prefixes {
+		if p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	rule.Prefixes = prefixes
+
+	if rule.Pattern != "" {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("the pattern is not a valid regular expression")
+		}
+	}
+
+	switch rule.CheckDigit {
+	case CheckNone, CheckLuhn, CheckMod11:
+	default:
+		return nil, fmt.Errorf("unknown check digit scheme")
+	}
+
+	if rule.AutoGenerate {
+		d, err := strconv.Atoi(strings.TrimSpace(r.FormValue("digits")))
+		if err != nil || d < 1 || d > 12 {
+			return nil, fmt.Errorf("the number of digits must be between 1 and 12")
+		}
+		rule.Digits = d
+
+		// Generated ids must satisfy the rest of the rule
+		sites := rule.Prefixes
+		if len(sites) == 0 {
+			sites = []string{""}
+		}
+		for _, p := range sites {
+			if err := rule.check(rule.generate(p, 1)); err != nil {
+				return nil, fmt.Errorf("generated ids such as %s would not be accepted: %v", rule.generate(p, 1), err)
+			}
+		}
+	}
+
+	return rule, nil
+}
+
+// EditSubjectIDs displays a form for setting the subject id rules.
+func EditSubjectIDs(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionEditProject, r) {
+		msg := "You don't have permission to change the subject id rules of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectHeader(ctx, pkey)
+	if err != nil {
+		log.Printf("EditSubjectIDs [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	rule := &proj.SubjectIDs
+	digits := rule.Digits
+	if digits == 0 {
+		digits = 4
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Pkey        string
+		Project     *Project
+		Rule        *SubjectIDRule
+		Prefixes    string
+		Digits      int
+		Schemes     [][]string
+		Describe    string
+		AnyAssigned bool
+	}{
+		User:     useremail,
+		LoggedIn: useremail != "",
+		Pkey:     pkey,
+		Project:  proj,
+		Rule:     rule,
+		Prefixes: strings.Join(rule.Prefixes, ", "),
+		Digits:   digits,
+		Schemes: [][]string{
+			{CheckNone, "None"},
+			{CheckLuhn, "Luhn"},
+			{CheckMod11, "Mod-11"},
+		},
+		Describe:    rule.Describe(),
+		AnyAssigned: proj.NumAssignments() > 0,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "edit_subject_ids.html", tvals); err != nil {
+		log.Printf("editSubjectIDs failed to execute template: %v", err)
+	}
+}
+
+// EditSubjectIDsCompleted stores the subject id rules.
+func EditSubjectIDsCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionEditProject, r) {
+		msg := "You don't have permission to change the subject id rules of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EditSubjectIDsCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	rule, err := parseSubjectIDRule(r)
+	if err != nil {
+		msg := fmt.Sprintf("The subject id rules were not changed: %v.", err)
+		rmsg := "Return to subject id rules"
+		messagePage(w, r, msg, rmsg, "/edit_subject_ids?pkey="+pkey)
+		return
+	}
+
+	// Sequential numbering continues from the numbers already issued
+	rule.Issued = proj.SubjectIDs.Issued
+
+	before := proj.SubjectIDs.Describe()
+	proj.SubjectIDs = *rule
+
+	desc := rule.Describe()
+	if desc == "" {
+		desc = "any id"
+	}
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  time.Now(),
+		Comment:   []string{"Subject id rules set: " + desc + "."},
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditSettings, "subject ids", before, desc)
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("EditSubjectIDsCompleted [2]: %v", err)
+		msg := "Database error, the subject id rules were not saved."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := "The subject id rules have been updated."
+	rmsg := "Return to project dashboard"
+	messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
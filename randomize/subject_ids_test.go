@@ -0,0 +1,170 @@
+package randomize
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckDigits(t *testing.T) {
+
+	// Known values: a Luhn test number and ISBN-10s
+	if c := luhnDigit("7992739871"); c != '3' {
+		t.Errorf("got Luhn digit %c, want 3", c)
+	}
+	if c := mod11Digit("030640615"); c != '2' {
+		t.Errorf("got mod-11 digit %c, want 2", c)
+	}
+	if c := mod11Digit("080442957"); c != 'X' {
+		t.Errorf("got mod-11 digit %c, want X", c)
+	}
+}
+
+func TestSubjectIDRule(t *testing.T) {
+
+	rule := &SubjectIDRule{
+		Prefixes:   []string{"NYC-", "BOS-"},
+		Pattern:    `[A-Z]{3}-[0-9]{5}`,
+		CheckDigit: CheckLuhn,
+	}
+
+	for _, id := range []string{"NYC-12344", "BOS-00000"} {
+		if err := rule.check(id); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+
+	for _, id := range []string{
+		"",          // blank
+		"CHI-12344", // unknown site
+		"NYC-1234",  // too short for the pattern
+		"NYC-12345", // wrong check digit
+		"NYC-13244", // transposed digits
+	} {
+		if err := rule.check(id); err == nil {
+			t.Errorf("%s was accepted", id)
+		}
+	}
+
+	// Mod-11 catches the 09/90 transposition that Luhn misses
+	luhn := &SubjectIDRule{CheckDigit: CheckLuhn}
+	if err := luhn.check("90" + string(luhnDigit("09"))); err != nil {
+		t.Errorf("Luhn: %v", err)
+	}
+	mod11 := &SubjectIDRule{CheckDigit: CheckMod11}
+	if err := mod11.check("90" + string(mod11Digit("09"))); err == nil {
+		t.Errorf("mod-11 accepted the transposition 09/90")
+	}
+	if err := mod11.check("030640615x"); err == nil {
+		t.Errorf("wrong X check digit was accepted")
+	}
+	if err := mod11.check("080442957x"); err != nil {
+		t.Errorf("080442957x: %v", err)
+	}
+
+	if err := (&SubjectIDRule{}).check("anything"); err != nil {
+		t.Errorf("zero rule: %v", err)
+	}
+}
+
+func TestGenerateSubjectIds(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+	}, 1, 0, "S%03d", [][]string{{"F"}})
+	proj.SubjectIDs = SubjectIDRule{
+		Prefixes:     []string{"A", "B"},
+		CheckDigit:   CheckMod11,
+		AutoGenerate: true,
+		Digits:       3,
+	}
+
+	if _, err := proj.siteSubjectId("C"); err == nil {
+		t.Errorf("unknown site was accepted")
+	}
+
+	// Numbers are issued only when a subject is randomized
+	id, err := proj.siteSubjectId("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := proj.siteSubjectId("A"); again != id {
+		t.Errorf("got %s then %s before randomizing", id, again)
+	}
+	if err := proj.SubjectIDs.check(id); err != nil {
+		t.Fatalf("generated id %s: %v", id, err)
+	}
+	if !strings.HasPrefix(id, "A001") {
+		t.Errorf("got %s, want A001 with a check digit", id)
+	}
+	if _, err := proj.doAssignment(map[string]string{"Sex": "F"}, id, "user"); err != nil {
+		t.Fatal(err)
+	}
+	proj.issueSubjectId(id)
+
+	next, _ := proj.siteSubjectId("A")
+	if !strings.HasPrefix(next, "A002") {
+		t.Errorf("got %s after %s", next, id)
+	}
+	if other, _ := proj.siteSubjectId("B"); !strings.HasPrefix(other, "B001") {
+		t.Errorf("got %s for the second site", other)
+	}
+
+	// Ids that are already in use are skipped
+	if _, err := proj.screen(next, "user", "", proj.Created); err != nil {
+		t.Fatal(err)
+	}
+	if skip, _ := proj.siteSubjectId("A"); !strings.HasPrefix(skip, "A003") {
+		t.Errorf("got %s, want A003", skip)
+	}
+
+	// Issued ids are known to be in use when the subjects are not stored
+	proj.RawData = nil
+	proj.StoreRawData = false
+	if !proj.SubjectIDs.issued(id) {
+		t.Errorf("%s is not recognized as issued", id)
+	}
+	if proj.SubjectIDs.issued(next) || proj.SubjectIDs.issued("B0010") {
+		t.Errorf("an id that was not issued is recognized as issued")
+	}
+}
+
+func TestParseSubjectIDRule(t *testing.T) {
+
+	form := func(v url.Values) *http.Request {
+		r, _ := http.NewRequest("POST", "/", strings.NewReader(v.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	rule, err := parseSubjectIDRule(form(url.Values{
+		"prefixes":      {"NYC-, BOS-"},
+		"check_digit":   {CheckLuhn},
+		"auto_generate": {"yes"},
+		"digits":        {"4"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rule.Prefixes) != 2 || rule.Prefixes[1] != "BOS-" || rule.Digits != 4 {
+		t.Errorf("got %+v", rule)
+	}
+
+	// Generated ids must match the pattern
+	_, err = parseSubjectIDRule(form(url.Values{
+		"pattern":       {`S[0-9]+`},
+		"auto_generate": {"yes"},
+		"digits":        {"4"},
+	}))
+	if err == nil {
+		t.Errorf("pattern rejecting generated ids was accepted")
+	}
+
+	if _, err = parseSubjectIDRule(form(url.Values{"pattern": {"("}})); err == nil {
+		t.Errorf("invalid pattern was accepted")
+	}
+}
@@ -0,0 +1,556 @@
+package randomize
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+)
+
+// maxSubjectMatches is the largest number of subjects listed for a
+// partial subject id
+const maxSubjectMatches = 50
+
+// indexSubjects adds the subjects that have been appended to RawData
+// since the last call to the subject index.
+func (proj *Project) indexSubjects() {
+
+	if proj.subjectIndex == nil || proj.indexed > len(proj.RawData) {
+		proj.subjectIndex = make(map[string]int)
+		proj.indexed = 0
+	}
+
+	for ; proj.indexed < len(proj.RawData); proj.indexed++ {
+		id := proj.RawData[proj.indexed].SubjectId
+		if _, ok := proj.subjectIndex[id]; !ok {
+			proj.subjectIndex[id] = proj.indexed
+		}
+	}
+}
+
+// findSubject returns the data record for the given subject (or
+// cluster), or nil if there is no such subject.  The subject is read
+// from the database if the subjects of the project were not read.
+func (proj *Project) findSubject(subjectId string) *DataRecord {
+
+	if rec := proj.indexedSubject(subjectId); rec != nil {
+		return rec
+	}
+
+	return proj.fetchSubject(subjectId)
+}
+
+// indexedSubject returns the data record for the given subject among
+// the records in RawData, or nil if there is no such record.
+func (proj *Project) indexedSubject(subjectId string) *DataRecord {
+
+	proj.indexSubjects()
+	i, ok := proj.subjectIndex[subjectId]
+	if ok && proj.RawData[i].SubjectId != subjectId {
+		// RawData was replaced, index it again
+		proj.subjectIndex = nil
+		proj.indexSubjects()
+		i, ok = proj.subjectIndex[subjectId]
+	}
+	if !ok {
+		return nil
+	}
+
+	return proj.RawData[i]
+}
+
+// HistoryEntry is one step in the history of a subject.
+type HistoryEntry struct {
+	Time        time.Time
+	Description string
+	User        string
+	Reason      string `json:",omitempty"`
+
+	// blind is the description without the treatment group, for
+	// entries whose description contains the group
+	blind string
+}
+
+// SubjectLookup is the result of looking up a subject by id.  If the
+// id identifies a single subject its record and history are given,
+// otherwise Matches lists the subjects whose ids begin with the
+// query.
+type SubjectLookup struct {
+	Query     string
+	Matches   []string         `json:",omitempty"`
+	Record    *DataRecord      `json:",omitempty"`
+	Screening *ScreeningRecord `json:",omitempty"`
+	History   []*HistoryEntry  `json:",omitempty"`
+}
+
+// Found returns true if a single subject was found.
+func (sl *SubjectLookup) Found() bool {
+	return sl.Record != nil || sl.Screening != nil
+}
+
+// blinded returns a copy of the lookup without the treatment groups
+// of the subject, for projects that require a signature to see them.
+func (sl *SubjectLookup) blinded() *SubjectLookup {
+
+	b := *sl
+	if sl.Record != nil {
+		rec := *sl.Record
+		rec.AssignedGroup = ""
+		rec.CurrentGroup = ""
+		rec.Sequence = nil
+		b.Record = &rec
+	}
+	b.History = nil
+	for _, h := range sl.History {
+		if h.blind != "" {
+			hb := *h
+			hb.Description = h.blind
+			h = &hb
+		}
+		b.History = append(b.History, h)
+	}
+
+	return &b
+}
+
+// SubjectId returns the id of the subject that was found.
+func (sl *SubjectLookup) SubjectId() string {
+	if sl.Record != nil {
+		return sl.Record.SubjectId
+	} else if sl.Screening != nil {
+		return sl.Screening.SubjectId
+	}
+	return ""
+}
+
+// blindEvent returns a description of an event that reveals the
+// treatment group, without the group, or "" if the event does not
+// reveal the group.
+func blindEvent(e *Event) string {
+	switch e.Kind {
+	case EventAssign:
+		return "Assigned to a group"
+	case EventRegroup:
+		return "Group changed"
+	}
+	return ""
+}
+
+// describeEvent returns a description of an event in the history of
+// a subject.
+func describeEvent(e *Event) string {
+	switch e.Kind {
+	case EventAssign:
+		return fmt.Sprintf("Assigned to group '%s'", e.Group)
+	case EventRegroup:
+		return fmt.Sprintf("Group changed to '%s'", e.Group)
+	case EventRemove:
+		if e.Retain {
+			return "Removed from the study, still counted in the balance"
+		}
+		return "Removed from the study"
+	case EventReinstate:
+		return "Reinstated"
+	case EventCorrect:
+		return fmt.Sprintf("%s corrected to '%s'", e.Variable, e.Level)
+	}
+	return e.Kind
+}
+
+// subjectHistory returns the history of a subject in time order,
+// combining the lifecycle transitions with the events of the subject.
+// If the event log has no events for a randomized subject, the
+// assignment and corrections are taken from the subject's record.
+func subjectHistory(rec *DataRecord, sr *ScreeningRecord, events []*Event) []*HistoryEntry {
+
+	var hist []*HistoryEntry
+
+	var changes []*StatusChange
+	if rec != nil {
+		changes = rec.History
+	} else if sr != nil {
+		changes = sr.History
+	}
+	for _, c := range changes {
+		hist = append(hist, &HistoryEntry{
+			Time:        c.Time,
+			Description: "Status changed to " + c.Status,
+			User:        c.User,
+			Reason:      c.Reason,
+		})
+	}
+
+	if len(events) == 0 && rec != nil {
+		events = append(events, &Event{
+			Time:  rec.AssignedTime,
+			Kind:  EventAssign,
+			Group: rec.AssignedGroup,
+			User:  rec.Assigner,
+		})
+		for _, c := range rec.Corrections {
+			events = append(events, &Event{
+				Time:     c.Time,
+				Kind:     EventCorrect,
+				Variable: c.Variable,
+				Level:    c.To,
+				User:     c.User,
+			})
+		}
+	}
+	for _, e := range events {
+		hist = append(hist, &HistoryEntry{
+			Time:        e.Time,
+			Description: describeEvent(e),
+			User:        e.User,
+			blind:       blindEvent(e),
+		})
+	}
+
+	sort.SliceStable(hist, func(i, j int) bool { return hist[i].Time.Before(hist[j].Time) })
+
+	return hist
+}
+
+// matchSubjects returns the ids of the randomized and screened
+// subjects whose ids begin with prefix, in order.
+func (proj *Project) matchSubjects(prefix string) []string {
+
+	var ids []string
+	for _, rec := range proj.RawData {
+		if strings.HasPrefix(rec.SubjectId, prefix) {
+			ids = append(ids, rec.SubjectId)
+		}
+	}
+	ids = append(ids, proj.matchScreening(prefix)...)
+	sort.Strings(ids)
+
+	if len(ids) > maxSubjectMatches {
+		ids = ids[0:maxSubjectMatches]
+	}
+	return ids
+}
+
+// matchScreening returns the ids of the subjects in the screening log
+// whose ids begin with prefix.
+func (proj *Project) matchScreening(prefix string) []string {
+	var ids []string
+	for _, sr := range proj.Screening {
+		if strings.HasPrefix(sr.SubjectId, prefix) {
+			ids = append(ids, sr.SubjectId)
+		}
+	}
+	return ids
+}
+
+// lookupSubject looks up a subject in a project whose subjects and
+// events have been read.
+func (proj *Project) lookupSubject(q string) *SubjectLookup {
+
+	sl := &SubjectLookup{Query: q}
+	id := q
+	if proj.findSubject(id) == nil && proj.findScreening(id) == nil {
+		sl.Matches = proj.matchSubjects(q)
+		if len(sl.Matches) != 1 {
+			return sl
+		}
+		id = sl.Matches[0]
+	}
+
+	sl.Record = proj.findSubject(id)
+	sl.Screening = proj.findScreening(id)
+
+	events := proj.Events
+	if len(events) == 0 && len(proj.RawData) > 0 {
+		events = proj.deriveEvents()
+	}
+	var subjectEvents []*Event
+	for _, e := range events {
+		if e.SubjectId == id {
+			subjectEvents = append(subjectEvents, e)
+		}
+	}
+	sl.History = subjectHistory(sl.Record, sl.Screening, subjectEvents)
+
+	return sl
+}
+
+// findSubjects looks up a subject using the index of the stored
+// subjects, so that only the matching subjects are read.  Projects
+// that have not been moved to the child collections are searched in
+// memory.
+func findSubjects(ctx context.Context, pkey, q string) (*Project, *SubjectLookup, error) {
+
+	proj, err := getProjectHeader(ctx, pkey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proj.stored.loaded {
+		return proj, proj.lookupSubject(q), nil
+	}
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer client.Close()
+
+	sl := &SubjectLookup{Query: q}
+	id := q
+	rec, err := findStoredSubject(ctx, client, pkey, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rec == nil && proj.findScreening(id) == nil {
+		ids, err := storedSubjectIds(ctx, client, pkey, q, maxSubjectMatches)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, proj.matchScreening(q)...)
+		sort.Strings(ids)
+		if len(ids) > maxSubjectMatches {
+			ids = ids[0:maxSubjectMatches]
+		}
+		sl.Matches = ids
+		if len(ids) != 1 {
+			return proj, sl, nil
+		}
+		id = ids[0]
+		rec, err = findStoredSubject(ctx, client, pkey, id)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sl.Record = rec
+	sl.Screening = proj.findScreening(id)
+	events, err := storedSubjectEvents(ctx, client, pkey, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	sl.History = subjectHistory(sl.Record, sl.Screening, events)
+
+	return proj, sl, nil
+}
+
+// LookupSubject displays a form for finding a subject by id, and the
+// record and history of the subject that was found.  The record shows
+// the treatment group, so it must be signed for in projects that
+// require signatures.
+func LookupSubject(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionViewData, r) {
+		msg := "You don't have permission to view the subjects of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	q := strings.TrimSpace(r.FormValue("q"))
+	var proj *Project
+	var sl *SubjectLookup
+	var err error
+	if q == "" {
+		proj, err = getProjectHeader(ctx, pkey)
+	} else {
+		proj, sl, err = findSubjects(ctx, pkey, q)
+	}
+	if err != nil {
+		log.Printf("LookupSubject [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !proj.StoreRawData {
+		msg := "Subjects can only be looked up in projects that store the subject-level data."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	// Unblinding must be signed in projects that require signatures,
+	// a list of matching ids does not show any groups
+	var sig *Signature
+	if sl != nil && sl.Found() {
+		if proj.RequireSignatures && r.Method == "GET" {
+			signActionPage(w, r, proj, fmt.Sprintf("look up subject '%s', including their treatment group", sl.SubjectId()))
+			return
+		} else if r.Method == "POST" && !proj.RequireSignatures {
+			Serve404(w)
+			return
+		}
+		var ok bool
+		sig, ok = requireSignature(ctx, proj, w, r, "/lookup_subject?pkey="+pkey)
+		if !ok {
+			return
+		}
+	} else if r.Method == "POST" {
+		Serve404(w)
+		return
+	}
+
+	type variableView struct {
+		Name     string
+		Value    string
+		Original string
+	}
+	type historyView struct {
+		Time        string
+		Description string
+		User        string
+		Reason      string
+	}
+	loc, _ := time.LoadLocation("America/New_York")
+	var variables []variableView
+	var history []historyView
+	var assigned string
+	if sl != nil && sl.Found() {
+		if rec := sl.Record; rec != nil {
+			assigned = rec.AssignedTime.In(loc).Format("2006-01-02 3:04 PM")
+			for j, va := range proj.Variables {
+				vv := variableView{Name: va.Name}
+				if j < len(rec.Data) {
+					vv.Value = rec.Data[j]
+				}
+				if j < len(rec.OriginalData) && rec.OriginalData[j] != vv.Value {
+					vv.Original = rec.OriginalData[j]
+				}
+				variables = append(variables, vv)
+			}
+		}
+		for _, h := range sl.History {
+			history = append(history, historyView{
+				Time:        h.Time.In(loc).Format("2006-01-02 3:04 PM"),
+				Description: h.Description,
+				User:        h.User,
+				Reason:      h.Reason,
+			})
+		}
+		if err := recordSignedAudit(ctx, pkey, useremail, AuditViewData, sl.SubjectId(), nil, "subject lookup", sig); err != nil {
+			msg := "Database error, the lookup could not be recorded in the audit log."
+			rmsg := "Return to project dashboard"
+			messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		}
+	}
+
+	tvals := struct {
+		User      string
+		LoggedIn  bool
+		Pkey      string
+		Project   *Project
+		Query     string
+		Lookup    *SubjectLookup
+		Assigned  string
+		Variables []variableView
+		History   []historyView
+	}{
+		User:      useremail,
+		LoggedIn:  useremail != "",
+		Pkey:      pkey,
+		Project:   proj,
+		Query:     q,
+		Lookup:    sl,
+		Assigned:  assigned,
+		Variables: variables,
+		History:   history,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "lookup_subject.html", tvals); err != nil {
+		log.Printf("LookupSubject failed to execute template: %v", err)
+	}
+}
+
+// writeLookupError writes an error response from LookupSubjectAPI.
+func writeLookupError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"Error": msg})
+}
+
+// LookupSubjectAPI finds a subject by id, or lists the subjects whose
+// ids begin with the given id, returning the result as JSON.  In
+// projects that require signatures the treatment groups are only
+// given if the request is a POST that includes a signature, they are
+// left out otherwise.
+func LookupSubjectAPI(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionViewData, r) {
+		writeLookupError(w, http.StatusForbidden, "You don't have permission to view the subjects of this project.")
+		return
+	}
+
+	q := strings.TrimSpace(r.FormValue("q"))
+	if q == "" {
+		writeLookupError(w, http.StatusBadRequest, "No subject id was given.")
+		return
+	}
+
+	proj, sl, err := findSubjects(ctx, pkey, q)
+	if err != nil {
+		log.Printf("LookupSubjectAPI [1]: %v", err)
+		writeLookupError(w, http.StatusInternalServerError, "Datastore error: unable to retrieve project.")
+		return
+	}
+	if !proj.StoreRawData {
+		writeLookupError(w, http.StatusBadRequest, "Subjects can only be looked up in projects that store the subject-level data.")
+		return
+	}
+
+	var sig *Signature
+	if proj.RequireSignatures && r.Method == "POST" {
+		sig, err = signAction(ctx, r)
+		if err != nil {
+			writeLookupError(w, http.StatusForbidden, fmt.Sprintf("The signature was not accepted: %v.", err))
+			return
+		}
+	}
+
+	if sl.Found() {
+		what := "subject lookup"
+		if proj.RequireSignatures && sig == nil {
+			sl = sl.blinded()
+			what = "subject lookup without the treatment group"
+		}
+		if err := recordSignedAudit(ctx, pkey, userEmail(r), AuditViewData, sl.SubjectId(), nil, what, sig); err != nil {
+			writeLookupError(w, http.StatusInternalServerError, "Datastore error: unable to record the lookup in the audit log.")
+			return
+		}
+	} else if len(sl.Matches) == 0 {
+		writeLookupError(w, http.StatusNotFound, fmt.Sprintf("There is no subject with id '%s' in this project.", q))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(sl); err != nil {
+		log.Printf("LookupSubjectAPI [2]: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package randomize
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindSubject(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+	}, 1, 20, "S%03d", [][]string{{"F"}})
+
+	if rec := proj.findSubject("S007"); rec == nil || rec.SubjectId != "S007" {
+		t.Fatalf("S007 not found")
+	}
+	if rec := proj.findSubject("S999"); rec != nil {
+		t.Errorf("found a subject that does not exist")
+	}
+
+	// Subjects assigned after the index was built are found
+	if _, err := proj.doAssignment(map[string]string{"Sex": "M"}, "S020", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := proj.findSubject("S020"); rec == nil || rec.SubjectId != "S020" {
+		t.Errorf("new subject not found")
+	}
+
+	// The index is rebuilt if the records are replaced
+	proj.RawData = []*DataRecord{proj.RawData[3], proj.RawData[0]}
+	if rec := proj.findSubject("S000"); rec == nil || rec.SubjectId != "S000" {
+		t.Errorf("S000 not found after the records were replaced")
+	}
+	if rec := proj.findSubject("S010"); rec != nil {
+		t.Errorf("found a subject that was no longer present")
+	}
+}
+
+func TestLookupSubject(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+	}, 1, 12, "S%03d", [][]string{{"F"}})
+	now := time.Now()
+	if _, err := proj.screen("X01", "user", "", now); err != nil {
+		t.Fatal(err)
+	}
+	rec := proj.findSubject("S003")
+	if err := proj.removeSubject(rec, "Withdrew consent", "moved away", false, "user2", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// An exact id gives the record and history
+	sl := proj.lookupSubject("S003")
+	if !sl.Found() || sl.Record != rec || sl.Matches != nil {
+		t.Fatalf("S003: got %+v", sl)
+	}
+	var desc []string
+	for _, h := range sl.History {
+		desc = append(desc, h.Description)
+	}
+	want := []string{fmt.Sprintf("Assigned to group '%s'", rec.AssignedGroup), "Removed from the study"}
+	found := 0
+	for _, d := range desc {
+		for _, w := range want {
+			if d == w {
+				found++
+			}
+		}
+	}
+	if found != len(want) {
+		t.Errorf("S003 history %v does not contain %v", desc, want)
+	}
+
+	// Without a signature the groups are left out, the subject's
+	// record is not changed
+	bl := sl.blinded()
+	if bl.Record.AssignedGroup != "" || bl.Record.CurrentGroup != "" || bl.SubjectId() != "S003" {
+		t.Errorf("blinded lookup has groups: %+v", bl.Record)
+	}
+	for _, h := range bl.History {
+		if strings.Contains(h.Description, "'") {
+			t.Errorf("blinded history shows %q", h.Description)
+		}
+	}
+	if rec.AssignedGroup == "" || sl.Record != rec || len(bl.History) != len(sl.History) {
+		t.Errorf("blinding changed the lookup")
+	}
+
+	// A prefix lists the matching subjects
+	sl = proj.lookupSubject("S00")
+	if sl.Found() || len(sl.Matches) != 10 {
+		t.Errorf("S00: got %v", sl.Matches)
+	}
+
+	// Only the subjects with the prefix are listed, and a prefix with
+	// a single match gives that subject
+	sl = proj.lookupSubject("S01")
+	if sl.Found() || !reflect.DeepEqual(sl.Matches, []string{"S010", "S011"}) {
+		t.Errorf("S01: got %v", sl.Matches)
+	}
+	sl = proj.lookupSubject("S011")
+	if !sl.Found() || sl.SubjectId() != "S011" {
+		t.Errorf("S011 not found")
+	}
+	sl = proj.lookupSubject("X")
+	if !sl.Found() || sl.Screening == nil || sl.SubjectId() != "X01" {
+		t.Errorf("screened subject X01 not found: %+v", sl)
+	}
+
+	sl = proj.lookupSubject("Z")
+	if sl.Found() || len(sl.Matches) != 0 {
+		t.Errorf("Z: got %+v", sl)
+	}
+}
@@ -0,0 +1,355 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// levelKey returns the key used in LevelTargets for the given level of
+// the given variable.
+func levelKey(variable, level string) string {
+	return variable + "=" + level
+}
+
+// groupTarget returns the target number of subjects for the given
+// group, or zero if there is no target.
+func (proj *Project) groupTarget(group int) int {
+	if group < len(proj.GroupTargets) {
+		return proj.GroupTargets[group]
+	}
+	return 0
+}
+
+// groupFull returns true if the given group has reached its target.
+// The targets use the counts that are balanced, so subjects removed
+// with their balance retained still count toward them.
+func (proj *Project) groupFull(group int) bool {
+	n := proj.groupTarget(group)
+	return n > 0 && proj.Assignments[group] >= n
+}
+
+// levelCount returns the number of subjects with the given level of
+// the given variable, over all groups, that count toward balance: the
+// included subjects and those removed with their balance retained.
+func (proj *Project) levelCount(variable, level int) int {
+	var n float64
+	for g := range proj.GroupNames {
+		n += proj.GetData(variable, level, g)
+	}
+	return int(n)
+}
+
+// targetReached returns true if the overall target sample size has
+// been reached, counting subjects in the same way as groupFull.
+func (proj *Project) targetReached() bool {
+	return proj.TargetTotal > 0 && proj.NumAssignments() >= proj.TargetTotal
+}
+
+// capError returns an error if a subject with the given variable
+// values cannot be enrolled because the overall target, the target
+// for one of the subject's levels, or the targets of all open groups
+// have been reached.  Variables that are missing from mpv are not
+// checked.
+func (proj *Project) capError(mpv map[string]string) error {
+
+	if proj.targetReached() {
+		return fmt.Errorf("the target sample size of %d has been reached", proj.TargetTotal)
+	}
+
+	for j, va := range proj.Variables {
+		if err := proj.levelTargetError(j, getIndex(va.Levels, mpv[va.Name])); err != nil {
+			return err
+		}
+	}
+
+	if len(proj.eligibleGroups()) == 0 {
+		return fmt.Errorf("all open treatment groups have reached their targets")
+	}
+
+	return nil
+}
+
+// levelTargetError returns an error if the target for the given level
+// of the given variable has been reached.  Levels that are not known
+// (-1) are not checked.
+func (proj *Project) levelTargetError(variable, level int) error {
+
+	if level == -1 {
+		return nil
+	}
+	va := proj.Variables[variable]
+	key := levelKey(va.Name, va.Levels[level])
+	if n := proj.LevelTargets[key]; n > 0 && proj.levelCount(variable, level) >= n {
+		return fmt.Errorf("the target of %d subjects with %s has been reached", n, key)
+	}
+
+	return nil
+}
+
+// reinstateError returns an error if reinstating the given removed
+// subject would exceed a target.  Subjects removed with their balance
+// retained still count toward the targets, so reinstating them cannot.
+func (proj *Project) reinstateError(rec *DataRecord) error {
+
+	if rec.BalanceRetained {
+		return nil
+	}
+
+	if proj.targetReached() {
+		return fmt.Errorf("the target sample size of %d has been reached", proj.TargetTotal)
+	}
+	if g := getIndex(proj.GroupNames, rec.CurrentGroup); g != -1 && proj.groupFull(g) {
+		return fmt.Errorf("the target of %d subjects for group %s has been reached", proj.groupTarget(g), rec.CurrentGroup)
+	}
+	for j, va := range proj.Variables {
+		if j >= len(rec.Data) {
+			break
+		}
+		if err := proj.levelTargetError(j, getIndex(va.Levels, rec.Data[j])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eligibleGroups returns the indices of the groups that are open and
+// have not reached their targets.
+func (proj *Project) eligibleGroups() []int {
+	var ix []int
+	for _, g := range proj.openGroups() {
+		if !proj.groupFull(g) {
+			ix = append(ix, g)
+		}
+	}
+	return ix
+}
+
+// autoClose closes the project for enrollment once the overall target
+// has been reached, and records a comment.  It returns true if the
+// project was closed.
+func (proj *Project) autoClose(user string, now time.Time) bool {
+
+	if !proj.Open || !proj.targetReached() {
+		return false
+	}
+
+	proj.Open = false
+	comment := &Comment{
+		Commenter: user,
+		DateTime:  now,
+		Comment: []string{
+			fmt.Sprintf("Enrollment closed automatically, the target sample size of %d was reached.", proj.TargetTotal),
+		},
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	return true
+}
+
+// EditTargets displays a form for setting the enrollment targets.
+func EditTargets(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionOpenClose, r) {
+		msg := "You don't have permission to change the enrollment targets of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EditTargets [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	type targetRow struct {
+		Label  string
+		Field  string
+		Count  int
+		Target int
+	}
+
+	var groups []targetRow
+	for g, name := range proj.GroupNames {
+		groups = append(groups, targetRow{
+			Label:  name,
+			Field:  fmt.Sprintf("group%d", g),
+			Count:  proj.Assignments[g],
+			Target: proj.groupTarget(g),
+		})
+	}
+
+	var levels []targetRow
+	for j, va := range proj.Variables {
+		for k, lev := range va.Levels {
+			key := levelKey(va.Name, lev)
+			levels = append(levels, targetRow{
+				Label:  key,
+				Field:  fmt.Sprintf("level%d_%d", j, k),
+				Count:  proj.levelCount(j, k),
+				Target: proj.LevelTargets[key],
+			})
+		}
+	}
+
+	tvals := struct {
+		User     string
+		LoggedIn bool
+		Pkey     string
+		Project  *Project
+		Total    int
+		Groups   []targetRow
+		Levels   []targetRow
+	}{
+		User:     useremail,
+		LoggedIn: useremail != "",
+		Pkey:     pkey,
+		Project:  proj,
+		Total:    proj.NumAssignments(),
+		Groups:   groups,
+		Levels:   levels,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "edit_targets.html", tvals); err != nil {
+		log.Printf("editTargets failed to execute template: %v", err)
+	}
+}
+
+// EditTargetsCompleted stores the enrollment targets.
+func EditTargetsCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionOpenClose, r) {
+		msg := "You don't have permission to change the enrollment targets of this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("EditTargetsCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	// A blank field means that there is no target.
+	var bad []string
+	parseTarget := func(label, field string) int {
+		x := strings.TrimSpace(r.FormValue(field))
+		if x == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(x)
+		if err != nil || n < 0 {
+			bad = append(bad, label)
+			return 0
+		}
+		return n
+	}
+
+	total := parseTarget("overall", "total")
+	groupTargets := make([]int, len(proj.GroupNames))
+	for g, name := range proj.GroupNames {
+		groupTargets[g] = parseTarget(name, fmt.Sprintf("group%d", g))
+	}
+	levelTargets := make(map[string]int)
+	for j, va := range proj.Variables {
+		for k, lev := range va.Levels {
+			key := levelKey(va.Name, lev)
+			if n := parseTarget(key, fmt.Sprintf("level%d_%d", j, k)); n > 0 {
+				levelTargets[key] = n
+			}
+		}
+	}
+
+	if len(bad) > 0 {
+		msg := fmt.Sprintf("The targets must be non-negative whole numbers, please correct: %s.", strings.Join(bad, ", "))
+		rmsg := "Return to enrollment targets"
+		messagePage(w, r, msg, rmsg, "/edit_targets?pkey="+pkey)
+		return
+	}
+
+	before := map[string]interface{}{
+		"Total": proj.TargetTotal, "Groups": proj.GroupTargets, "Levels": proj.LevelTargets,
+	}
+	proj.TargetTotal = total
+	proj.GroupTargets = groupTargets
+	proj.LevelTargets = levelTargets
+
+	var desc []string
+	if total > 0 {
+		desc = append(desc, fmt.Sprintf("overall %d", total))
+	}
+	for g, n := range groupTargets {
+		if n > 0 {
+			desc = append(desc, fmt.Sprintf("%s %d", proj.GroupNames[g], n))
+		}
+	}
+	for _, va := range proj.Variables {
+		for _, lev := range va.Levels {
+			key := levelKey(va.Name, lev)
+			if n := levelTargets[key]; n > 0 {
+				desc = append(desc, fmt.Sprintf("%s %d", key, n))
+			}
+		}
+	}
+	if len(desc) == 0 {
+		desc = append(desc, "none")
+	}
+
+	now := time.Now()
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  now,
+		Comment:   []string{"Enrollment targets set: " + strings.Join(desc, ", ") + "."},
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	msg := "The enrollment targets have been updated."
+	if proj.autoClose(useremail, now) {
+		msg += " The overall target has already been reached, so the project has been closed for enrollment."
+	}
+
+	proj.logAudit(useremail, AuditSettings, "enrollment targets", before, strings.Join(desc, ", "))
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Printf("EditTargetsCompleted [2]: %v", err)
+		msg := "Database error, the enrollment targets were not saved."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	rmsg := "Return to project dashboard"
+	messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
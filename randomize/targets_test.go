@@ -0,0 +1,59 @@
+package randomize
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEnrollmentTargets(t *testing.T) {
+
+	proj := testProject(t, &Project{
+		GroupNames: []string{"A", "B", "C"},
+		Variables: []Variable{
+			{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1},
+		},
+		TargetTotal:  30,
+		GroupTargets: []int{0, 5, 0},
+		LevelTargets: map[string]int{"Sex=M": 10},
+	}, 1, 0, "", nil)
+
+	for i := 0; i < 40; i++ {
+		mpv := map[string]string{"Sex": "F"}
+		if i%2 == 1 && proj.levelCount(0, 1) < 10 {
+			mpv["Sex"] = "M"
+		}
+		_, err := proj.doAssignment(mpv, fmt.Sprintf("%d", i), "user")
+		if i < 30 && err != nil {
+			t.Fatalf("subject %d: %v", i, err)
+		} else if i >= 30 && err == nil {
+			t.Fatalf("subject %d was enrolled beyond the target", i)
+		}
+	}
+
+	if proj.Assignments[1] != 5 {
+		t.Errorf("group B should be capped at 5, has %d", proj.Assignments[1])
+	}
+	if proj.levelCount(0, 1) != 10 {
+		t.Errorf("expected 10 males, got %d", proj.levelCount(0, 1))
+	}
+	if proj.NumAssignments() != 30 || proj.Open {
+		t.Errorf("the project should close at 30 subjects")
+	}
+	if len(proj.Comments) != 1 {
+		t.Errorf("expected a comment when the project closed")
+	}
+
+	// A stratum that is full is refused even when other targets are not
+	proj.TargetTotal = 0
+	proj.Open = true
+	if err := proj.capError(map[string]string{"Sex": "M"}); err == nil {
+		t.Errorf("the male stratum is full")
+	}
+	if err := proj.capError(map[string]string{"Sex": "F"}); err != nil {
+		t.Errorf("females can still be enrolled: %v", err)
+	}
+	if proj.autoClose("user", time.Now()) {
+		t.Errorf("there is no overall target")
+	}
+}
@@ -0,0 +1,178 @@
+package randomize
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// TransferOwnership is step 1 of giving a project to a new owner.
+func TransferOwnership(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+	susers, _ := getSharedUsers(ctx, pkey)
+
+	if !checkPermission(susers, ActionTransferOwnership, r) {
+		msg := "Only the project owner can transfer ownership of a project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("TransferOwnership [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Pkey        string
+		ProjectName string
+		Roles       []Role
+	}{
+		User:        useremail,
+		LoggedIn:    useremail != "",
+		Pkey:        pkey,
+		ProjectName: proj.Name,
+		Roles:       assignableRoles,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "transfer_ownership.html", tvals); err != nil {
+		log.Printf("transferOwnership failed to execute template: %v", err)
+	}
+}
+
+// TransferOwnershipCompleted is step 2 of giving a project to a new owner.
+func TransferOwnershipCompleted(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	useremail := userEmail(r)
+	pkey := r.FormValue("pkey")
+	ctx := r.Context()
+
+	shares, _ := getShares(ctx, pkey)
+	if !checkPermission(activeRoles(shares, time.Now()), ActionTransferOwnership, r) {
+		msg := "Only the project owner can transfer ownership of a project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	proj, err := getProjectFromKey(pkey)
+	if err != nil {
+		log.Printf("TransferOwnershipCompleted [1]: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	owners, invalid := parseEmails(r.FormValue("new_owner"))
+	if len(invalid) > 0 || len(owners) != 1 {
+		msg := "A single valid email address must be provided for the new owner."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+	newOwner := owners[0]
+	oldOwner := strings.ToLower(proj.Owner)
+
+	if newOwner == oldOwner {
+		msg := fmt.Sprintf("The project is already owned by %s.", newOwner)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+	defer client.Close()
+
+	exists, err := projectNameExists(ctx, client, newOwner, proj.Name)
+	if err != nil {
+		log.Printf("TransferOwnershipCompleted [2]: %v", err)
+		msg := "Database error"
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	} else if exists {
+		msg := fmt.Sprintf("%s already owns a project named \"%s\", rename one of the projects first.", newOwner, proj.Name)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	// The new owner replaces any share they had, the previous owner
+	// can optionally remain as a collaborator.
+	delete(shares, oldOwner)
+	keepPrevious := r.FormValue("keep_previous") == "yes"
+	if keepPrevious {
+		role := Role(r.FormValue("previous_role"))
+		if !validRole(role) {
+			role = RoleViewer
+		}
+		shares[oldOwner] = Share{Role: role}
+	}
+	shares[newOwner] = Share{Role: RoleOwner}
+
+	proj.Owner = newOwner
+	comment := &Comment{
+		Commenter: useremail,
+		DateTime:  time.Now(),
+		Comment:   []string{fmt.Sprintf("Ownership transferred from %s to %s.", oldOwner, newOwner)},
+	}
+	proj.Comments = append(proj.Comments, comment)
+
+	proj.logAudit(useremail, AuditOwner, "", oldOwner, newOwner)
+
+	// The project and its sharing record are updated together
+	err = saveProject(ctx, client, pkey, proj, false, func(tx *firestore.Transaction) error {
+		return tx.Set(client.Doc("SharingByProject/"+pkey), encodeSharing(shares))
+	})
+	if err != nil {
+		log.Printf("TransferOwnershipCompleted [3]: %v", err)
+		msg := "A database error occurred, ownership was not transferred."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	// Owners find their projects by the Owner field, only the
+	// previous owner (if they keep access) is listed in SharingByUser.
+	if err := setSharingByUser(ctx, client, newOwner, pkey, false); err != nil {
+		log.Printf("TransferOwnershipCompleted [4]: %v", err)
+	}
+	if keepPrevious {
+		if err := setSharingByUser(ctx, client, oldOwner, pkey, true); err != nil {
+			log.Printf("TransferOwnershipCompleted [5]: %v", err)
+		}
+	}
+
+	log.Printf("Transferred %s from %s to %s", pkey, oldOwner, newOwner)
+	msg := fmt.Sprintf("The project \"%s\" is now owned by %s.", proj.Name, newOwner)
+	rmsg := "Return to dashboard"
+	messagePage(w, r, msg, rmsg, "/dashboard")
+}
@@ -3,15 +3,18 @@ package randomize
 import (
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"strings"
 	"time"
+
+	"cloud.google.com/go/firestore"
 )
 
 // ViewCompleteData displays the complete data in raw text form.
 func ViewCompleteData(w http.ResponseWriter, r *http.Request) {
 
-	if r.Method != "GET" {
+	if r.Method != "GET" && r.Method != "POST" {
 		Serve404(w)
 		return
 	}
@@ -20,11 +23,14 @@ func ViewCompleteData(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionViewData, r) {
 		return
 	}
 
-	proj, _ := getProjectFromKey(pkey)
+	// The subjects are read in pages below unless an earlier state is
+	// shown, or the project has not yet been moved to the child
+	// collections so that they were read with the project
+	proj, _ := getProjectHeader(ctx, pkey)
 	if !proj.StoreRawData {
 		msg := "Complete data are not stored for this project."
 		rmsg := "Return to dashboard"
@@ -32,38 +38,153 @@ func ViewCompleteData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The data can be shown as they were at an earlier time
+	what := "complete data"
+	asOf, err := parseAsOf(r)
+	if err == nil && !asOf.IsZero() && !proj.stored.loaded {
+		proj, err = getProjectFromKey(pkey)
+	}
+	if err == nil && !asOf.IsZero() {
+		proj, err = proj.asOf(asOf)
+		what = "complete data as of " + asOf.UTC().Format(time.RFC3339)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Unable to show the data at this time: %v.", err)
+		rmsg := "Return to dashboard"
+		messagePage(w, r, msg, rmsg, fmt.Sprintf("/project_dashboard?pkey=%s", pkey))
+		return
+	}
+
+	// Unblinding must be signed in projects that require signatures
+	if proj.RequireSignatures && r.Method == "GET" {
+		signActionPage(w, r, proj, "view the complete data, including the treatment group of every subject")
+		return
+	} else if r.Method == "POST" && !proj.RequireSignatures {
+		Serve404(w)
+		return
+	}
+	sig, ok := requireSignature(ctx, proj, w, r, "/project_dashboard?pkey="+pkey)
+	if !ok {
+		return
+	}
+
+	// The data are only shown once the viewing has been recorded
+	if err := recordSignedAudit(ctx, pkey, userEmail(r), AuditViewData, "", nil, what, sig); err != nil {
+		msg := "Database error, the viewing of the data could not be recorded in the audit log."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
-	// Header line
+	// The protocol information is in the project export, the header
+	// line must be the first line for programs reading the data
+	corrected := proj.Corrected
+	writeHeader(w, proj, corrected)
+
+	if proj.stored.loaded {
+		for _, rec := range proj.RawData {
+			writeDataRecord(w, proj, rec, corrected)
+		}
+		return
+	}
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		log.Printf("ViewCompleteData [1]: %v", err)
+		return
+	}
+	defer client.Close()
+
+	err = subjectPages(ctx, client, pkey, func(page []*DataRecord) error {
+		for _, rec := range page {
+			writeDataRecord(w, proj, rec, corrected)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ViewCompleteData [2]: %v", err)
+		_, _ = io.WriteString(w, "Error: the data could not be read completely.\n")
+	}
+}
+
+// writeHeader writes the header line of the complete data.
+func writeHeader(w io.Writer, proj *Project, corrected bool) {
 	_, _ = io.WriteString(w, "Subject id,Assignment date,Assignment time,")
 	_, _ = io.WriteString(w, "Assigned group,Final group,Included,Assigner")
+	_, _ = io.WriteString(w, ",Status,Status date,Status reason,Mis-stratified")
+	if len(proj.Periods) > 0 {
+		_, _ = io.WriteString(w, ",Allocation period")
+	}
+	if proj.IsCrossover() {
+		for k := 0; k < proj.NumPeriods(); k++ {
+			_, _ = io.WriteString(w, fmt.Sprintf(",Period %d treatment", k+1))
+		}
+	}
 	for _, va := range proj.Variables {
 		_, _ = io.WriteString(w, ",")
 		_, _ = io.WriteString(w, va.Name)
 	}
+	if corrected {
+		for _, va := range proj.Variables {
+			_, _ = io.WriteString(w, ",")
+			_, _ = io.WriteString(w, va.Name+" as entered")
+		}
+	}
 	_, _ = io.WriteString(w, "\n")
+}
 
-	for _, rec := range proj.RawData {
-		_, _ = io.WriteString(w, rec.SubjectId)
-		_, _ = io.WriteString(w, ",")
-		t := rec.AssignedTime
-		loc, _ := time.LoadLocation("America/New_York")
-		t = t.In(loc)
-		_, _ = io.WriteString(w, t.Format("2006-1-2"))
-		_, _ = io.WriteString(w, ",")
-		_, _ = io.WriteString(w, t.Format("3:04 PM EST"))
-		_, _ = io.WriteString(w, ",")
-		_, _ = io.WriteString(w, rec.AssignedGroup)
-		_, _ = io.WriteString(w, ",")
-		_, _ = io.WriteString(w, rec.CurrentGroup)
-		_, _ = io.WriteString(w, ",")
-		if rec.Included {
-			_, _ = io.WriteString(w, "Yes,")
-		} else {
-			_, _ = io.WriteString(w, "No,")
+// writeDataRecord writes one line of the complete data.
+func writeDataRecord(w io.Writer, proj *Project, rec *DataRecord, corrected bool) {
+	_, _ = io.WriteString(w, rec.SubjectId)
+	_, _ = io.WriteString(w, ",")
+	t := rec.AssignedTime
+	loc, _ := time.LoadLocation("America/New_York")
+	t = t.In(loc)
+	_, _ = io.WriteString(w, t.Format("2006-1-2"))
+	_, _ = io.WriteString(w, ",")
+	_, _ = io.WriteString(w, t.Format("3:04 PM EST"))
+	_, _ = io.WriteString(w, ",")
+	_, _ = io.WriteString(w, rec.AssignedGroup)
+	_, _ = io.WriteString(w, ",")
+	_, _ = io.WriteString(w, rec.CurrentGroup)
+	_, _ = io.WriteString(w, ",")
+	if rec.Included {
+		_, _ = io.WriteString(w, "Yes,")
+	} else {
+		_, _ = io.WriteString(w, "No,")
+	}
+	_, _ = io.WriteString(w, rec.Assigner+",")
+	_, _ = io.WriteString(w, rec.CurrentStatus()+",")
+	if sc := rec.LastChange(); sc != nil {
+		_, _ = io.WriteString(w, sc.Time.In(loc).Format("2006-1-2")+",")
+		_, _ = io.WriteString(w, csvField(sc.Reason)+",")
+	} else {
+		_, _ = io.WriteString(w, ",,")
+	}
+	if rec.MisStratified() {
+		_, _ = io.WriteString(w, "Yes,")
+	} else {
+		_, _ = io.WriteString(w, "No,")
+	}
+	if len(proj.Periods) > 0 {
+		_, _ = io.WriteString(w, fmt.Sprintf("%d,", rec.Period+1))
+	}
+	if proj.IsCrossover() {
+		seq := rec.Sequence
+		if len(seq) == 0 {
+			seq = proj.sequence(rec.CurrentGroup)
 		}
-		_, _ = io.WriteString(w, rec.Assigner+",")
-		_, _ = io.WriteString(w, strings.Join(rec.Data, ","))
-		_, _ = io.WriteString(w, "\n")
+		_, _ = io.WriteString(w, strings.Join(seq, ",")+",")
 	}
+	_, _ = io.WriteString(w, strings.Join(rec.Data, ","))
+	if corrected {
+		orig := rec.OriginalData
+		if orig == nil {
+			orig = rec.Data
+		}
+		_, _ = io.WriteString(w, ","+strings.Join(orig, ","))
+	}
+	_, _ = io.WriteString(w, "\n")
 }
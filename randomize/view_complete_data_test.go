@@ -0,0 +1,55 @@
+package randomize
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProtocolInfo(t *testing.T) {
+
+	proj := &Project{
+		Name:           "Trial",
+		ProtocolNumber: "P-17",
+		RegistrationID: "NCT01234567",
+		Description:    "Dose finding, phase 2",
+		GroupNames:     []string{"A", "B"},
+		CellTotals:     []float64{1, 2},
+		StoreRawData:   true,
+		Amendments: []*Amendment{
+			{Change: "Added level \"X\" to variable \"Sex\".", EffectiveDate: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	// The complete data begins with its header line
+	var buf bytes.Buffer
+	writeHeader(&buf, proj, false)
+	if !strings.HasPrefix(buf.String(), "Subject id,Assignment date,") {
+		t.Errorf("the complete data does not begin with the header: %q", buf.String())
+	}
+
+	// The JSON export contains the protocol information but not the
+	// counts used for balancing
+	b, err := json.Marshal(exportProject(proj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["ProtocolNumber"] != "P-17" || m["Description"] != "Dose finding, phase 2" {
+		t.Errorf("the export does not contain the protocol information: %s", b)
+	}
+	amend, _ := m["Amendments"].([]interface{})
+	if len(amend) != 1 || !strings.HasPrefix(amend[0].(map[string]interface{})["EffectiveDate"].(string), "2021-03-01") {
+		t.Errorf("the export does not contain the amendment: %s", b)
+	}
+	for _, k := range []string{"CellTotals", "StoreRawData", "Bias"} {
+		if _, ok := m[k]; ok {
+			t.Errorf("the export contains %s", k)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -22,7 +24,7 @@ func ViewStatistics(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	susers, _ := getSharedUsers(ctx, pkey)
 
-	if !checkAccess(pkey, susers, r) {
+	if !checkPermission(susers, ActionView, r) {
 		return
 	}
 
@@ -36,6 +38,18 @@ func ViewStatistics(w http.ResponseWriter, r *http.Request) {
 		log.Printf("View_statistics [1]: %v", err)
 		return
 	}
+
+	// The statistics can be shown as they were at an earlier time
+	asOf, err := parseAsOf(r)
+	if err == nil && !asOf.IsZero() {
+		proj, err = proj.asOf(asOf)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Unable to show the statistics at this time: %v.", err)
+		rmsg := "Return to statistics"
+		messagePage(w, r, msg, rmsg, "/view_statistics?pkey="+pkey)
+		return
+	}
 	projectView := formatProject(proj)
 
 	// Treatment assignment.
@@ -68,6 +82,83 @@ func ViewStatistics(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Factor margins, overall and within each variable level, for
+	// factorial designs.
+	var factorStat [][]string
+	var factorHeads []string
+	var marginStat [][]string
+	if len(proj.Factors) > 0 {
+		margins := proj.factorMargins()
+		for f, fa := range proj.Factors {
+			for m, lev := range fa.Levels {
+				factorHeads = append(factorHeads, fa.Name+"="+lev)
+				factorStat = append(factorStat, []string{fa.Name + "=" + lev, fmt.Sprintf("%d", margins[f][m])})
+			}
+		}
+		for j, v := range proj.Variables {
+			for k, lev := range v.Levels {
+				row := []string{v.Name + "=" + lev}
+				for f, fa := range proj.Factors {
+					for m := range fa.Levels {
+						var u float64
+						for q := 0; q < numGroups; q++ {
+							if proj.factorLevels(q)[f] == m {
+								u += proj.GetData(j, k, q)
+							}
+						}
+						row = append(row, fmt.Sprintf("%.0f", u))
+					}
+				}
+				marginStat = append(marginStat, row)
+			}
+		}
+	}
+
+	// Individual-level statistics for cluster randomized projects,
+	// using the covariates of each individual's cluster.
+	var memberAsgn [][]string
+	var memberStat [][]string
+	if proj.IsCluster() {
+		masgn, mcells := proj.memberTotals()
+		for k, v := range proj.GroupNames {
+			memberAsgn = append(memberAsgn, []string{v, fmt.Sprintf("%d", masgn[k])})
+		}
+		r := proj.maxLevels()
+		for j, v := range proj.Variables {
+			for k, lev := range v.Levels {
+				row := []string{v.Name + "=" + lev}
+				for q := 0; q < numGroups; q++ {
+					row = append(row, fmt.Sprintf("%.0f", mcells[numGroups*r*j+numGroups*k+q]))
+				}
+				memberStat = append(memberStat, row)
+			}
+		}
+	}
+
+	// Lifecycle states of the randomized subjects, and the size of
+	// the screening log.
+	var statusStat [][]string
+	var screenStat [][]string
+	if proj.StoreRawData {
+		for i, counts := range proj.statusCounts() {
+			row := []string{subjectStatuses[i]}
+			for _, n := range counts {
+				row = append(row, fmt.Sprintf("%d", n))
+			}
+			statusStat = append(statusStat, row)
+		}
+		var nscreened int
+		for _, sr := range proj.Screening {
+			if sr.Status == StatusScreened {
+				nscreened++
+			}
+		}
+		screenStat = [][]string{
+			{"Screened, not yet randomized", fmt.Sprintf("%d", nscreened)},
+			{"Screen failures", fmt.Sprintf("%d", len(proj.ScreenFailures()))},
+		}
+	}
+
 	tvals := struct {
 		User        string
 		LoggedIn    bool
@@ -76,6 +167,17 @@ func ViewStatistics(w http.ResponseWriter, r *http.Request) {
 		ProjectView *ProjectView
 		TxAsgn      [][]string
 		BalStat     [][]string
+		Periods     []*PeriodView
+		FactorStat  [][]string
+		FactorHeads []string
+		MarginStat  [][]string
+		MemberAsgn  [][]string
+		MemberStat  [][]string
+		StatusStat  [][]string
+		ScreenStat  [][]string
+		MisStrat    []string
+		AsOf        string
+		AsOfValue   string
 		Pkey        string
 	}{
 		User:        useremail,
@@ -86,6 +188,20 @@ func ViewStatistics(w http.ResponseWriter, r *http.Request) {
 		TxAsgn:      txAsgn,
 		Pkey:        pkey,
 		BalStat:     balStat,
+		Periods:     formatPeriods(proj),
+		FactorStat:  factorStat,
+		FactorHeads: factorHeads,
+		MarginStat:  marginStat,
+		MemberAsgn:  memberAsgn,
+		MemberStat:  memberStat,
+		StatusStat:  statusStat,
+		ScreenStat:  screenStat,
+		MisStrat:    proj.misStratifiedSubjects(),
+	}
+	if !asOf.IsZero() {
+		loc, _ := time.LoadLocation("America/New_York")
+		tvals.AsOf = asOf.In(loc).Format("January 2, 2006 3:04 PM")
+		tvals.AsOfValue = strings.TrimSpace(r.FormValue("as_of"))
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "view_statistics.html", tvals); err != nil {